@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errAllocateUnsupported = errors.New("preallocation not supported")
+
+type AllocationMode int
+
+const (
+	AllocateSparse AllocationMode = iota
+	AllocateFull
+)
+
+const zeroChunkSize = 1024 * 1024
+
+func ParseAllocationMode(value string) (AllocationMode, error) {
+	switch value {
+	case "sparse":
+		return AllocateSparse, nil
+	case "full":
+		return AllocateFull, nil
+	default:
+		return 0, fmt.Errorf("unknown allocation mode: %v", value)
+	}
+}
+
+func (mode AllocationMode) String() string {
+	if mode == AllocateFull {
+		return "full"
+	}
+	return "sparse"
+}
+
+// allocate grows a file to its final size. Sparse files only get their size
+// set, full allocation reserves the blocks up front so running out of space
+// shows up before the download starts rather than at the end.
+func allocate(file *os.File, length int64, mode AllocationMode) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if size > length {
+		return file.Truncate(length)
+	}
+	if size == length {
+		return nil
+	}
+	if mode == AllocateSparse {
+		return file.Truncate(length)
+	}
+	if err := fallocate(file, size, length-size); err == nil {
+		return nil
+	} else if !errors.Is(err, errAllocateUnsupported) {
+		return err
+	}
+	zeros := make([]byte, zeroChunkSize)
+	for offset := size; offset < length; offset += zeroChunkSize {
+		chunk := zeros
+		if offset+int64(len(chunk)) > length {
+			chunk = chunk[:length-offset]
+		}
+		if _, err := file.WriteAt(chunk, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(file *os.File, offset int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, offset, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errAllocateUnsupported
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+func fallocate(file *os.File, offset int64, length int64) error {
+	return errAllocateUnsupported
+}
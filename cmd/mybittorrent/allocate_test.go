@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	for _, mode := range []AllocationMode{AllocateSparse, AllocateFull} {
+		path := filepath.Join(t.TempDir(), "data.bin")
+		if err := os.WriteFile(path, []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := allocate(file, zeroChunkSize+100, mode); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(contents) != zeroChunkSize+100 {
+			t.Errorf("%v allocated length bad result - want %d, got %d", mode, zeroChunkSize+100, len(contents))
+		}
+		if !bytes.HasPrefix(contents, []byte("existing")) {
+			t.Errorf("%v allocation should keep existing data", mode)
+		}
+		if !bytes.Equal(contents[8:], make([]byte, len(contents)-8)) {
+			t.Errorf("%v allocated space should read as zeros", mode)
+		}
+	}
+}
+
+func TestAllocateShrinksLargerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := allocate(file, 4, AllocateFull); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != 4 {
+		t.Errorf("length bad result - want 4, got %d", stat.Size())
+	}
+}
+
+func TestParseAllocationMode(t *testing.T) {
+	for value, want := range map[string]AllocationMode{"sparse": AllocateSparse, "full": AllocateFull} {
+		mode, err := ParseAllocationMode(value)
+		if err != nil || mode != want {
+			t.Errorf("%v bad result - want %v, got %v (%v)", value, want, mode, err)
+		}
+	}
+	if _, err := ParseAllocationMode("eager"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const DefaultAnnounceInterval = 30 * time.Minute
+
+type Announcer struct {
+	client   *TorrentClient
+	session  *Session
+	peerId   string
+	port     int
+	interval time.Duration
+}
+
+func NewAnnouncer(client *TorrentClient, session *Session, port int) *Announcer {
+	return &Announcer{
+		client:   client,
+		session:  session,
+		peerId:   DefaultPeerId,
+		port:     port,
+		interval: DefaultAnnounceInterval,
+	}
+}
+
+func (a *Announcer) Announce(event string) ([]Peer, error) {
+	stats := a.session.Stats()
+	response, err := a.client.Announce(a.session.torrent, &AnnounceRequest{
+		PeerId:     a.peerId,
+		Port:       a.port,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       a.session.Left(),
+		Event:      event,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Interval > 0 {
+		a.interval = time.Duration(response.Interval) * time.Second
+	}
+	return response.Peers, nil
+}
+
+func (a *Announcer) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			if _, err := a.Announce("stopped"); err != nil {
+				log.Println(err)
+			}
+			return
+		case <-time.After(a.interval):
+			if _, err := a.Announce(""); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
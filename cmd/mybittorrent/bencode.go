@@ -13,6 +13,8 @@ import (
 var (
 	ErrBencodeInteger = errors.New("invalid bencode integer")
 	ErrBencodeString  = errors.New("invalid bencode string")
+	ErrBencodeEnd     = errors.New("unexpected end of bencode")
+	ErrBencodeKey     = errors.New("invalid bencode dictionary key")
 )
 
 type Bencode struct{}
@@ -35,6 +37,9 @@ func NewBencode() *Bencode {
 }
 
 func (b *Bencode) Decode(bencode string) BencodeDecoded {
+	if len(bencode) == 0 {
+		return BencodeDecoded{"", 0, ErrBencodeEnd}
+	}
 	if unicode.IsDigit(rune(bencode[0])) {
 		return b.decodeString(bencode)
 	} else if bencode[0] == 'i' {
@@ -58,6 +63,9 @@ func (b *Bencode) decodeString(bencode string) BencodeDecoded {
 	if err != nil {
 		return BencodeDecoded{"", 0, err}
 	}
+	if length < 0 || length > len(bencode)-firstColonIndex-1 {
+		return BencodeDecoded{"", 0, ErrBencodeString}
+	}
 	end := firstColonIndex + 1 + length
 	return BencodeDecoded{bencode[firstColonIndex+1 : end], end, nil}
 }
@@ -77,7 +85,7 @@ func (b *Bencode) decodeInteger(bencode string) BencodeDecoded {
 func (b *Bencode) decodeList(bencode string) BencodeDecoded {
 	list := make([]BencodeType, 0)
 	processedBencode := bencode[1:]
-	for processedBencode[0] != 'e' {
+	for len(processedBencode) > 0 && processedBencode[0] != 'e' {
 		bencodeDecoded := b.Decode(processedBencode)
 		if bencodeDecoded.err != nil {
 			return BencodeDecoded{make([]BencodeType, 0), 0, bencodeDecoded.err}
@@ -85,6 +93,9 @@ func (b *Bencode) decodeList(bencode string) BencodeDecoded {
 		processedBencode = processedBencode[bencodeDecoded.end:]
 		list = append(list, bencodeDecoded.value)
 	}
+	if len(processedBencode) == 0 {
+		return BencodeDecoded{make([]BencodeType, 0), 0, ErrBencodeEnd}
+	}
 	end := len(bencode) - len(processedBencode) + 1
 	return BencodeDecoded{list, end, nil}
 }
@@ -92,11 +103,14 @@ func (b *Bencode) decodeList(bencode string) BencodeDecoded {
 func (b *Bencode) decodeDictionary(bencode string) BencodeDecoded {
 	dict := make(map[string]interface{})
 	processedBencode := bencode[1:]
-	for processedBencode[0] != 'e' {
+	for len(processedBencode) > 0 && processedBencode[0] != 'e' {
 		key := b.Decode(processedBencode)
 		if key.err != nil {
 			return BencodeDecoded{map[interface{}]interface{}{}, 0, key.err}
 		}
+		if _, ok := key.value.(string); !ok {
+			return BencodeDecoded{map[interface{}]interface{}{}, 0, ErrBencodeKey}
+		}
 		processedBencode = processedBencode[key.end:]
 		value := b.Decode(processedBencode)
 		if value.err != nil {
@@ -105,6 +119,9 @@ func (b *Bencode) decodeDictionary(bencode string) BencodeDecoded {
 		processedBencode = processedBencode[value.end:]
 		dict[key.value.(string)] = value.value
 	}
+	if len(processedBencode) == 0 {
+		return BencodeDecoded{map[interface{}]interface{}{}, 0, ErrBencodeEnd}
+	}
 	end := len(bencode) - len(processedBencode) + 1
 	return BencodeDecoded{dict, end, nil}
 }
@@ -42,6 +42,15 @@ func TestErrDecodeBencodeInteger(t *testing.T) {
 	}
 }
 
+func TestErrBencodeTruncated(t *testing.T) {
+	for _, bencodedString := range []string{"", "10:hello", "l5:hello", "d3:key", "d3:keyi1e", "di1ei2ee", "-1:"} {
+		bencodeDecoded := NewBencode().Decode(bencodedString)
+		if bencodeDecoded.err == nil {
+			t.Errorf("%q expected error - got: %v", bencodedString, bencodeDecoded.value)
+		}
+	}
+}
+
 func TestDecodeBencode(t *testing.T) {
 	type testCase struct {
 		bencoded string
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const RechokeInterval = 10 * time.Second
+const OptimisticUnchokeInterval = 30 * time.Second
+const SnubTimeout = 60 * time.Second
+const NewPeerPeriod = time.Minute
+const DefaultUploadSlots = 4
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Choker implements the tit-for-tat unchoke algorithm: the peers that give us
+// the best rate get the regular upload slots and one extra slot rotates
+// between the others so new peers get a chance to prove themselves.
+type Choker struct {
+	clock          Clock
+	slots          int
+	optimistic     *PeerConnection
+	lastOptimistic time.Time
+	random         *rand.Rand
+}
+
+func NewChoker(clock Clock, slots int) *Choker {
+	if slots < 1 {
+		slots = DefaultUploadSlots
+	}
+	return &Choker{
+		clock:  clock,
+		slots:  slots,
+		random: rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+}
+
+func (c *Choker) Slots() int {
+	return c.slots
+}
+
+func (c *Choker) Snubbed(peer *PeerConnection) bool {
+	now := c.clock.Now()
+	if !peer.AmInterested || now.Sub(peer.connectedAt) < SnubTimeout {
+		return false
+	}
+	return peer.lastBlock.IsZero() || now.Sub(peer.lastBlock) >= SnubTimeout
+}
+
+// Rechoke decides who gets an upload slot for the next interval and returns
+// the peers whose choke state changed. Transfer counters are reset so every
+// call compares the rates of the last interval only.
+func (c *Choker) Rechoke(peers []*PeerConnection, seeding bool) []*PeerConnection {
+	now := c.clock.Now()
+	var candidates []*PeerConnection
+	present := false
+	for _, peer := range peers {
+		if peer == c.optimistic {
+			present = true
+		}
+		if !peer.PeerInterested || (!seeding && c.Snubbed(peer)) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	rate := func(peer *PeerConnection) int64 {
+		if seeding {
+			return peer.uploaded
+		}
+		return peer.downloaded
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rate(candidates[i]) > rate(candidates[j])
+	})
+	regular := c.slots - 1
+	if regular > len(candidates) {
+		regular = len(candidates)
+	}
+	unchoke := make(map[*PeerConnection]bool)
+	for _, peer := range candidates[:regular] {
+		unchoke[peer] = true
+	}
+	if !present || unchoke[c.optimistic] || !c.optimistic.PeerInterested ||
+		now.Sub(c.lastOptimistic) >= OptimisticUnchokeInterval {
+		c.optimistic = c.pickOptimistic(peers, unchoke)
+		c.lastOptimistic = now
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+	var changed []*PeerConnection
+	for _, peer := range peers {
+		choke := !unchoke[peer]
+		if peer.AmChoking != choke {
+			peer.AmChoking = choke
+			changed = append(changed, peer)
+		}
+		peer.uploaded = 0
+		peer.downloaded = 0
+	}
+	return changed
+}
+
+func (c *Choker) pickOptimistic(peers []*PeerConnection, unchoked map[*PeerConnection]bool) *PeerConnection {
+	now := c.clock.Now()
+	var pool []*PeerConnection
+	for _, peer := range peers {
+		if !peer.PeerInterested || unchoked[peer] {
+			continue
+		}
+		pool = append(pool, peer)
+		if now.Sub(peer.connectedAt) < NewPeerPeriod {
+			// Newly connected peers are three times as likely to be picked
+			// since they have nothing to trade yet.
+			pool = append(pool, peer, peer)
+		}
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[c.random.Intn(len(pool))]
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(duration time.Duration) {
+	clock.now = clock.now.Add(duration)
+}
+
+func chokerPeers(clock *fakeClock, count int) []*PeerConnection {
+	peers := make([]*PeerConnection, count)
+	for index := range peers {
+		peers[index] = &PeerConnection{
+			PeerInterested: true,
+			AmChoking:      true,
+			connectedAt:    clock.now,
+		}
+	}
+	return peers
+}
+
+func unchokedPeers(peers []*PeerConnection) map[int]bool {
+	response := make(map[int]bool)
+	for index, peer := range peers {
+		if !peer.AmChoking {
+			response[index] = true
+		}
+	}
+	return response
+}
+
+func TestChokerUnchokesTopDownloaders(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	choker := NewChoker(clock, 3)
+	peers := chokerPeers(clock, 5)
+	for index, peer := range peers {
+		peer.downloaded = int64(index * 100)
+	}
+
+	changed := choker.Rechoke(peers, false)
+
+	unchoked := unchokedPeers(peers)
+	if !unchoked[4] || !unchoked[3] {
+		t.Errorf("regular unchoke bad result - want peers 3 and 4, got %v", unchoked)
+	}
+	if len(unchoked) != 3 {
+		t.Errorf("unchoked peers bad result - want 3, got %d", len(unchoked))
+	}
+	if len(changed) != 3 {
+		t.Errorf("changed peers bad result - want 3, got %d", len(changed))
+	}
+	if peers[4].downloaded != 0 {
+		t.Errorf("rate counters should be reset - got %d", peers[4].downloaded)
+	}
+}
+
+func TestChokerUnchokesTopUploadsWhenSeeding(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	choker := NewChoker(clock, 2)
+	peers := chokerPeers(clock, 3)
+	peers[0].uploaded = 500
+	peers[1].downloaded = 900
+
+	choker.Rechoke(peers, true)
+
+	if peers[0].AmChoking {
+		t.Error("top uploader should be unchoked when seeding")
+	}
+}
+
+func TestChokerIgnoresUninterestedPeers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	choker := NewChoker(clock, 4)
+	peers := chokerPeers(clock, 2)
+	peers[0].PeerInterested = false
+	peers[0].downloaded = 1000
+
+	choker.Rechoke(peers, false)
+
+	if !peers[0].AmChoking {
+		t.Error("uninterested peer should stay choked")
+	}
+}
+
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	choker := NewChoker(clock, 1)
+	choker.random = rand.New(rand.NewSource(1))
+	peers := chokerPeers(clock, 8)
+
+	choker.Rechoke(peers, false)
+	first := choker.optimistic
+	if first == nil || first.AmChoking {
+		t.Fatal("expected an optimistic unchoke")
+	}
+
+	clock.Advance(RechokeInterval)
+	choker.Rechoke(peers, false)
+	if choker.optimistic != first {
+		t.Error("optimistic unchoke should not rotate before its interval")
+	}
+
+	seen := map[*PeerConnection]bool{first: true}
+	for i := 0; i < 10; i++ {
+		clock.Advance(OptimisticUnchokeInterval)
+		choker.Rechoke(peers, false)
+		seen[choker.optimistic] = true
+		if len(unchokedPeers(peers)) != 1 {
+			t.Fatalf("unchoked peers bad result - want 1, got %d", len(unchokedPeers(peers)))
+		}
+	}
+	if len(seen) < 2 {
+		t.Error("optimistic unchoke should rotate between peers")
+	}
+}
+
+func TestChokerAntiSnubbing(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	choker := NewChoker(clock, 2)
+	peers := chokerPeers(clock, 3)
+	for _, peer := range peers {
+		peer.AmInterested = true
+		peer.lastBlock = clock.now
+	}
+
+	clock.Advance(SnubTimeout)
+	peers[1].lastBlock = clock.now
+	peers[2].lastBlock = clock.now
+	peers[0].downloaded = 1000
+	peers[1].downloaded = 10
+
+	if !choker.Snubbed(peers[0]) {
+		t.Fatal("peer without blocks for the snub timeout should be snubbed")
+	}
+	choker.Rechoke(peers, false)
+
+	if choker.optimistic == peers[0] {
+		return
+	}
+	if !peers[0].AmChoking {
+		t.Error("snubbed peer should not get a regular unchoke")
+	}
+	if peers[1].AmChoking {
+		t.Error("best non snubbed peer should be unchoked")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const MaxConnections = 50
+const MaxCandidates = 500
+const MaxConnectFailures = 3
+const RetryInterval = 30 * time.Second
+
+// ConnectionManager keeps the pool of peer addresses we may connect to, from
+// trackers, magnet links and peer exchange, and hands them out for dialing.
+type ConnectionManager struct {
+	clock         Clock
+	mutex         sync.Mutex
+	candidates    map[string]*candidate
+	order         []string
+	wake          chan struct{}
+	utp           *UTPSocket
+	retryInterval time.Duration
+}
+
+type candidate struct {
+	connected bool
+	failures  int
+	retryAt   time.Time
+	// tcpOnly is set once a uTP connection attempt failed.
+	tcpOnly bool
+}
+
+func NewConnectionManager(clock Clock) *ConnectionManager {
+	return &ConnectionManager{
+		clock:         clock,
+		candidates:    make(map[string]*candidate),
+		wake:          make(chan struct{}, 1),
+		retryInterval: RetryInterval,
+	}
+}
+
+// validPeerAddress rejects addresses no peer can be listening on.
+func validPeerAddress(address string) bool {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port <= 0 || port > 65535 {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host != ""
+	}
+	return !ip.IsUnspecified() && !ip.IsMulticast() && !ip.Equal(net.IPv4bcast)
+}
+
+// Add puts new addresses in the pool and returns how many were accepted.
+func (manager *ConnectionManager) Add(addresses ...string) int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	added := 0
+	for _, address := range addresses {
+		if len(manager.candidates) >= MaxCandidates {
+			break
+		}
+		if _, ok := manager.candidates[address]; ok || !validPeerAddress(address) {
+			continue
+		}
+		manager.candidates[address] = &candidate{}
+		manager.order = append(manager.order, address)
+		added++
+	}
+	if added > 0 {
+		select {
+		case manager.wake <- struct{}{}:
+		default:
+		}
+	}
+	return added
+}
+
+// Next returns an address to dial and marks it connected.
+func (manager *ConnectionManager) Next() (string, bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	now := manager.clock.Now()
+	for _, address := range manager.order {
+		candidate := manager.candidates[address]
+		if !candidate.connected && !now.Before(candidate.retryAt) {
+			candidate.connected = true
+			return address, true
+		}
+	}
+	return "", false
+}
+
+// NextRetry returns when the earliest address that is not connected may be
+// dialed, false when every address is connected or the pool is empty.
+func (manager *ConnectionManager) NextRetry() (time.Time, bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	var next time.Time
+	found := false
+	for _, address := range manager.order {
+		candidate := manager.candidates[address]
+		if candidate.connected {
+			continue
+		}
+		if !found || candidate.retryAt.Before(next) {
+			next = candidate.retryAt
+			found = true
+		}
+	}
+	return next, found
+}
+
+// Disconnected returns an address to the pool. Addresses that keep failing are
+// dropped, the others are retried later.
+func (manager *ConnectionManager) Disconnected(address string, failed bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	candidate, ok := manager.candidates[address]
+	if !ok {
+		return
+	}
+	candidate.connected = false
+	if !failed {
+		candidate.retryAt = manager.clock.Now().Add(manager.retryInterval)
+		return
+	}
+	candidate.failures++
+	if candidate.failures >= MaxConnectFailures {
+		delete(manager.candidates, address)
+		for index, other := range manager.order {
+			if other == address {
+				manager.order = append(manager.order[:index], manager.order[index+1:]...)
+				break
+			}
+		}
+		return
+	}
+	candidate.retryAt = manager.clock.Now().Add(manager.retryInterval << candidate.failures)
+}
+
+// SetUTP makes Dial try uTP over the socket before falling back to TCP.
+func (manager *ConnectionManager) SetUTP(socket *UTPSocket) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.utp = socket
+}
+
+// Dial connects to an address over uTP when a socket is set, and over TCP
+// otherwise or when the peer does not answer uTP.
+func (manager *ConnectionManager) Dial(address string) (net.Conn, error) {
+	manager.mutex.Lock()
+	socket := manager.utp
+	candidate, ok := manager.candidates[address]
+	tcpOnly := ok && candidate.tcpOnly
+	manager.mutex.Unlock()
+	if socket != nil && !tcpOnly {
+		conn, err := socket.Dial(address, UTPDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		manager.mutex.Lock()
+		if candidate, ok := manager.candidates[address]; ok {
+			candidate.tcpOnly = true
+		}
+		manager.mutex.Unlock()
+	}
+	return net.DialTimeout("tcp", address, DialTimeout)
+}
+
+// Wake is signalled whenever new addresses are added.
+func (manager *ConnectionManager) Wake() <-chan struct{} {
+	return manager.wake
+}
+
+func (manager *ConnectionManager) Len() int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return len(manager.candidates)
+}
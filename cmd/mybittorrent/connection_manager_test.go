@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionManagerAdd(t *testing.T) {
+	manager := NewConnectionManager(&fakeClock{})
+	added := manager.Add("127.0.0.1:6881", "127.0.0.1:6881", "[::1]:6881", "0.0.0.0:6881", "224.0.0.1:6881",
+		"127.0.0.1:0", "127.0.0.1", "example.com:51413")
+	if added != 3 {
+		t.Errorf("added bad result - want 3, got %d", added)
+	}
+	select {
+	case <-manager.Wake():
+	default:
+		t.Error("expected wake after adding peers")
+	}
+}
+
+func TestConnectionManagerRetries(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	manager := NewConnectionManager(clock)
+	manager.Add("127.0.0.1:1", "127.0.0.1:2")
+
+	first, _ := manager.Next()
+	second, _ := manager.Next()
+	if first != "127.0.0.1:1" || second != "127.0.0.1:2" {
+		t.Errorf("next bad result - want both peers in order, got %v and %v", first, second)
+	}
+	if address, ok := manager.Next(); ok {
+		t.Errorf("connected peers should not be handed out again - got %v", address)
+	}
+
+	manager.Disconnected(first, false)
+	if retryAt, ok := manager.NextRetry(); !ok || !retryAt.Equal(clock.now.Add(RetryInterval)) {
+		t.Errorf("next retry bad result - want %v, got %v (%v)", clock.now.Add(RetryInterval), retryAt, ok)
+	}
+	for failures := 0; failures < MaxConnectFailures; failures++ {
+		if _, ok := manager.Next(); ok {
+			t.Fatal("peers should wait before being retried")
+		}
+		clock.Advance(RetryInterval << MaxConnectFailures)
+		address, ok := manager.Next()
+		if !ok || address != first {
+			t.Fatalf("retry bad result - want %v, got %v (%v)", first, address, ok)
+		}
+		manager.Disconnected(address, true)
+	}
+	if manager.Len() != 1 {
+		t.Errorf("failing peer should be dropped - got %d candidates", manager.Len())
+	}
+}
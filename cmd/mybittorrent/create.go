@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoFiles     = errors.New("no files to create a torrent from")
+	ErrPieceLength = errors.New("piece length must be a power of two of at least the block size")
+)
+
+// TargetPieces is the number of pieces an automatically chosen piece length
+// aims for.
+const TargetPieces = 1500
+
+const MaxAutoPieceLength = 16 * 1024 * 1024
+
+const CreatedBy = "mybittorrent"
+
+// CreateOptions describe the torrent to create, a zero PieceLength picks one
+// from the size of the content.
+type CreateOptions struct {
+	PieceLength int
+	Trackers    []string
+	WebSeeds    []string
+	Comment     string
+	Private     bool
+	Source      string
+}
+
+// AutoPieceLength returns the smallest power of two piece length keeping the
+// piece count near TargetPieces.
+func AutoPieceLength(length int64) int {
+	pieceLength := BlockSize
+	for pieceLength < MaxAutoPieceLength && length > int64(pieceLength)*TargetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// CreateTorrent builds the bencoded metainfo of a v1 torrent for the file or
+// directory at path, along with how fast the content was hashed.
+func CreateTorrent(path string, options CreateOptions) ([]byte, HashStats, error) {
+	// Relative paths like "." only name the content once resolved.
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, HashStats{}, err
+	}
+	files, multiFile, err := contentFiles(path)
+	if err != nil {
+		return nil, HashStats{}, err
+	}
+	var length int64
+	for _, file := range files {
+		length += int64(file.Length)
+	}
+	pieceLength := options.PieceLength
+	if pieceLength == 0 {
+		pieceLength = AutoPieceLength(length)
+	}
+	if pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, HashStats{}, ErrPieceLength
+	}
+	info := &Info{
+		Name:        filepath.Base(path),
+		PieceLength: pieceLength,
+		Length:      int(length),
+		Files:       files,
+		MultiFile:   multiFile,
+	}
+	paths := []string{path}
+	if multiFile {
+		paths = paths[:0]
+		for _, file := range files {
+			paths = append(paths, filepath.Join(append([]string{path}, file.Path...)...))
+		}
+	}
+	pieces, stats, err := hashContent(info, paths)
+	if err != nil {
+		return nil, HashStats{}, err
+	}
+
+	infoDict := map[string]interface{}{
+		"name":         info.Name,
+		"piece length": pieceLength,
+		"pieces":       string(bytes.Join(pieces, nil)),
+	}
+	if multiFile {
+		var list []interface{}
+		for _, file := range files {
+			parts := make([]interface{}, len(file.Path))
+			for index, part := range file.Path {
+				parts[index] = part
+			}
+			list = append(list, map[string]interface{}{"length": file.Length, "path": parts})
+		}
+		infoDict["files"] = list
+	} else {
+		infoDict["length"] = info.Length
+	}
+	if options.Private {
+		infoDict["private"] = 1
+	}
+	if options.Source != "" {
+		infoDict["source"] = options.Source
+	}
+	metainfo := map[string]interface{}{
+		"info":          infoDict,
+		"created by":    CreatedBy,
+		"creation date": int(time.Now().Unix()),
+	}
+	if len(options.Trackers) > 0 {
+		metainfo["announce"] = options.Trackers[0]
+	}
+	// Every tracker gets its own tier, they are tried in the order given.
+	if len(options.Trackers) > 1 {
+		var tiers []interface{}
+		for _, tracker := range options.Trackers {
+			tiers = append(tiers, []interface{}{tracker})
+		}
+		metainfo["announce-list"] = tiers
+	}
+	if len(options.WebSeeds) > 0 {
+		var seeds []interface{}
+		for _, seed := range options.WebSeeds {
+			seeds = append(seeds, seed)
+		}
+		metainfo["url-list"] = seeds
+	}
+	if options.Comment != "" {
+		metainfo["comment"] = options.Comment
+	}
+	encoded := NewBencode().encode(metainfo)
+	if encoded.err != nil {
+		return nil, HashStats{}, encoded.err
+	}
+	return []byte(encoded.value), stats, nil
+}
+
+// contentFiles lists the regular files under a directory in a stable order,
+// or the file itself when path is not a directory.
+func contentFiles(path string) ([]File, bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !stat.IsDir() {
+		return []File{{Length: int(stat.Size()), Path: []string{stat.Name()}}}, false, nil
+	}
+	var files []File
+	err = filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{
+			Length: int(stat.Size()),
+			Path:   strings.Split(filepath.ToSlash(relative), "/"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(files) == 0 {
+		return nil, false, ErrNoFiles
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Join(files[i].Path, "/") < strings.Join(files[j].Path, "/")
+	})
+	return files, true, nil
+}
+
+// hashContent hashes the pieces of the files in the order they appear in the
+// torrent.
+func hashContent(info *Info, paths []string) ([][]byte, HashStats, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := NewFileSource(paths)
+	defer source.Close()
+	pipeline := NewHashPipeline(info, 0)
+	var pieces [][]byte
+	var err error
+	for result := range pipeline.Hash(ctx, source) {
+		if result.Err != nil && err == nil {
+			err = result.Err
+			cancel()
+		}
+		pieces = append(pieces, result.Hash)
+	}
+	if err != nil {
+		return nil, HashStats{}, err
+	}
+	return pieces, pipeline.Stats(), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rawInfoHash hashes the info dictionary as it appears in the torrent.
+func rawInfoHash(t *testing.T, contents []byte) []byte {
+	begin := bytes.Index(contents, []byte("4:info")) + len("4:info")
+	decoded := NewBencode().Decode(string(contents[begin:]))
+	if decoded.err != nil {
+		t.Fatal(decoded.err)
+	}
+	hash := sha1.Sum(contents[begin : begin+decoded.end])
+	return hash[:]
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	tests := []struct {
+		length int64
+		want   int
+	}{
+		{0, BlockSize},
+		{BlockSize * TargetPieces, BlockSize},
+		{BlockSize*TargetPieces + 1, 2 * BlockSize},
+		{1 << 40, MaxAutoPieceLength},
+	}
+	for _, test := range tests {
+		if got := AutoPieceLength(test.length); got != test.want {
+			t.Errorf("piece length of %d bad result - want %d, got %d", test.length, test.want, got)
+		}
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	data := testData(3*BlockSize + 7)
+	path := filepath.Join(t.TempDir(), "single.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents, stats, err := CreateTorrent(path, CreateOptions{
+		PieceLength: BlockSize,
+		Trackers:    []string{"http://one.example/announce", "http://two.example/announce"},
+		WebSeeds:    []string{"http://seed.example/single.bin"},
+		Comment:     "test",
+		Private:     true,
+		Source:      "tests",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentPath := filepath.Join(t.TempDir(), "single.torrent")
+	if err := os.WriteFile(torrentPath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent := NewTorrentParser(NewBencode()).Parse(torrentPath)
+	if torrent.Err != nil {
+		t.Fatal(torrent.Err)
+	}
+	metainfo := torrent.Metainfo
+
+	if hash := rawInfoHash(t, contents); !bytes.Equal(metainfo.Info.Hash, hash) {
+		t.Errorf("info hash bad result - want %x, got %x", hash, metainfo.Info.Hash)
+	}
+	if stats.Bytes != int64(len(data)) || stats.Pieces != 4 {
+		t.Errorf("hash stats bad result - got %+v", stats)
+	}
+	if reference := testTorrent(data, BlockSize); !reflect.DeepEqual(metainfo.Info.Pieces, reference.Metainfo.Info.Pieces) {
+		t.Error("piece hashes do not match the data")
+	}
+	if metainfo.Announce != "http://one.example/announce" || metainfo.Info.Name != "single.bin" || metainfo.Info.MultiFile {
+		t.Errorf("metainfo bad result - got %v %v", metainfo.Announce, metainfo.Info.Name)
+	}
+	if !reflect.DeepEqual(metainfo.URLList, []string{"http://seed.example/single.bin"}) {
+		t.Errorf("url list bad result - got %v", metainfo.URLList)
+	}
+	for _, key := range []string{"13:announce-list", "7:privatei1e", "6:source5:tests", "7:comment4:test"} {
+		if !strings.Contains(string(contents), key) {
+			t.Errorf("torrent should contain %v", key)
+		}
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "content")
+	files := map[string][]byte{
+		"b.bin":       testData(BlockSize + 3),
+		"a/inner.bin": testData(10),
+		"a/empty.bin": nil,
+		"c.bin":       testData(2 * BlockSize),
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	contents, _, err := CreateTorrent(root, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := NewTorrentParser(NewBencode()).ParseBytes(contents)
+	if torrent.Err != nil {
+		t.Fatal(torrent.Err)
+	}
+	info := &torrent.Metainfo.Info
+
+	if hash := rawInfoHash(t, contents); !bytes.Equal(info.Hash, hash) {
+		t.Errorf("info hash bad result - want %x, got %x", hash, info.Hash)
+	}
+	var paths []string
+	for _, file := range info.Files {
+		paths = append(paths, strings.Join(file.Path, "/"))
+	}
+	if want := []string{"a/empty.bin", "a/inner.bin", "b.bin", "c.bin"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("files bad result - want %v, got %v", want, paths)
+	}
+	if info.Name != "content" || info.PieceLength != BlockSize {
+		t.Errorf("info bad result - got %v with piece length %d", info.Name, info.PieceLength)
+	}
+
+	storage, err := NewFileStorage(info, root, AllocateSparse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(torrent, nil)
+	defer session.Close()
+	if err := session.Attach(storage, true); err != nil {
+		t.Fatal(err)
+	}
+	if count := session.Completed().Count(len(info.Pieces)); count != len(info.Pieces) {
+		t.Errorf("verified pieces bad result - want %d, got %d", len(info.Pieces), count)
+	}
+}
+
+func TestCreateCurrentDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "content")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), testData(10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	contents, _, err := CreateTorrent(".", CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := NewTorrentParser(NewBencode()).ParseBytes(contents)
+	if torrent.Err != nil {
+		t.Fatal(torrent.Err)
+	}
+	if name := torrent.Metainfo.Info.Name; name != "content" {
+		t.Errorf("name bad result - want content, got %v", name)
+	}
+}
+
+func TestCreateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, testData(10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateTorrent(path, CreateOptions{PieceLength: 3 * BlockSize}); !errors.Is(err, ErrPieceLength) {
+		t.Errorf("expected ErrPieceLength - got: %v", err)
+	}
+	if _, _, err := CreateTorrent(t.TempDir(), CreateOptions{}); !errors.Is(err, ErrNoFiles) {
+		t.Errorf("expected ErrNoFiles - got: %v", err)
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDHTTimeout      = errors.New("dht query timed out")
+	ErrDHTClosed       = errors.New("dht closed")
+	ErrDHTBootstrap    = errors.New("dht bootstrap found no nodes")
+	ErrDHTAnnounce     = errors.New("no dht node accepted the announce")
+	ErrInvalidInfoHash = errors.New("invalid info hash")
+)
+
+const DHTQueryTimeout = 2 * time.Second
+const DHTAlpha = 3
+const DHTTokenInterval = 5 * time.Minute
+const DHTPeerTimeout = 30 * time.Minute
+const DHTMaxValues = 50
+const DHTRefreshInterval = 15 * time.Minute
+const DHTLookupInterval = 5 * time.Minute
+const MaxDHTPacket = 4096
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// DHT is a node of the mainline DHT. It answers the queries of other nodes
+// and looks up peers for an info hash, which is how trackerless torrents and
+// magnet links find peers.
+type DHT struct {
+	id           NodeId
+	port         int
+	clock        Clock
+	table        *RoutingTable
+	conn         net.PacketConn
+	mutex        sync.Mutex
+	transactions map[string]*dhtTransaction
+	transaction  uint16
+	peers        map[string]map[string]time.Time
+	secrets      [2][]byte
+	rotated      time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// LookupStep reports the answer of one node queried during a lookup.
+type LookupStep struct {
+	Node  DHTNode
+	Peers int
+	Nodes int
+	Err   error
+}
+
+// dhtTransaction is a query waiting for the node it was sent to to answer.
+type dhtTransaction struct {
+	address  *net.UDPAddr
+	response chan *krpcMessage
+}
+
+// DHTPeers is the answer of one node to get_peers.
+type DHTPeers struct {
+	Peers []string
+	Nodes []DHTNode
+	Token string
+}
+
+func NewDHT(id NodeId, port int) *DHT {
+	clock := systemClock{}
+	return &DHT{
+		id:           id,
+		port:         port,
+		clock:        clock,
+		table:        NewRoutingTable(id, clock),
+		transactions: make(map[string]*dhtTransaction),
+		peers:        make(map[string]map[string]time.Time),
+		secrets:      [2][]byte{newTokenSecret(), newTokenSecret()},
+		rotated:      clock.Now(),
+		closed:       make(chan struct{}),
+	}
+}
+
+func newTokenSecret() []byte {
+	secret := make([]byte, 8)
+	rand.Read(secret)
+	return secret
+}
+
+func (dht *DHT) Id() NodeId {
+	return dht.id
+}
+
+func (dht *DHT) Table() *RoutingTable {
+	return dht.table
+}
+
+func (dht *DHT) Listen() error {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(dht.port))
+	if err != nil {
+		return err
+	}
+	dht.conn = conn
+	dht.port = conn.LocalAddr().(*net.UDPAddr).Port
+	return nil
+}
+
+func (dht *DHT) Port() int {
+	return dht.port
+}
+
+// Serve reads packets until the DHT is closed, answering queries and handing
+// responses to the queries waiting for them.
+func (dht *DHT) Serve() error {
+	buffer := make([]byte, MaxDHTPacket)
+	bencode := NewBencode()
+	for {
+		n, address, err := dht.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-dht.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+		message, err := parseKrpcMessage(bencode, buffer[:n])
+		if err != nil {
+			continue
+		}
+		if message.Type == KrpcQuery {
+			dht.reply(bencode, message, address)
+			continue
+		}
+		// Only the queried node may answer, anyone else guessing the
+		// transaction id is ignored.
+		source, _ := address.(*net.UDPAddr)
+		dht.mutex.Lock()
+		transaction, ok := dht.transactions[message.Transaction]
+		ok = ok && source != nil && source.IP.Equal(transaction.address.IP) && source.Port == transaction.address.Port
+		if ok {
+			delete(dht.transactions, message.Transaction)
+		}
+		dht.mutex.Unlock()
+		if ok {
+			transaction.response <- message
+		}
+	}
+}
+
+func (dht *DHT) Close() error {
+	var err error
+	dht.closeOnce.Do(func() {
+		close(dht.closed)
+		if dht.conn != nil {
+			err = dht.conn.Close()
+		}
+	})
+	return err
+}
+
+func (dht *DHT) reply(bencode *Bencode, query *krpcMessage, address net.Addr) {
+	response := &krpcMessage{Transaction: query.Transaction, Type: KrpcResponse}
+	result, err := dht.handleQuery(query, address)
+	if err != nil {
+		response.Type = KrpcError
+		response.Error = err
+	} else {
+		result["id"] = string(dht.id[:])
+		response.Response = result
+	}
+	data, encodeErr := response.encode(bencode)
+	if encodeErr != nil {
+		log.Println(address, encodeErr)
+		return
+	}
+	dht.conn.WriteTo(data, address)
+}
+
+func (dht *DHT) handleQuery(query *krpcMessage, address net.Addr) (map[string]interface{}, *KrpcRemoteError) {
+	id, ok := query.nodeId()
+	if !ok {
+		return nil, &KrpcRemoteError{Code: KrpcProtocolError, Message: "invalid id"}
+	}
+	udpAddress, ok := address.(*net.UDPAddr)
+	if !ok {
+		return nil, &KrpcRemoteError{Code: KrpcServerError, Message: "unsupported address"}
+	}
+	dht.table.Insert(id, address.String())
+	switch query.Query {
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "find_node":
+		target, ok := nodeIdArgument(query.Arguments, "target")
+		if !ok {
+			return nil, &KrpcRemoteError{Code: KrpcProtocolError, Message: "invalid target"}
+		}
+		return map[string]interface{}{"nodes": string(compactNodes(dht.table.Closest(target, DHTBucketSize)))}, nil
+	case "get_peers":
+		infoHash, ok := nodeIdArgument(query.Arguments, "info_hash")
+		if !ok {
+			return nil, &KrpcRemoteError{Code: KrpcProtocolError, Message: "invalid info_hash"}
+		}
+		result := map[string]interface{}{"token": dht.token(udpAddress.IP)}
+		if peers := dht.storedPeers(infoHash); len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, peer := range peers {
+				values = append(values, peer)
+			}
+			result["values"] = values
+		} else {
+			result["nodes"] = string(compactNodes(dht.table.Closest(infoHash, DHTBucketSize)))
+		}
+		return result, nil
+	case "announce_peer":
+		infoHash, ok := nodeIdArgument(query.Arguments, "info_hash")
+		if !ok {
+			return nil, &KrpcRemoteError{Code: KrpcProtocolError, Message: "invalid info_hash"}
+		}
+		token, _ := query.Arguments["token"].(string)
+		if !dht.validToken(token, udpAddress.IP) {
+			return nil, &KrpcRemoteError{Code: KrpcProtocolError, Message: "bad token"}
+		}
+		port, _ := query.Arguments["port"].(int)
+		if implied, _ := query.Arguments["implied_port"].(int); implied != 0 {
+			port = udpAddress.Port
+		}
+		peer := net.JoinHostPort(udpAddress.IP.String(), strconv.Itoa(port))
+		if !validPeerAddress(peer) {
+			return nil, &KrpcRemoteError{Code: KrpcProtocolError, Message: "invalid port"}
+		}
+		dht.storePeer(infoHash, peer)
+		return map[string]interface{}{}, nil
+	}
+	return nil, &KrpcRemoteError{Code: KrpcMethodUnknown, Message: "method unknown"}
+}
+
+func nodeIdArgument(arguments map[string]interface{}, name string) (NodeId, bool) {
+	value, ok := arguments[name].(string)
+	if !ok || len(value) != len(NodeId{}) {
+		return NodeId{}, false
+	}
+	var id NodeId
+	copy(id[:], value)
+	return id, true
+}
+
+// token proves to us in announce_peer that the node asked get_peers from the
+// same IP recently. Secrets rotate every DHTTokenInterval and the previous one
+// stays valid, so a token lives between one and two intervals.
+func (dht *DHT) token(ip net.IP) string {
+	dht.mutex.Lock()
+	defer dht.mutex.Unlock()
+	dht.rotateSecrets()
+	return tokenFor(dht.secrets[0], ip)
+}
+
+func (dht *DHT) validToken(token string, ip net.IP) bool {
+	dht.mutex.Lock()
+	defer dht.mutex.Unlock()
+	dht.rotateSecrets()
+	return token != "" && (token == tokenFor(dht.secrets[0], ip) || token == tokenFor(dht.secrets[1], ip))
+}
+
+func (dht *DHT) rotateSecrets() {
+	now := dht.clock.Now()
+	for now.Sub(dht.rotated) >= DHTTokenInterval {
+		dht.secrets[1] = dht.secrets[0]
+		dht.secrets[0] = newTokenSecret()
+		dht.rotated = dht.rotated.Add(DHTTokenInterval)
+	}
+}
+
+func tokenFor(secret []byte, ip net.IP) string {
+	hash := sha1.Sum(append(append([]byte{}, secret...), ip...))
+	return string(hash[:8])
+}
+
+func (dht *DHT) storePeer(infoHash NodeId, peer string) {
+	dht.mutex.Lock()
+	defer dht.mutex.Unlock()
+	peers, ok := dht.peers[string(infoHash[:])]
+	if !ok {
+		peers = make(map[string]time.Time)
+		dht.peers[string(infoHash[:])] = peers
+	}
+	peers[peer] = dht.clock.Now()
+}
+
+// storedPeers returns up to DHTMaxValues compact peers announced for the info
+// hash, expired announces are dropped on the way.
+func (dht *DHT) storedPeers(infoHash NodeId) []string {
+	dht.mutex.Lock()
+	defer dht.mutex.Unlock()
+	peers := dht.peers[string(infoHash[:])]
+	now := dht.clock.Now()
+	var values []string
+	for peer, announced := range peers {
+		if now.Sub(announced) >= DHTPeerTimeout {
+			delete(peers, peer)
+			continue
+		}
+		if compact, ok := compactAddress(peer); ok && len(values) < DHTMaxValues {
+			values = append(values, string(compact))
+		}
+	}
+	if len(peers) == 0 {
+		delete(dht.peers, string(infoHash[:]))
+	}
+	return values
+}
+
+// query sends a query and waits for its response. Nodes that answer are added
+// to the routing table, known nodes that time out count a failure.
+func (dht *DHT) query(address string, method string, arguments map[string]interface{}) (map[string]interface{}, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	arguments["id"] = string(dht.id[:])
+	waiter := make(chan *krpcMessage, 1)
+	dht.mutex.Lock()
+	dht.transaction++
+	transaction := string(binary.BigEndian.AppendUint16(nil, dht.transaction))
+	dht.transactions[transaction] = &dhtTransaction{address: udpAddress, response: waiter}
+	dht.mutex.Unlock()
+	defer func() {
+		dht.mutex.Lock()
+		delete(dht.transactions, transaction)
+		dht.mutex.Unlock()
+	}()
+	message := &krpcMessage{Transaction: transaction, Type: KrpcQuery, Query: method, Arguments: arguments}
+	data, err := message.encode(NewBencode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dht.conn.WriteTo(data, udpAddress); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(DHTQueryTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-waiter:
+		if response.Type == KrpcError {
+			return nil, response.Error
+		}
+		id, ok := response.nodeId()
+		if !ok {
+			return nil, ErrInvalidKrpcMessage
+		}
+		dht.table.Insert(id, udpAddress.String())
+		return response.Response, nil
+	case <-timer.C:
+		for _, node := range dht.table.Nodes() {
+			if node.Address == udpAddress.String() {
+				dht.table.Failed(node.Id)
+			}
+		}
+		return nil, ErrDHTTimeout
+	case <-dht.closed:
+		return nil, ErrDHTClosed
+	}
+}
+
+func (dht *DHT) Ping(address string) (NodeId, error) {
+	response, err := dht.query(address, "ping", map[string]interface{}{})
+	if err != nil {
+		return NodeId{}, err
+	}
+	id, _ := nodeIdArgument(response, "id")
+	return id, nil
+}
+
+func (dht *DHT) FindNode(address string, target NodeId) ([]DHTNode, error) {
+	response, err := dht.query(address, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := response["nodes"].(string)
+	return parseCompactNodes([]byte(nodes)), nil
+}
+
+func (dht *DHT) GetPeers(address string, infoHash NodeId) (*DHTPeers, error) {
+	response, err := dht.query(address, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, err
+	}
+	result := &DHTPeers{}
+	result.Token, _ = response["token"].(string)
+	nodes, _ := response["nodes"].(string)
+	result.Nodes = parseCompactNodes([]byte(nodes))
+	values, _ := response["values"].([]interface{})
+	for _, value := range values {
+		if compact, ok := value.(string); ok && (len(compact) == 6 || len(compact) == 18) {
+			result.Peers = append(result.Peers, parseCompactAddress([]byte(compact)))
+		}
+	}
+	return result, nil
+}
+
+// AnnouncePeer tells the node we accept peers for the info hash on port, port
+// 0 asks it to use the port our queries come from.
+func (dht *DHT) AnnouncePeer(address string, infoHash NodeId, port int, token string) error {
+	arguments := map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      port,
+		"token":     token,
+	}
+	if port == 0 {
+		arguments["implied_port"] = 1
+	}
+	_, err := dht.query(address, "announce_peer", arguments)
+	return err
+}
+
+// Bootstrap fills the routing table by looking up our own id, starting from
+// the given nodes and whatever the table already holds.
+func (dht *DHT) Bootstrap(addresses []string) error {
+	var wait sync.WaitGroup
+	for _, address := range addresses {
+		wait.Add(1)
+		go func(address string) {
+			defer wait.Done()
+			dht.Ping(address)
+		}(address)
+	}
+	wait.Wait()
+	dht.lookup(dht.id, false, nil)
+	if dht.table.Len() == 0 {
+		return ErrDHTBootstrap
+	}
+	return nil
+}
+
+// Restore adds the nodes of a saved routing table. They are treated as seen
+// now, the ones that went away are dropped after failing a few queries.
+func (dht *DHT) Restore(nodes []DHTNode) {
+	for _, node := range nodes {
+		dht.table.Insert(node.Id, node.Address)
+	}
+}
+
+// Peers looks up the peers of an info hash, trace is called for every node
+// queried on the way when it is not nil.
+func (dht *DHT) Peers(infoHash NodeId, trace func(LookupStep)) []string {
+	peers, _ := dht.lookup(infoHash, true, trace)
+	return peers
+}
+
+// Announce looks up the nodes closest to the info hash and announces to them
+// that we accept peers on port.
+func (dht *DHT) Announce(infoHash NodeId, port int, trace func(LookupStep)) ([]string, error) {
+	peers, closest := dht.lookup(infoHash, true, trace)
+	announced := 0
+	for _, node := range closest {
+		if node.token == "" {
+			continue
+		}
+		if err := dht.AnnouncePeer(node.Address, infoHash, port, node.token); err == nil {
+			announced++
+		}
+	}
+	if announced == 0 {
+		return peers, ErrDHTAnnounce
+	}
+	return peers, nil
+}
+
+type lookupNode struct {
+	DHTNode
+	queried   bool
+	responded bool
+	token     string
+}
+
+// lookup walks towards target, querying DHTAlpha nodes at a time until the
+// DHTBucketSize closest nodes seen have all been queried. It returns the peers
+// found for get_peers lookups and the closest nodes that answered.
+func (dht *DHT) lookup(target NodeId, getPeers bool, trace func(LookupStep)) ([]string, []*lookupNode) {
+	seen := make(map[string]*lookupNode)
+	var nodes []*lookupNode
+	add := func(node DHTNode) {
+		if _, ok := seen[node.Address]; ok || node.Id == dht.id || !validPeerAddress(node.Address) {
+			return
+		}
+		lookup := &lookupNode{DHTNode: node}
+		seen[node.Address] = lookup
+		nodes = append(nodes, lookup)
+	}
+	for _, node := range dht.table.Closest(target, DHTBucketSize) {
+		add(node)
+	}
+	peers := make(map[string]struct{})
+	var found []string
+	for {
+		sort.Slice(nodes, func(i, j int) bool {
+			return target.closer(nodes[i].Id, nodes[j].Id)
+		})
+		var batch []*lookupNode
+		considered := 0
+		for _, node := range nodes {
+			if considered == DHTBucketSize || len(batch) == DHTAlpha {
+				break
+			}
+			if node.queried && !node.responded {
+				continue
+			}
+			considered++
+			if !node.queried {
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		type result struct {
+			node  *lookupNode
+			nodes []DHTNode
+			peers []string
+			token string
+			err   error
+		}
+		results := make(chan result, len(batch))
+		for _, node := range batch {
+			node.queried = true
+			go func(node *lookupNode) {
+				if getPeers {
+					response, err := dht.GetPeers(node.Address, target)
+					if err != nil {
+						results <- result{node: node, err: err}
+						return
+					}
+					results <- result{node: node, nodes: response.Nodes, peers: response.Peers, token: response.Token}
+					return
+				}
+				response, err := dht.FindNode(node.Address, target)
+				results <- result{node: node, nodes: response, err: err}
+			}(node)
+		}
+		for range batch {
+			result := <-results
+			if trace != nil {
+				trace(LookupStep{Node: result.node.DHTNode, Peers: len(result.peers), Nodes: len(result.nodes), Err: result.err})
+			}
+			if result.err != nil {
+				continue
+			}
+			result.node.responded = true
+			result.node.token = result.token
+			for _, node := range result.nodes {
+				add(node)
+			}
+			for _, peer := range result.peers {
+				if _, ok := peers[peer]; !ok {
+					peers[peer] = struct{}{}
+					found = append(found, peer)
+				}
+			}
+		}
+	}
+	var closest []*lookupNode
+	for _, node := range nodes {
+		if node.responded && len(closest) < DHTBucketSize {
+			closest = append(closest, node)
+		}
+	}
+	return found, closest
+}
+
+// LookupPeers adds the peers of infoHash to manager. When port is not zero it
+// is also announced to the nodes closest to the info hash.
+func (dht *DHT) LookupPeers(infoHash NodeId, port int, manager *ConnectionManager) error {
+	if port == 0 {
+		manager.Add(dht.Peers(infoHash, nil)...)
+		return nil
+	}
+	peers, err := dht.Announce(infoHash, port, nil)
+	manager.Add(peers...)
+	return err
+}
+
+// FeedPeers runs LookupPeers every DHTLookupInterval until stop is closed,
+// which also keeps our announcement from expiring.
+func (dht *DHT) FeedPeers(infoHash NodeId, port int, manager *ConnectionManager, stop <-chan struct{}) {
+	ticker := time.NewTicker(DHTLookupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := dht.LookupPeers(infoHash, port, manager); err != nil {
+				log.Println(err)
+			}
+		case <-stop:
+			return
+		case <-dht.closed:
+			return
+		}
+	}
+}
+
+// Run refreshes the routing table every DHTRefreshInterval until stop is
+// closed.
+func (dht *DHT) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(DHTRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.lookup(dht.id, false, nil)
+			dht.lookup(NewNodeId(), false, nil)
+		case <-stop:
+			return
+		case <-dht.closed:
+			return
+		}
+	}
+}
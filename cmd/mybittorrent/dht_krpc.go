@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidKrpcMessage = errors.New("invalid krpc message")
+
+const (
+	KrpcQuery    = "q"
+	KrpcResponse = "r"
+	KrpcError    = "e"
+)
+
+const (
+	KrpcGenericError  = 201
+	KrpcServerError   = 202
+	KrpcProtocolError = 203
+	KrpcMethodUnknown = 204
+)
+
+// KrpcRemoteError is an error message sent back by the queried node.
+type KrpcRemoteError struct {
+	Code    int
+	Message string
+}
+
+func (err *KrpcRemoteError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", err.Code, err.Message)
+}
+
+type krpcMessage struct {
+	Transaction string
+	Type        string
+	Query       string
+	Arguments   map[string]interface{}
+	Response    map[string]interface{}
+	Error       *KrpcRemoteError
+}
+
+func (message *krpcMessage) encode(bencode *Bencode) ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": message.Transaction,
+		"y": message.Type,
+	}
+	switch message.Type {
+	case KrpcQuery:
+		dict["q"] = message.Query
+		dict["a"] = message.Arguments
+	case KrpcResponse:
+		dict["r"] = message.Response
+	case KrpcError:
+		dict["e"] = []interface{}{message.Error.Code, message.Error.Message}
+	}
+	encode := bencode.encode(dict)
+	if encode.err != nil {
+		return nil, encode.err
+	}
+	return []byte(encode.value), nil
+}
+
+func parseKrpcMessage(bencode *Bencode, data []byte) (*krpcMessage, error) {
+	decode := bencode.Decode(string(data))
+	if decode.err != nil {
+		return nil, decode.err
+	}
+	dict, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidKrpcMessage
+	}
+	message := &krpcMessage{}
+	message.Transaction, _ = dict["t"].(string)
+	message.Type, _ = dict["y"].(string)
+	switch message.Type {
+	case KrpcQuery:
+		message.Query, _ = dict["q"].(string)
+		if message.Arguments, ok = dict["a"].(map[string]interface{}); !ok {
+			return nil, ErrInvalidKrpcMessage
+		}
+	case KrpcResponse:
+		if message.Response, ok = dict["r"].(map[string]interface{}); !ok {
+			return nil, ErrInvalidKrpcMessage
+		}
+	case KrpcError:
+		list, ok := dict["e"].([]interface{})
+		if !ok || len(list) != 2 {
+			return nil, ErrInvalidKrpcMessage
+		}
+		message.Error = &KrpcRemoteError{}
+		message.Error.Code, _ = list[0].(int)
+		message.Error.Message, _ = list[1].(string)
+	default:
+		return nil, ErrInvalidKrpcMessage
+	}
+	return message, nil
+}
+
+// nodeId reads the id every query and response carries.
+func (message *krpcMessage) nodeId() (NodeId, bool) {
+	dict := message.Arguments
+	if message.Type == KrpcResponse {
+		dict = message.Response
+	}
+	value, ok := dict["id"].(string)
+	if !ok || len(value) != len(NodeId{}) {
+		return NodeId{}, false
+	}
+	var id NodeId
+	copy(id[:], value)
+	return id, true
+}
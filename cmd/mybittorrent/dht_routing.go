@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrInvalidRoutingTable = errors.New("invalid routing table")
+
+const DHTBucketSize = 8
+const DHTMaxFailures = 3
+const DHTNodeTimeout = 15 * time.Minute
+const compactNodeLength = 26
+
+type NodeId [20]byte
+
+type DHTNode struct {
+	Id       NodeId
+	Address  string
+	lastSeen time.Time
+	failures int
+}
+
+// RoutingTable keeps the nodes we know in one bucket per length of the id
+// prefix they share with us, so we know many nodes close to us and a few far
+// away.
+type RoutingTable struct {
+	self    NodeId
+	clock   Clock
+	mutex   sync.Mutex
+	buckets [len(NodeId{})*8 + 1][]*DHTNode
+}
+
+func NewNodeId() NodeId {
+	var id NodeId
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeId) distance(other NodeId) NodeId {
+	var distance NodeId
+	for index := range id {
+		distance[index] = id[index] ^ other[index]
+	}
+	return distance
+}
+
+func (id NodeId) prefixLength(other NodeId) int {
+	for index := range id {
+		if x := id[index] ^ other[index]; x != 0 {
+			length := index * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				length++
+			}
+			return length
+		}
+	}
+	return len(id) * 8
+}
+
+// closer reports whether a is closer to id than b.
+func (id NodeId) closer(a, b NodeId) bool {
+	distanceA, distanceB := id.distance(a), id.distance(b)
+	return bytes.Compare(distanceA[:], distanceB[:]) < 0
+}
+
+func NewRoutingTable(self NodeId, clock Clock) *RoutingTable {
+	return &RoutingTable{
+		self:  self,
+		clock: clock,
+	}
+}
+
+// Insert records a node that contacted us or answered a query. A full bucket
+// only makes room by replacing a node not heard from in DHTNodeTimeout.
+func (table *RoutingTable) Insert(id NodeId, address string) bool {
+	if id == table.self || !validPeerAddress(address) {
+		return false
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	now := table.clock.Now()
+	index := table.self.prefixLength(id)
+	bucket := table.buckets[index]
+	for position, node := range bucket {
+		if node.Id == id {
+			node.Address = address
+			node.lastSeen = now
+			node.failures = 0
+			table.buckets[index] = append(append(bucket[:position], bucket[position+1:]...), node)
+			return true
+		}
+	}
+	node := &DHTNode{Id: id, Address: address, lastSeen: now}
+	if len(bucket) < DHTBucketSize {
+		table.buckets[index] = append(bucket, node)
+		return true
+	}
+	if now.Sub(bucket[0].lastSeen) < DHTNodeTimeout {
+		return false
+	}
+	table.buckets[index] = append(bucket[1:], node)
+	return true
+}
+
+// Failed counts a query the node did not answer and drops nodes that keep
+// failing.
+func (table *RoutingTable) Failed(id NodeId) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	index := table.self.prefixLength(id)
+	bucket := table.buckets[index]
+	for position, node := range bucket {
+		if node.Id != id {
+			continue
+		}
+		node.failures++
+		if node.failures >= DHTMaxFailures {
+			table.buckets[index] = append(bucket[:position], bucket[position+1:]...)
+		}
+		return
+	}
+}
+
+// Closest returns up to count nodes ordered by their distance to target.
+func (table *RoutingTable) Closest(target NodeId, count int) []DHTNode {
+	nodes := table.Nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.closer(nodes[i].Id, nodes[j].Id)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func (table *RoutingTable) Nodes() []DHTNode {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var nodes []DHTNode
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			nodes = append(nodes, *node)
+		}
+	}
+	return nodes
+}
+
+func (table *RoutingTable) Len() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	count := 0
+	for _, bucket := range table.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// Save writes our id and the known nodes so a restart does not need the
+// bootstrap nodes.
+func (table *RoutingTable) Save(bencode *Bencode, path string) error {
+	encode := bencode.encode(map[string]interface{}{
+		"id":    string(table.self[:]),
+		"nodes": string(compactNodes(table.Nodes())),
+	})
+	if encode.err != nil {
+		return encode.err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, []byte(encode.value), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+func LoadRoutingTable(bencode *Bencode, path string) (NodeId, []DHTNode, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	if len(contents) == 0 {
+		return NodeId{}, nil, ErrInvalidRoutingTable
+	}
+	decode := bencode.Decode(string(contents))
+	if decode.err != nil {
+		return NodeId{}, nil, decode.err
+	}
+	dict, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return NodeId{}, nil, ErrInvalidRoutingTable
+	}
+	id, ok := dict["id"].(string)
+	if !ok || len(id) != len(NodeId{}) {
+		return NodeId{}, nil, ErrInvalidRoutingTable
+	}
+	nodes, ok := dict["nodes"].(string)
+	if !ok || len(nodes)%compactNodeLength != 0 {
+		return NodeId{}, nil, ErrInvalidRoutingTable
+	}
+	var self NodeId
+	copy(self[:], id)
+	return self, parseCompactNodes([]byte(nodes)), nil
+}
+
+// compactNodes packs IPv4 nodes as their id followed by the compact address,
+// other nodes are left out.
+func compactNodes(nodes []DHTNode) []byte {
+	var compact []byte
+	for _, node := range nodes {
+		address, ok := compactAddress(node.Address)
+		if !ok || len(address) != 6 {
+			continue
+		}
+		compact = append(append(compact, node.Id[:]...), address...)
+	}
+	return compact
+}
+
+func parseCompactNodes(compact []byte) []DHTNode {
+	var nodes []DHTNode
+	for len(compact) >= compactNodeLength {
+		var node DHTNode
+		copy(node.Id[:], compact[:20])
+		node.Address = parseCompactAddress(compact[20:compactNodeLength])
+		nodes = append(nodes, node)
+		compact = compact[compactNodeLength:]
+	}
+	return nodes
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nodeIdWithPrefix(prefix ...byte) NodeId {
+	var id NodeId
+	copy(id[:], prefix)
+	return id
+}
+
+func TestNodeIdPrefixLength(t *testing.T) {
+	tests := []struct {
+		a, b NodeId
+		want int
+	}{
+		{nodeIdWithPrefix(0x00), nodeIdWithPrefix(0x80), 0},
+		{nodeIdWithPrefix(0x00), nodeIdWithPrefix(0x01), 7},
+		{nodeIdWithPrefix(0xff, 0x00), nodeIdWithPrefix(0xff, 0x20), 10},
+		{nodeIdWithPrefix(0x12), nodeIdWithPrefix(0x12), 160},
+	}
+	for _, test := range tests {
+		if got := test.a.prefixLength(test.b); got != test.want {
+			t.Errorf("prefix length of %x and %x bad result - want %d, got %d", test.a[:2], test.b[:2], test.want, got)
+		}
+	}
+}
+
+func TestRoutingTableFullBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	table := NewRoutingTable(nodeIdWithPrefix(0x00), clock)
+	for index := 0; index < DHTBucketSize; index++ {
+		if !table.Insert(nodeIdWithPrefix(0x80, byte(index)), "10.0.0.1:"+strconv.Itoa(1000+index)) {
+			t.Fatalf("node %d was not inserted", index)
+		}
+	}
+	if table.Insert(nodeIdWithPrefix(0x80, 0xff), "10.0.0.2:1000") {
+		t.Error("full bucket accepted a node while its nodes are good")
+	}
+	if !table.Insert(nodeIdWithPrefix(0x40), "10.0.0.3:1000") {
+		t.Error("node of another bucket was not inserted")
+	}
+	if table.Insert(table.self, "10.0.0.4:1000") {
+		t.Error("table accepted our own id")
+	}
+
+	clock.Advance(DHTNodeTimeout)
+	table.Insert(nodeIdWithPrefix(0x80, 1), "10.0.0.1:1001")
+	if !table.Insert(nodeIdWithPrefix(0x80, 0xff), "10.0.0.2:1000") {
+		t.Error("full bucket did not replace a stale node")
+	}
+	for _, node := range table.Nodes() {
+		if node.Id == nodeIdWithPrefix(0x80, 0) {
+			t.Error("least recently seen node was not replaced")
+		}
+	}
+
+	for attempt := 0; attempt < DHTMaxFailures; attempt++ {
+		table.Failed(nodeIdWithPrefix(0x40))
+	}
+	if got := table.Len(); got != DHTBucketSize {
+		t.Errorf("table size bad result - want %d, got %d", DHTBucketSize, got)
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	table := NewRoutingTable(nodeIdWithPrefix(0x00), &fakeClock{})
+	for _, prefix := range []byte{0xf0, 0x10, 0x30, 0x80} {
+		table.Insert(nodeIdWithPrefix(prefix), "10.0.0."+strconv.Itoa(int(prefix))+":6881")
+	}
+	closest := table.Closest(nodeIdWithPrefix(0x20), 3)
+	want := []byte{0x30, 0x10, 0x80}
+	if len(closest) != len(want) {
+		t.Fatalf("closest nodes bad result - want %d, got %d", len(want), len(closest))
+	}
+	for index, node := range closest {
+		if node.Id[0] != want[index] {
+			t.Errorf("closest node %d bad result - want %x, got %x", index, want[index], node.Id[0])
+		}
+	}
+}
+
+func TestRoutingTableSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	self := NewNodeId()
+	table := NewRoutingTable(self, &fakeClock{})
+	table.Insert(nodeIdWithPrefix(0x80), "10.0.0.1:6881")
+	table.Insert(nodeIdWithPrefix(0x40), "10.0.0.2:6882")
+	table.Insert(nodeIdWithPrefix(0x20), "[::1]:6883")
+	if err := table.Save(NewBencode(), path); err != nil {
+		t.Fatal(err)
+	}
+
+	id, nodes, err := LoadRoutingTable(NewBencode(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != self {
+		t.Errorf("loaded id bad result - want %x, got %x", self, id)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("loaded nodes bad result - want 2 IPv4 nodes, got %v", nodes)
+	}
+	for _, node := range nodes {
+		if (node.Id == nodeIdWithPrefix(0x80)) != (node.Address == "10.0.0.1:6881") {
+			t.Errorf("loaded node bad result - got %x at %s", node.Id[0], node.Address)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testDHT(t *testing.T) *DHT {
+	dht := NewDHT(NewNodeId(), 0)
+	if err := dht.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go dht.Serve()
+	t.Cleanup(func() { dht.Close() })
+	return dht
+}
+
+func dhtAddress(dht *DHT) string {
+	return "127.0.0.1:" + strconv.Itoa(dht.Port())
+}
+
+func TestKrpcMessage(t *testing.T) {
+	bencode := NewBencode()
+	messages := []*krpcMessage{
+		{Transaction: "aa", Type: KrpcQuery, Query: "ping", Arguments: map[string]interface{}{"id": "abcdefghij0123456789"}},
+		{Transaction: "aa", Type: KrpcResponse, Response: map[string]interface{}{"id": "mnopqrstuvwxyz123456"}},
+		{Transaction: "aa", Type: KrpcError, Error: &KrpcRemoteError{Code: KrpcGenericError, Message: "A Generic Error Ocurred"}},
+	}
+	want := []string{
+		"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		"d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+		"d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+	}
+	for index, message := range messages {
+		data, err := message.encode(bencode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want[index] {
+			t.Errorf("krpc encoding bad result - want %s, got %s", want[index], data)
+		}
+		parsed, err := parseKrpcMessage(bencode, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Type != message.Type || parsed.Transaction != message.Transaction {
+			t.Errorf("krpc parsing bad result - want %v, got %v", message, parsed)
+		}
+	}
+	if _, err := parseKrpcMessage(bencode, []byte("d1:t2:aa1:y1:qe")); !errors.Is(err, ErrInvalidKrpcMessage) {
+		t.Errorf("query without arguments expected ErrInvalidKrpcMessage - got: %v", err)
+	}
+}
+
+func TestDHTTokens(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	dht := NewDHT(NewNodeId(), 0)
+	dht.clock = clock
+	dht.rotated = clock.Now()
+	ip := net.ParseIP("10.0.0.1")
+	token := dht.token(ip)
+	if !dht.validToken(token, ip) {
+		t.Error("fresh token rejected")
+	}
+	if dht.validToken(token, net.ParseIP("10.0.0.2")) {
+		t.Error("token accepted from another ip")
+	}
+	clock.Advance(DHTTokenInterval)
+	if !dht.validToken(token, ip) {
+		t.Error("token rejected after one rotation")
+	}
+	clock.Advance(DHTTokenInterval)
+	if dht.validToken(token, ip) {
+		t.Error("token accepted after two rotations")
+	}
+}
+
+func TestDHTQueries(t *testing.T) {
+	server := testDHT(t)
+	client := testDHT(t)
+	id, err := client.Ping(dhtAddress(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != server.Id() {
+		t.Errorf("ping id bad result - want %x, got %x", server.Id(), id)
+	}
+	if server.Table().Len() != 1 || client.Table().Len() != 1 {
+		t.Errorf("routing tables bad result - want 1 node each, got %d and %d", server.Table().Len(), client.Table().Len())
+	}
+
+	infoHash := NewNodeId()
+	if err := client.AnnouncePeer(dhtAddress(server), infoHash, 7000, "bogus"); err == nil {
+		t.Error("announce with a bad token was accepted")
+	}
+	response, err := client.GetPeers(dhtAddress(server), infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 0 || response.Token == "" {
+		t.Errorf("get_peers bad result - want a token and no peers, got %v", response)
+	}
+	if err := client.AnnouncePeer(dhtAddress(server), infoHash, 7000, response.Token); err != nil {
+		t.Fatal(err)
+	}
+	response, err = client.GetPeers(dhtAddress(server), infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || response.Peers[0] != "127.0.0.1:7000" {
+		t.Errorf("announced peers bad result - want [127.0.0.1:7000], got %v", response.Peers)
+	}
+
+	var remote *KrpcRemoteError
+	if _, err := client.query(dhtAddress(server), "vote", map[string]interface{}{}); !errors.As(err, &remote) || remote.Code != KrpcMethodUnknown {
+		t.Errorf("unknown method expected error %d - got: %v", KrpcMethodUnknown, err)
+	}
+}
+
+func TestDHTCluster(t *testing.T) {
+	nodes := make([]*DHT, 12)
+	for index := range nodes {
+		nodes[index] = testDHT(t)
+	}
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap([]string{dhtAddress(nodes[0])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infoHash := NewNodeId()
+	if _, err := nodes[3].Announce(infoHash, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := dhtAddress(nodes[3])
+	for _, node := range []*DHT{nodes[0], nodes[7], nodes[11]} {
+		peers := node.Peers(infoHash, nil)
+		if len(peers) != 1 || peers[0] != want {
+			t.Errorf("peers found by %x bad result - want [%s], got %v", node.Id(), want, peers)
+		}
+	}
+	var steps []LookupStep
+	nodes[5].Peers(infoHash, func(step LookupStep) {
+		steps = append(steps, step)
+	})
+	if len(steps) == 0 || steps[0].Err != nil {
+		t.Errorf("lookup trace bad result - got %v", steps)
+	}
+	if len(nodes[11].Table().Nodes()) < 2 {
+		t.Errorf("last node knows too few nodes - got %d", nodes[11].Table().Len())
+	}
+}
+
+func TestDownloadFromDHTPeers(t *testing.T) {
+	data := testData(5*BlockSize + 123)
+	torrent := testTorrent(data, 2*BlockSize)
+	info := &torrent.Metainfo.Info
+	seed := NewMemoryStorage(info)
+	writeAllPieces(t, seed, info, data)
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(seed, true); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	nodes := []*DHT{testDHT(t), testDHT(t), testDHT(t)}
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap([]string{dhtAddress(nodes[0])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var infoHash NodeId
+	copy(infoHash[:], info.Hash)
+	if _, err := nodes[1].Announce(infoHash, listener.Port(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	incoming := NewListener(0)
+	if err := incoming.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer incoming.Close()
+	go incoming.Serve()
+	storage := NewMemoryStorage(info)
+	_, err := NewTorrentClient(NewBencode()).Download(&DownloadRequest{
+		Torrent:  torrent,
+		Storage:  storage,
+		DHT:      nodes[2],
+		Listener: incoming,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.Bytes(), data) {
+		t.Error("downloaded data does not match seeded data")
+	}
+	announced := "127.0.0.1:" + strconv.Itoa(incoming.Port())
+	found := false
+	for _, peer := range nodes[0].Peers(infoHash, nil) {
+		found = found || peer == announced
+	}
+	if !found {
+		t.Errorf("leecher should be announced on the DHT as %v", announced)
+	}
+}
+
+func TestDHTIgnoresResponsesFromOtherAddresses(t *testing.T) {
+	dht := testDHT(t)
+	remote, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	// The spoofer answers the query before the node it was sent to does.
+	id := NewNodeId()
+	go func() {
+		buffer := make([]byte, MaxDHTPacket)
+		n, _, err := remote.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		query, err := parseKrpcMessage(NewBencode(), buffer[:n])
+		if err != nil {
+			return
+		}
+		local, _ := net.ResolveUDPAddr("udp", dhtAddress(dht))
+		answer := func(conn net.PacketConn, id NodeId) {
+			response := &krpcMessage{Transaction: query.Transaction, Type: KrpcResponse, Response: map[string]interface{}{"id": string(id[:])}}
+			if data, err := response.encode(NewBencode()); err == nil {
+				conn.WriteTo(data, local)
+			}
+		}
+		answer(spoofer, NewNodeId())
+		answer(remote, id)
+	}()
+	got, err := dht.Ping(remote.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Errorf("ping bad result - want %x, got %x", id, got)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+var ErrDiskClosed = errors.New("disk io closed")
+
+const DefaultDiskWorkers = 4
+const DefaultDiskQueue = 16
+const DefaultReadCachePieces = 32
+
+// DiskStats reports the disk queue and read cache. PeakQueueDepth is the
+// most jobs ever waiting at once.
+type DiskStats struct {
+	QueueDepth     int
+	PeakQueueDepth int
+	InFlight       int
+	CacheHits      int64
+	CacheMisses    int64
+}
+
+// DiskIO moves storage access off the network path. Blocks are collected in a
+// write cache until their piece is complete, then hashed and written by a
+// bounded pool of workers. Queuing work blocks while the pool is saturated
+// which in turn stops the calling peer from reading more from its socket.
+type DiskIO struct {
+	storage     Storage
+	info        *Info
+	jobs        chan func()
+	quit        chan struct{}
+	closeMutex  sync.RWMutex
+	closed      bool
+	workers     sync.WaitGroup
+	pending     sync.WaitGroup
+	mutex       sync.Mutex
+	writeCache  map[int][]byte
+	readCache   *pieceCache
+	inFlight    int
+	peakQueue   int
+	cacheHits   int64
+	cacheMisses int64
+}
+
+type pieceCache struct {
+	capacity int
+	order    *list.List
+	items    map[int]*list.Element
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+func NewDiskIO(storage Storage, info *Info, workers int, queue int, cachePieces int) *DiskIO {
+	disk := &DiskIO{
+		storage:    storage,
+		info:       info,
+		jobs:       make(chan func(), queue),
+		quit:       make(chan struct{}),
+		writeCache: make(map[int][]byte),
+		readCache:  newPieceCache(cachePieces),
+	}
+	for i := 0; i < workers; i++ {
+		disk.workers.Add(1)
+		go disk.work()
+	}
+	return disk
+}
+
+func (disk *DiskIO) work() {
+	defer disk.workers.Done()
+	for {
+		select {
+		case job := <-disk.jobs:
+			disk.run(job)
+		case <-disk.quit:
+			for {
+				select {
+				case job := <-disk.jobs:
+					disk.run(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (disk *DiskIO) run(job func()) {
+	disk.mutex.Lock()
+	disk.inFlight++
+	disk.mutex.Unlock()
+	job()
+	disk.mutex.Lock()
+	disk.inFlight--
+	disk.mutex.Unlock()
+	disk.pending.Done()
+}
+
+func (disk *DiskIO) submit(job func()) error {
+	disk.closeMutex.RLock()
+	defer disk.closeMutex.RUnlock()
+	if disk.closed {
+		return ErrDiskClosed
+	}
+	disk.pending.Add(1)
+	disk.jobs <- job
+	disk.mutex.Lock()
+	if depth := len(disk.jobs); depth > disk.peakQueue {
+		disk.peakQueue = depth
+	}
+	disk.mutex.Unlock()
+	return nil
+}
+
+// WriteBlock stores a block in the write cache, it never touches the disk.
+func (disk *DiskIO) WriteBlock(piece int, begin int, block []byte) error {
+	size := disk.info.PieceSize(piece)
+	if begin < 0 || begin+len(block) > size {
+		return ErrOutOfBounds
+	}
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+	data, ok := disk.writeCache[piece]
+	if !ok {
+		data = make([]byte, size)
+		disk.writeCache[piece] = data
+	}
+	copy(data[begin:], block)
+	return nil
+}
+
+// CommitPiece queues the cached piece to be verified and written, done is
+// called from a worker once that happened. It blocks while the queue is full.
+func (disk *DiskIO) CommitPiece(piece int, done func(ok bool, err error)) error {
+	disk.mutex.Lock()
+	data, ok := disk.writeCache[piece]
+	delete(disk.writeCache, piece)
+	disk.mutex.Unlock()
+	if !ok {
+		return ErrOutOfBounds
+	}
+	return disk.submit(func() {
+		if !disk.info.VerifyPiece(piece, data) {
+			done(false, nil)
+			return
+		}
+		if _, err := disk.storage.WriteAt(data, piece, 0); err != nil {
+			done(false, err)
+			return
+		}
+		if err := disk.storage.MarkComplete(piece); err != nil {
+			done(false, err)
+			return
+		}
+		disk.mutex.Lock()
+		disk.readCache.put(piece, data)
+		disk.mutex.Unlock()
+		done(true, nil)
+	})
+}
+
+// ReadBlock serves a block of a complete piece, whole pieces are read into
+// the cache since peers usually ask for every block of a piece in turn.
+func (disk *DiskIO) ReadBlock(piece int, begin int, length int) ([]byte, error) {
+	disk.mutex.Lock()
+	if data, ok := disk.readCache.get(piece); ok {
+		disk.cacheHits++
+		disk.mutex.Unlock()
+		return sliceBlock(data, begin, length)
+	}
+	disk.cacheMisses++
+	disk.mutex.Unlock()
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	err := disk.submit(func() {
+		data := make([]byte, disk.info.PieceSize(piece))
+		if _, err := disk.storage.ReadAt(data, piece, 0); err != nil {
+			results <- result{err: err}
+			return
+		}
+		disk.mutex.Lock()
+		disk.readCache.put(piece, data)
+		disk.mutex.Unlock()
+		results <- result{data: data}
+	})
+	if err != nil {
+		return nil, err
+	}
+	read := <-results
+	if read.err != nil {
+		return nil, read.err
+	}
+	return sliceBlock(read.data, begin, length)
+}
+
+func sliceBlock(data []byte, begin int, length int) ([]byte, error) {
+	if begin < 0 || length < 0 || begin+length > len(data) {
+		return nil, ErrOutOfBounds
+	}
+	return data[begin : begin+length], nil
+}
+
+// Drain waits until every queued job has finished.
+func (disk *DiskIO) Drain() {
+	disk.pending.Wait()
+}
+
+func (disk *DiskIO) Stats() DiskStats {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+	return DiskStats{
+		QueueDepth:     len(disk.jobs),
+		PeakQueueDepth: disk.peakQueue,
+		InFlight:       disk.inFlight,
+		CacheHits:      disk.cacheHits,
+		CacheMisses:    disk.cacheMisses,
+	}
+}
+
+func (stats DiskStats) HitRate() float64 {
+	total := stats.CacheHits + stats.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.CacheHits) / float64(total)
+}
+
+func (disk *DiskIO) Close() error {
+	disk.closeMutex.Lock()
+	if disk.closed {
+		disk.closeMutex.Unlock()
+		return nil
+	}
+	disk.closed = true
+	disk.closeMutex.Unlock()
+	close(disk.quit)
+	disk.workers.Wait()
+	return disk.storage.Close()
+}
+
+func newPieceCache(capacity int) *pieceCache {
+	return &pieceCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[int]*list.Element),
+	}
+}
+
+func (cache *pieceCache) get(index int) ([]byte, bool) {
+	element, ok := cache.items[index]
+	if !ok {
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*cachedPiece).data, true
+}
+
+func (cache *pieceCache) put(index int, data []byte) {
+	if cache.capacity <= 0 {
+		return
+	}
+	if element, ok := cache.items[index]; ok {
+		element.Value.(*cachedPiece).data = data
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.items[index] = cache.order.PushFront(&cachedPiece{index: index, data: data})
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.items, oldest.Value.(*cachedPiece).index)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDiskIOCoalescesBlocksBeforeWriting(t *testing.T) {
+	data := testData(3 * BlockSize)
+	torrent := testTorrent(data, 2*BlockSize)
+	info := &torrent.Metainfo.Info
+	storage := NewMemoryStorage(info)
+	disk := NewDiskIO(storage, info, 2, 4, 4)
+	defer disk.Close()
+
+	disk.WriteBlock(0, BlockSize, data[BlockSize:2*BlockSize])
+	if !bytes.Equal(storage.Bytes()[BlockSize:2*BlockSize], make([]byte, BlockSize)) {
+		t.Error("blocks should stay in the write cache until the piece is committed")
+	}
+	disk.WriteBlock(0, 0, data[:BlockSize])
+
+	results := make(chan bool, 1)
+	if err := disk.CommitPiece(0, func(ok bool, err error) { results <- ok && err == nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !<-results {
+		t.Fatal("expected piece to pass verification")
+	}
+	if !bytes.Equal(storage.Bytes()[:2*BlockSize], data[:2*BlockSize]) {
+		t.Error("committed piece should be written to storage")
+	}
+	if completion, _ := storage.Completion(); !completion.Has(0) {
+		t.Error("committed piece should be marked complete")
+	}
+}
+
+func TestDiskIORejectsCorruptPiece(t *testing.T) {
+	data := testData(2 * BlockSize)
+	torrent := testTorrent(data, 2*BlockSize)
+	info := &torrent.Metainfo.Info
+	storage := NewMemoryStorage(info)
+	disk := NewDiskIO(storage, info, 1, 1, 1)
+	defer disk.Close()
+
+	disk.WriteBlock(0, 0, make([]byte, 2*BlockSize))
+	results := make(chan bool, 1)
+	disk.CommitPiece(0, func(ok bool, err error) { results <- ok })
+	if <-results {
+		t.Error("corrupt piece should fail verification")
+	}
+	if completion, _ := storage.Completion(); completion.Has(0) {
+		t.Error("corrupt piece should not be marked complete")
+	}
+}
+
+func TestDiskIOReadCache(t *testing.T) {
+	data := testData(3 * BlockSize)
+	torrent := testTorrent(data, BlockSize)
+	info := &torrent.Metainfo.Info
+	storage := NewMemoryStorage(info)
+	writeAllPieces(t, storage, info, data)
+	disk := NewDiskIO(storage, info, 1, 1, 2)
+	defer disk.Close()
+
+	for _, piece := range []int{0, 0, 1, 0, 2, 1, 0} {
+		block, err := disk.ReadBlock(piece, 10, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := piece*BlockSize + 10
+		if !bytes.Equal(block, data[begin:begin+20]) {
+			t.Errorf("piece %d read bad result", piece)
+		}
+	}
+
+	// 0 miss, 0 hit, 1 miss, 0 hit, 2 miss evicts 1, 1 miss evicts 0, 0 miss.
+	stats := disk.Stats()
+	if stats.CacheHits != 2 || stats.CacheMisses != 5 {
+		t.Errorf("cache stats bad result - want 2 hits and 5 misses, got %d and %d", stats.CacheHits, stats.CacheMisses)
+	}
+	if rate := stats.HitRate(); rate < 0.28 || rate > 0.29 {
+		t.Errorf("hit rate bad result - want 2/7, got %v", rate)
+	}
+}
+
+func TestDiskIOBackpressure(t *testing.T) {
+	data := testData(2 * BlockSize)
+	torrent := testTorrent(data, BlockSize)
+	info := &torrent.Metainfo.Info
+	disk := NewDiskIO(NewMemoryStorage(info), info, 0, 1, 0)
+	defer disk.Close()
+
+	disk.WriteBlock(0, 0, data[:BlockSize])
+	disk.WriteBlock(1, 0, data[BlockSize:])
+	if err := disk.CommitPiece(0, func(bool, error) {}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := disk.Stats(); stats.QueueDepth != 1 || stats.PeakQueueDepth != 1 {
+		t.Errorf("queue depth bad result - want 1 and a peak of 1, got %d and %d", stats.QueueDepth, stats.PeakQueueDepth)
+	}
+
+	committed := make(chan struct{})
+	go func() {
+		disk.CommitPiece(1, func(bool, error) {})
+		close(committed)
+	}()
+	select {
+	case <-committed:
+		t.Error("commit should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	disk.workers.Add(1)
+	go disk.work()
+	select {
+	case <-committed:
+	case <-time.After(time.Second):
+		t.Error("commit should proceed once the queue drains")
+	}
+}
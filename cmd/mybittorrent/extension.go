@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrExtensionNotSupported     = errors.New("extension not supported by peer")
+	ErrInvalidExtensionHandshake = errors.New("invalid extension handshake")
+)
+
+const ExtendedHandshakeId = 0
+const ClientVersion = "mybittorrent 0.1"
+const MaxPeerRequests = 250
+
+// ExtensionBit is set in the reserved bytes of the handshake by peers that
+// speak the extension protocol.
+const ExtensionBit = 0x10
+
+type ExtendedPayload struct {
+	Id      byte
+	Payload []byte
+}
+
+type ExtensionHandshake struct {
+	M            map[string]int
+	V            string
+	P            int
+	Reqq         int
+	MetadataSize int
+}
+
+// ExtensionHandler implements one extension. Handlers are called from the
+// goroutine serving the peer, outside of the session lock.
+type ExtensionHandler interface {
+	PeerHandshake(peer *PeerConnection, handshake *ExtensionHandshake) error
+	HandleMessage(peer *PeerConnection, payload []byte) error
+}
+
+// ExtensionRegistry maps extension names to their handlers. The message id
+// we announce for an extension is its position in registration order.
+type ExtensionRegistry struct {
+	mutex    sync.Mutex
+	names    []string
+	handlers map[string]ExtensionHandler
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		handlers: make(map[string]ExtensionHandler),
+	}
+}
+
+func (registry *ExtensionRegistry) Register(name string, handler ExtensionHandler) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.handlers[name]; !ok {
+		registry.names = append(registry.names, name)
+	}
+	registry.handlers[name] = handler
+}
+
+func (registry *ExtensionRegistry) Ids() map[string]int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	ids := make(map[string]int, len(registry.names))
+	for index, name := range registry.names {
+		ids[name] = index + 1
+	}
+	return ids
+}
+
+// Handle dispatches an extended message, the handshake updates what the peer
+// supports and is passed on to every extension both sides know.
+func (registry *ExtensionRegistry) Handle(peer *PeerConnection, message ExtendedPayload) error {
+	if message.Id == ExtendedHandshakeId {
+		handshake, err := parseExtensionHandshake(NewBencode(), message.Payload)
+		if err != nil {
+			return err
+		}
+		peer.setExtensions(handshake)
+		registry.mutex.Lock()
+		var handlers []ExtensionHandler
+		for _, name := range registry.names {
+			if peer.SupportsExtension(name) {
+				handlers = append(handlers, registry.handlers[name])
+			}
+		}
+		registry.mutex.Unlock()
+		for _, handler := range handlers {
+			if err := handler.PeerHandshake(peer, handshake); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	registry.mutex.Lock()
+	index := int(message.Id) - 1
+	if index >= len(registry.names) {
+		registry.mutex.Unlock()
+		return nil
+	}
+	handler := registry.handlers[registry.names[index]]
+	registry.mutex.Unlock()
+	return handler.HandleMessage(peer, message.Payload)
+}
+
+func (handshake *ExtensionHandshake) encode(bencode *Bencode) ([]byte, error) {
+	m := make(map[string]interface{}, len(handshake.M))
+	for name, id := range handshake.M {
+		m[name] = id
+	}
+	dict := map[string]interface{}{"m": m}
+	if handshake.V != "" {
+		dict["v"] = handshake.V
+	}
+	if handshake.P > 0 {
+		dict["p"] = handshake.P
+	}
+	if handshake.Reqq > 0 {
+		dict["reqq"] = handshake.Reqq
+	}
+	if handshake.MetadataSize > 0 {
+		dict["metadata_size"] = handshake.MetadataSize
+	}
+	encode := bencode.encode(dict)
+	if encode.err != nil {
+		return nil, encode.err
+	}
+	return []byte(encode.value), nil
+}
+
+func parseExtensionHandshake(bencode *Bencode, data []byte) (*ExtensionHandshake, error) {
+	decode := bencode.Decode(string(data))
+	if decode.err != nil {
+		return nil, decode.err
+	}
+	dict, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidExtensionHandshake
+	}
+	handshake := &ExtensionHandshake{M: make(map[string]int)}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, value := range m {
+			if id, ok := value.(int); ok && id >= 0 && id <= 255 {
+				handshake.M[name] = id
+			}
+		}
+	}
+	handshake.V, _ = dict["v"].(string)
+	handshake.P, _ = dict["p"].(int)
+	handshake.Reqq, _ = dict["reqq"].(int)
+	handshake.MetadataSize, _ = dict["metadata_size"].(int)
+	return handshake, nil
+}
+
+func (peer *PeerConnection) SupportsExtensions() bool {
+	return peer.Reserved[5]&ExtensionBit != 0
+}
+
+func (peer *PeerConnection) SupportsExtension(name string) bool {
+	peer.extensionMutex.Lock()
+	defer peer.extensionMutex.Unlock()
+	return peer.extensions[name] != 0
+}
+
+func (peer *PeerConnection) ExtensionHandshake() *ExtensionHandshake {
+	peer.extensionMutex.Lock()
+	defer peer.extensionMutex.Unlock()
+	return peer.extensionHandshake
+}
+
+// setExtensions merges a handshake into what is known about the peer, later
+// handshakes only update the extensions they mention and id 0 disables one.
+func (peer *PeerConnection) setExtensions(handshake *ExtensionHandshake) {
+	peer.extensionMutex.Lock()
+	defer peer.extensionMutex.Unlock()
+	if peer.extensions == nil {
+		peer.extensions = make(map[string]int)
+	}
+	for name, id := range handshake.M {
+		if id == 0 {
+			delete(peer.extensions, name)
+		} else {
+			peer.extensions[name] = id
+		}
+	}
+	peer.extensionHandshake = handshake
+}
+
+// SendExtended sends an extension message using the id the peer assigned.
+func (peer *PeerConnection) SendExtended(name string, payload []byte) error {
+	peer.extensionMutex.Lock()
+	id := peer.extensions[name]
+	peer.extensionMutex.Unlock()
+	if id == 0 {
+		return ErrExtensionNotSupported
+	}
+	return peer.Send(PeerMessage{Id: int32(Extended), Payload: ExtendedPayload{Id: byte(id), Payload: payload}})
+}
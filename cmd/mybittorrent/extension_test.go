@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type recordingExtension struct {
+	handshakes []*ExtensionHandshake
+	messages   [][]byte
+}
+
+func (extension *recordingExtension) PeerHandshake(peer *PeerConnection, handshake *ExtensionHandshake) error {
+	extension.handshakes = append(extension.handshakes, handshake)
+	return nil
+}
+
+func (extension *recordingExtension) HandleMessage(peer *PeerConnection, payload []byte) error {
+	extension.messages = append(extension.messages, payload)
+	return nil
+}
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	handshake := &ExtensionHandshake{
+		M:            map[string]int{"ut_metadata": 1, "ut_pex": 2},
+		V:            ClientVersion,
+		P:            6881,
+		Reqq:         MaxPeerRequests,
+		MetadataSize: 1234,
+	}
+	bencode := NewBencode()
+	encoded, err := handshake.encode(bencode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseExtensionHandshake(bencode, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, handshake) {
+		t.Errorf("handshake bad result - want %v, got %v", handshake, parsed)
+	}
+
+	if _, err := parseExtensionHandshake(bencode, []byte("i1e")); !errors.Is(err, ErrInvalidExtensionHandshake) {
+		t.Errorf("expected ErrInvalidExtensionHandshake - got %v", err)
+	}
+}
+
+func TestExtendedMessageSerialization(t *testing.T) {
+	message := PeerMessage{Id: int32(Extended), Payload: ExtendedPayload{Id: 3, Payload: []byte("d1:ai1ee")}}
+	buffer, err := serialize(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readMessage(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, message) {
+		t.Errorf("extended message bad result - want %v, got %v", message, read)
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	first := &recordingExtension{}
+	second := &recordingExtension{}
+	registry := NewExtensionRegistry()
+	registry.Register("ut_first", first)
+	registry.Register("ut_second", second)
+	if ids := registry.Ids(); ids["ut_first"] != 1 || ids["ut_second"] != 2 {
+		t.Errorf("ids bad result - want ut_first 1 and ut_second 2, got %v", ids)
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	peer := NewPeerConnection(local, &HandshakeMessage{Reserved: reservedBytes()}, 1)
+	if !peer.SupportsExtensions() {
+		t.Error("expected peer to support extensions")
+	}
+
+	payload, _ := (&ExtensionHandshake{M: map[string]int{"ut_second": 7, "ut_other": 1}}).encode(NewBencode())
+	if err := registry.Handle(peer, ExtendedPayload{Id: ExtendedHandshakeId, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.handshakes) != 0 || len(second.handshakes) != 1 {
+		t.Errorf("handshake should only reach ut_second - got %d and %d", len(first.handshakes), len(second.handshakes))
+	}
+
+	for _, id := range []byte{1, 2, 9} {
+		if err := registry.Handle(peer, ExtendedPayload{Id: id, Payload: []byte{id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(first.messages, [][]byte{{1}}) || !reflect.DeepEqual(second.messages, [][]byte{{2}}) {
+		t.Errorf("dispatch bad result - got %v and %v", first.messages, second.messages)
+	}
+
+	if err := peer.SendExtended("ut_first", nil); !errors.Is(err, ErrExtensionNotSupported) {
+		t.Errorf("expected ErrExtensionNotSupported - got %v", err)
+	}
+	go peer.SendExtended("ut_second", []byte("hi"))
+	message, err := readMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExtendedPayload{Id: 7, Payload: []byte("hi")}); !reflect.DeepEqual(message.Payload, want) {
+		t.Errorf("sent message bad result - want %v, got %v", want, message.Payload)
+	}
+
+	payload, _ = (&ExtensionHandshake{M: map[string]int{"ut_second": 0}}).encode(NewBencode())
+	if err := registry.Handle(peer, ExtendedPayload{Id: ExtendedHandshakeId, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if peer.SupportsExtension("ut_second") || !peer.SupportsExtension("ut_other") {
+		t.Error("a zero id should only disable that extension")
+	}
+}
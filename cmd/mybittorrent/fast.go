@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	ErrRequestRejected       = errors.New("request rejected by peer")
+	ErrUnexpectedFastMessage = errors.New("fast extension message from a peer without it")
+)
+
+// FastBit is set in the last reserved byte by peers supporting the fast
+// extension.
+const FastBit = 0x04
+const AllowedFastCount = 10
+const MaxSuggestedPieces = 16
+
+func (peer *PeerConnection) SupportsFast() bool {
+	return peer.Reserved[7]&FastBit != 0
+}
+
+// checkFastMessage fails for the messages the fast extension requires closing
+// the connection over when the peer did not negotiate it.
+func checkFastMessage(peer *PeerConnection, message PeerMessage) error {
+	switch MessageType(message.Id) {
+	case HaveAll, HaveNone, RejectRequest:
+		if !peer.SupportsFast() {
+			return ErrUnexpectedFastMessage
+		}
+	}
+	return nil
+}
+
+// AllowedFastSet computes the pieces a peer at ip may request while choked,
+// following the algorithm of the fast extension so both sides agree on it.
+func AllowedFastSet(ip net.IP, infoHash []byte, pieces int, count int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || pieces == 0 {
+		return nil
+	}
+	if count > pieces {
+		count = pieces
+	}
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash...)
+	var set []int
+	seen := make(map[int]bool)
+	for len(set) < count {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < count; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(pieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// peerIP returns the IP of a peer for the allowed fast set, nil when it is
+// not an IPv4 peer.
+func peerIP(peer *PeerConnection) net.IP {
+	host, _, err := net.SplitHostPort(peer.Address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func fastTestPeer(session *Session, has ...int) *PeerConnection {
+	peer := testPeer(session, has...)
+	pieces := len(session.torrent.Metainfo.Info.Pieces)
+	peer.Reserved[7] |= FastBit
+	peer.allowedFast = NewPieceBitfield(pieces)
+	peer.allowedForPeer = NewPieceBitfield(pieces)
+	peer.rejected = NewPieceBitfield(pieces)
+	return peer
+}
+
+func TestAllowedFastSet(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	tests := []struct {
+		ip    string
+		count int
+		want  []int
+	}{
+		{"80.4.4.200", 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"80.4.4.200", 9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"80.4.4.1", 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"::1", 7, nil},
+	}
+	for _, test := range tests {
+		got := AllowedFastSet(net.ParseIP(test.ip), infoHash, 1313, test.count)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("allowed fast set of %s bad result - want %v, got %v", test.ip, test.want, got)
+		}
+	}
+	if got := AllowedFastSet(net.ParseIP("80.4.4.200"), infoHash, 3, 10); len(got) != 3 {
+		t.Errorf("allowed fast set size bad result - want 3, got %v", got)
+	}
+}
+
+func TestFastMessages(t *testing.T) {
+	tests := []PeerMessage{
+		{Id: int32(HaveAll), Payload: []byte{}},
+		{Id: int32(HaveNone), Payload: []byte{}},
+		{Id: int32(SuggestPiece), Payload: HavePayload{Index: 7}},
+		{Id: int32(AllowedFast), Payload: HavePayload{Index: 3}},
+		{Id: int32(RejectRequest), Payload: PiecePayload{Index: 1, Begin: BlockSize, Length: BlockSize}},
+	}
+	for _, message := range tests {
+		buffer, err := serialize(message)
+		if err != nil {
+			t.Fatalf("message %d could not be written: %v", message.Id, err)
+		}
+		got, err := readMessage(bytes.NewReader(buffer))
+		if err != nil {
+			t.Fatalf("message %d could not be read: %v", message.Id, err)
+		}
+		if !reflect.DeepEqual(got, message) {
+			t.Errorf("message bad result - want %v, got %v", message, got)
+		}
+	}
+}
+
+func TestSessionRejectReleasesBlock(t *testing.T) {
+	data := testData(4 * BlockSize)
+	session := NewSession(testTorrent(data, 2*BlockSize), NewSequentialPicker(2))
+	defer session.Close()
+	rejecting := fastTestPeer(session, 0, 1)
+	rejecting.PeerChoking = false
+	other := testPeer(session, 0)
+
+	request, ok := session.nextRequest(rejecting)
+	if !ok || request.Index != 0 {
+		t.Fatalf("first request bad result - want piece 0, got %v", request)
+	}
+	rejecting.requests[request] = struct{}{}
+	session.handleMessage(rejecting, PeerMessage{Id: int32(RejectRequest), Payload: request})
+	if len(rejecting.requests) != 0 {
+		t.Errorf("rejected request still pending: %v", rejecting.requests)
+	}
+
+	next, ok := session.nextRequest(other)
+	if !ok || next != request {
+		t.Errorf("rejected block bad result - want %v requested from other peer, got %v", request, next)
+	}
+	if next, ok := session.nextRequest(rejecting); !ok || next.Index != 1 {
+		t.Errorf("rejecting peer bad result - want piece 1, got %v", next)
+	}
+}
+
+func TestSessionChokedFastPeer(t *testing.T) {
+	data := testData(6 * BlockSize)
+	session := NewSession(testTorrent(data, 2*BlockSize), NewSequentialPicker(3))
+	defer session.Close()
+	peer := fastTestPeer(session)
+	peer.PeerChoking = true
+
+	session.handleMessage(peer, PeerMessage{Id: int32(HaveAll)})
+	if !peer.Bitfield.Complete(3) || !peer.AmInterested {
+		t.Fatalf("have all bad result - want every piece and interest, got %v", peer.Bitfield)
+	}
+	if _, ok := session.nextRequest(peer); ok {
+		t.Error("choked peer should not be requested without allowed fast pieces")
+	}
+	session.handleMessage(peer, PeerMessage{Id: int32(AllowedFast), Payload: HavePayload{Index: 2}})
+	if request, ok := session.nextRequest(peer); !ok || request.Index != 2 {
+		t.Errorf("allowed fast request bad result - want piece 2, got %v", request)
+	}
+}
+
+func TestSessionRejectsWhileChoking(t *testing.T) {
+	data := testData(4 * BlockSize)
+	session := NewSession(testTorrent(data, 2*BlockSize), nil)
+	defer session.Close()
+	session.completed.Set(0)
+	session.completed.Set(1)
+	peer := fastTestPeer(session)
+	peer.AmChoking = true
+	peer.allowedForPeer.Set(1)
+
+	request := PiecePayload{Index: 0, Begin: 0, Length: BlockSize}
+	messages := session.handleMessage(peer, PeerMessage{Id: int32(Request), Payload: request})
+	if len(messages) != 1 || messages[0].message.Id != int32(RejectRequest) {
+		t.Errorf("choked request bad result - want reject, got %v", messages)
+	}
+	request.Index = 1
+	messages = session.handleMessage(peer, PeerMessage{Id: int32(Request), Payload: request})
+	if len(messages) != 1 || messages[0].read == nil {
+		t.Errorf("allowed fast request bad result - want read, got %v", messages)
+	}
+}
+
+func TestSessionDropsNonFastPeerSendingHaveAll(t *testing.T) {
+	data := testData(4 * BlockSize)
+	session := NewSession(testTorrent(data, 2*BlockSize), nil)
+	defer session.Close()
+	for _, id := range []MessageType{HaveAll, HaveNone} {
+		conn, remote := net.Pipe()
+		peer := NewPeerConnection(conn, &HandshakeMessage{}, 2)
+		result := make(chan error, 1)
+		go func() {
+			result <- session.Serve(peer)
+		}()
+		go io.Copy(io.Discard, remote)
+		message, err := serialize(PeerMessage{Id: int32(id), Payload: []byte{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote.Write(message)
+		select {
+		case err := <-result:
+			if !errors.Is(err, ErrUnexpectedFastMessage) {
+				t.Errorf("message %d expected ErrUnexpectedFastMessage - got: %v", id, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d should close the connection", id)
+		}
+		remote.Close()
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import "sort"
+
+// FileMapping translates between the piece address space of a torrent and
+// the files it is made of.
+type FileMapping struct {
+	pieceLength int64
+	length      int64
+	offsets     []int64
+	lengths     []int64
+}
+
+type FileSegment struct {
+	File   int
+	Offset int64
+	Length int64
+}
+
+type PieceSegment struct {
+	Piece  int
+	Offset int64
+	Length int64
+}
+
+func NewFileMapping(info *Info) *FileMapping {
+	lengths := make([]int64, len(info.Files))
+	for index, file := range info.Files {
+		lengths[index] = int64(file.Length)
+	}
+	return newFileMapping(int64(info.PieceLength), lengths)
+}
+
+func newFileMapping(pieceLength int64, lengths []int64) *FileMapping {
+	mapping := &FileMapping{
+		pieceLength: pieceLength,
+		offsets:     make([]int64, len(lengths)),
+		lengths:     lengths,
+	}
+	for index, length := range lengths {
+		mapping.offsets[index] = mapping.length
+		mapping.length += length
+	}
+	return mapping
+}
+
+func (mapping *FileMapping) Pieces() int {
+	if mapping.pieceLength <= 0 {
+		return 0
+	}
+	return int((mapping.length + mapping.pieceLength - 1) / mapping.pieceLength)
+}
+
+func (mapping *FileMapping) PieceSize(piece int) int64 {
+	rest := mapping.length - mapping.pieceLength*int64(piece)
+	if rest >= mapping.pieceLength {
+		return mapping.pieceLength
+	}
+	return rest
+}
+
+// Segments splits length bytes at offset within piece into the parts of
+// every file they cover, in order. Zero length files never show up.
+func (mapping *FileMapping) Segments(piece int, offset int64, length int64) ([]FileSegment, error) {
+	if piece < 0 || piece >= mapping.Pieces() || offset < 0 || length < 0 ||
+		offset+length > mapping.PieceSize(piece) {
+		return nil, ErrOutOfBounds
+	}
+	return mapping.segments(int64(piece)*mapping.pieceLength+offset, length), nil
+}
+
+func (mapping *FileMapping) segments(start int64, length int64) []FileSegment {
+	var segments []FileSegment
+	index := sort.Search(len(mapping.offsets), func(i int) bool {
+		return mapping.offsets[i]+mapping.lengths[i] > start
+	})
+	for ; index < len(mapping.offsets) && length > 0; index++ {
+		if mapping.lengths[index] == 0 {
+			continue
+		}
+		fileOffset := start - mapping.offsets[index]
+		part := mapping.lengths[index] - fileOffset
+		if part > length {
+			part = length
+		}
+		segments = append(segments, FileSegment{File: index, Offset: fileOffset, Length: part})
+		start += part
+		length -= part
+	}
+	return segments
+}
+
+// PieceSegments is the reverse of Segments, it splits length bytes at offset
+// within a file into the parts of every piece they cover.
+func (mapping *FileMapping) PieceSegments(file int, offset int64, length int64) ([]PieceSegment, error) {
+	if file < 0 || file >= len(mapping.lengths) || offset < 0 || length < 0 ||
+		offset+length > mapping.lengths[file] {
+		return nil, ErrOutOfBounds
+	}
+	var segments []PieceSegment
+	start := mapping.offsets[file] + offset
+	for length > 0 {
+		piece := start / mapping.pieceLength
+		pieceOffset := start - piece*mapping.pieceLength
+		part := mapping.pieceLength - pieceOffset
+		if part > length {
+			part = length
+		}
+		segments = append(segments, PieceSegment{Piece: int(piece), Offset: pieceOffset, Length: part})
+		start += part
+		length -= part
+	}
+	return segments, nil
+}
+
+// FilePieces returns the range of pieces overlapping a file, last is
+// exclusive and equals first for zero length files.
+func (mapping *FileMapping) FilePieces(file int) (int, int) {
+	start := mapping.offsets[file]
+	first := int(start / mapping.pieceLength)
+	if mapping.lengths[file] == 0 {
+		return first, first
+	}
+	end := start + mapping.lengths[file]
+	return first, int((end + mapping.pieceLength - 1) / mapping.pieceLength)
+}
+
+func (mapping *FileMapping) FileOffset(file int) int64 {
+	return mapping.offsets[file]
+}
+
+func (mapping *FileMapping) FileLength(file int) int64 {
+	return mapping.lengths[file]
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// naiveSegments maps every byte on its own and merges neighbours, it is slow
+// but obviously right.
+func naiveSegments(lengths []int64, start int64, length int64) []FileSegment {
+	var segments []FileSegment
+	for position := start; position < start+length; position++ {
+		var fileStart int64
+		for index, fileLength := range lengths {
+			if position >= fileStart && position < fileStart+fileLength {
+				last := len(segments) - 1
+				if last >= 0 && segments[last].File == index {
+					segments[last].Length++
+				} else {
+					segments = append(segments, FileSegment{File: index, Offset: position - fileStart, Length: 1})
+				}
+				break
+			}
+			fileStart += fileLength
+		}
+	}
+	return segments
+}
+
+func TestFileMappingSegments(t *testing.T) {
+	type testCase struct {
+		name        string
+		pieceLength int64
+		lengths     []int64
+	}
+
+	for _, tc := range []testCase{
+		{name: "single file", pieceLength: 4, lengths: []int64{10}},
+		{name: "exact pieces", pieceLength: 5, lengths: []int64{5, 5, 10}},
+		{name: "zero length files", pieceLength: 4, lengths: []int64{0, 3, 0, 0, 5, 0}},
+		{name: "many tiny files", pieceLength: 16, lengths: []int64{1, 2, 1, 1, 3, 1, 1, 1, 2, 1}},
+		{name: "short last piece", pieceLength: 8, lengths: []int64{7, 6, 4}},
+		{name: "file larger than pieces", pieceLength: 3, lengths: []int64{2, 11, 1}},
+	} {
+		mapping := newFileMapping(tc.pieceLength, tc.lengths)
+		for piece := 0; piece < mapping.Pieces(); piece++ {
+			size := mapping.PieceSize(piece)
+			for offset := int64(0); offset <= size; offset++ {
+				for length := int64(0); offset+length <= size; length++ {
+					got, err := mapping.Segments(piece, offset, length)
+					if err != nil {
+						t.Fatalf("%v: piece %d offset %d length %d: %v", tc.name, piece, offset, length, err)
+					}
+					want := naiveSegments(tc.lengths, int64(piece)*tc.pieceLength+offset, length)
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%v: piece %d offset %d length %d bad result - want %v, got %v",
+							tc.name, piece, offset, length, want, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFileMappingPieceSegmentsRoundTrip(t *testing.T) {
+	lengths := []int64{0, 1, 7, 0, 2, 1, 9, 3, 0}
+	mapping := newFileMapping(4, lengths)
+
+	for file, fileLength := range lengths {
+		for offset := int64(0); offset <= fileLength; offset++ {
+			for length := int64(0); offset+length <= fileLength; length++ {
+				pieces, err := mapping.PieceSegments(file, offset, length)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var total int64
+				for _, piece := range pieces {
+					segments, err := mapping.Segments(piece.Piece, piece.Offset, piece.Length)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want := []FileSegment{{File: file, Offset: offset + total, Length: piece.Length}}
+					if !reflect.DeepEqual(segments, want) {
+						t.Errorf("file %d offset %d length %d round trip bad result - want %v, got %v",
+							file, offset, length, want, segments)
+					}
+					total += piece.Length
+				}
+				if total != length {
+					t.Errorf("file %d offset %d length %d bad total - want %d, got %d", file, offset, length, length, total)
+				}
+			}
+		}
+	}
+}
+
+func TestFileMappingFilePieces(t *testing.T) {
+	mapping := newFileMapping(4, []int64{3, 0, 6, 4, 1})
+
+	for _, tc := range []struct {
+		file  int
+		first int
+		last  int
+	}{
+		{file: 0, first: 0, last: 1},
+		{file: 1, first: 0, last: 0},
+		{file: 2, first: 0, last: 3},
+		{file: 3, first: 2, last: 4},
+		{file: 4, first: 3, last: 4},
+	} {
+		first, last := mapping.FilePieces(tc.file)
+		if first != tc.first || last != tc.last {
+			t.Errorf("file %d pieces bad result - want [%d, %d), got [%d, %d)", tc.file, tc.first, tc.last, first, last)
+		}
+	}
+}
+
+func TestFileMappingOutOfBounds(t *testing.T) {
+	mapping := newFileMapping(4, []int64{3, 0, 6})
+
+	for _, tc := range []struct {
+		piece  int
+		offset int64
+		length int64
+	}{
+		{piece: -1, offset: 0, length: 1},
+		{piece: 3, offset: 0, length: 1},
+		{piece: 2, offset: 0, length: 2},
+		{piece: 0, offset: 3, length: 2},
+		{piece: 0, offset: -1, length: 1},
+		{piece: 0, offset: 0, length: -1},
+	} {
+		if _, err := mapping.Segments(tc.piece, tc.offset, tc.length); !errors.Is(err, ErrOutOfBounds) {
+			t.Errorf("%v expected ErrOutOfBounds - got: %v", tc, err)
+		}
+	}
+	if _, err := mapping.PieceSegments(1, 0, 1); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("zero length file expected ErrOutOfBounds - got: %v", err)
+	}
+	if _, err := mapping.PieceSegments(3, 0, 0); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("missing file expected ErrOutOfBounds - got: %v", err)
+	}
+}
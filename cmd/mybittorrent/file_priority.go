@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type FilePriority int
+
+const (
+	PrioritySkip FilePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+	// priorityDeadline is only given to pieces a reader is blocked on.
+	priorityDeadline
+)
+
+func ParseFilePriority(value string) (FilePriority, error) {
+	switch value {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal", "":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return 0, fmt.Errorf("unknown file priority: %v", value)
+	}
+}
+
+func (priority FilePriority) String() string {
+	switch priority {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	case priorityDeadline:
+		return "deadline"
+	default:
+		return "normal"
+	}
+}
+
+// ParseFileSelection reads a comma separated list of file indexes, each
+// optionally followed by a colon and a priority, such as "0:high,2". Files
+// that are not listed are skipped.
+func ParseFileSelection(value string, files int) ([]FilePriority, error) {
+	priorities := make([]FilePriority, files)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		indexValue, priorityValue, _ := strings.Cut(entry, ":")
+		index, err := strconv.Atoi(indexValue)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= files {
+			return nil, fmt.Errorf("file index out of range: %d", index)
+		}
+		priority, err := ParseFilePriority(priorityValue)
+		if err != nil {
+			return nil, err
+		}
+		priorities[index] = priority
+	}
+	return priorities, nil
+}
+
+// PiecePriorities gives every piece the highest priority of the files it
+// overlaps, pieces only touching skipped files are skipped themselves.
+func PiecePriorities(info *Info, priorities []FilePriority) []FilePriority {
+	mapping := NewFileMapping(info)
+	response := make([]FilePriority, len(info.Pieces))
+	for file, priority := range priorities {
+		first, last := mapping.FilePieces(file)
+		for piece := first; piece < last && piece < len(response); piece++ {
+			if priority > response[piece] {
+				response[piece] = priority
+			}
+		}
+	}
+	return response
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFileSelection(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  []FilePriority
+		err   bool
+	}{
+		{value: "0", want: []FilePriority{PriorityNormal, PrioritySkip, PrioritySkip}},
+		{value: "0:high, 2:low", want: []FilePriority{PriorityHigh, PrioritySkip, PriorityLow}},
+		{value: "1,2:normal", want: []FilePriority{PrioritySkip, PriorityNormal, PriorityNormal}},
+		{value: "3", err: true},
+		{value: "-1", err: true},
+		{value: "a", err: true},
+		{value: "0:urgent", err: true},
+	} {
+		got, err := ParseFileSelection(tc.value, 3)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q expected error - got %v", tc.value, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q bad result - want %v, got %v (%v)", tc.value, tc.want, got, err)
+		}
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	torrent := testMultiFileTorrent(testData(100), 32, 10, 0, 50, 40)
+	priorities := []FilePriority{PriorityLow, PriorityHigh, PrioritySkip, PriorityNormal}
+
+	want := []FilePriority{PriorityLow, PriorityNormal, PriorityNormal, PriorityNormal}
+	if got := PiecePriorities(&torrent.Metainfo.Info, priorities); !reflect.DeepEqual(got, want) {
+		t.Errorf("piece priorities bad result - want %v, got %v", want, got)
+	}
+
+	priorities = []FilePriority{PriorityHigh, PriorityNormal, PrioritySkip, PrioritySkip}
+	want = []FilePriority{PriorityHigh, PrioritySkip, PrioritySkip, PrioritySkip}
+	if got := PiecePriorities(&torrent.Metainfo.Info, priorities); !reflect.DeepEqual(got, want) {
+		t.Errorf("piece priorities bad result - want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// HashReadBuffer is how much a FileSource reads from disk at once.
+const HashReadBuffer = 4 * 1024 * 1024
+
+// PieceSource fills data with a piece of the torrent. The pipeline asks for
+// the pieces one after another in order, so sources may read sequentially.
+type PieceSource interface {
+	ReadPiece(index int, data []byte) error
+}
+
+// PieceResult is what the pipeline found for one piece. Hash is the SHA-1 of
+// the piece when hashing, Valid tells whether it matched the torrent when
+// verifying and Empty whether a piece that did not only holds zeros, as the
+// unwritten parts of sparse files do. Err is set when the piece could not be
+// read.
+type PieceResult struct {
+	Index int
+	Hash  []byte
+	Valid bool
+	Empty bool
+	Err   error
+}
+
+type HashStats struct {
+	Pieces  int
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Throughput returns the bytes hashed per second.
+func (stats HashStats) Throughput() float64 {
+	if stats.Elapsed <= 0 {
+		return 0
+	}
+	return float64(stats.Bytes) / stats.Elapsed.Seconds()
+}
+
+// HashPipeline reads pieces on one goroutine and hashes them on a pool of
+// workers. Results are delivered in piece order whatever order the workers
+// finish in, and at most twice as many pieces as there are workers are held
+// in memory.
+type HashPipeline struct {
+	info    *Info
+	workers int
+	mutex   sync.Mutex
+	stats   HashStats
+	started time.Time
+	running bool
+}
+
+type hashJob struct {
+	index int
+	data  []byte
+	err   error
+}
+
+// NewHashPipeline returns a pipeline for the pieces of info, it uses one
+// worker per CPU when workers is not positive.
+func NewHashPipeline(info *Info, workers int) *HashPipeline {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &HashPipeline{info: info, workers: workers}
+}
+
+// Hash computes the SHA-1 of every piece, for torrents whose hashes are not
+// known yet.
+func (pipeline *HashPipeline) Hash(ctx context.Context, source PieceSource) <-chan PieceResult {
+	return pipeline.run(ctx, source, func(result *PieceResult, data []byte) {
+		hash := sha1.Sum(data)
+		result.Hash = hash[:]
+	})
+}
+
+// Verify checks every piece against the torrent.
+func (pipeline *HashPipeline) Verify(ctx context.Context, source PieceSource) <-chan PieceResult {
+	return pipeline.run(ctx, source, func(result *PieceResult, data []byte) {
+		result.Valid = pipeline.info.VerifyPiece(result.Index, data)
+		if !result.Valid {
+			result.Empty = allZero(data)
+		}
+	})
+}
+
+func allZero(data []byte) bool {
+	for _, value := range data {
+		if value != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats reports how much was hashed so far and how long it took.
+func (pipeline *HashPipeline) Stats() HashStats {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+	stats := pipeline.stats
+	if pipeline.running {
+		stats.Elapsed = time.Since(pipeline.started)
+	}
+	return stats
+}
+
+// run feeds the pieces through work. The results channel is closed after the
+// last piece, or early once ctx is cancelled, and only when source is no
+// longer read from. Callers stopping before that have to cancel ctx.
+func (pipeline *HashPipeline) run(ctx context.Context, source PieceSource, work func(result *PieceResult, data []byte)) <-chan PieceResult {
+	info := pipeline.info
+	pieces := (info.Length + info.PieceLength - 1) / info.PieceLength
+	pipeline.mutex.Lock()
+	pipeline.stats = HashStats{}
+	pipeline.started = time.Now()
+	pipeline.running = true
+	pipeline.mutex.Unlock()
+
+	buffers := 2 * pipeline.workers
+	free := make(chan []byte, buffers)
+	jobs := make(chan hashJob, pipeline.workers)
+	done := make(chan PieceResult, pipeline.workers)
+	results := make(chan PieceResult)
+
+	go func() {
+		defer close(jobs)
+		allocated := 0
+		for index := 0; index < pieces; index++ {
+			var data []byte
+			select {
+			case data = <-free:
+			default:
+				if allocated < buffers {
+					data = make([]byte, info.PieceLength)
+					allocated++
+				} else {
+					select {
+					case data = <-free:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			data = data[:info.PieceSize(index)]
+			err := source.ReadPiece(index, data)
+			select {
+			case jobs <- hashJob{index: index, data: data, err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for worker := 0; worker < pipeline.workers; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				result := PieceResult{Index: job.index, Err: job.err}
+				if job.err == nil {
+					work(&result, job.data)
+					pipeline.mutex.Lock()
+					pipeline.stats.Pieces++
+					pipeline.stats.Bytes += int64(len(job.data))
+					pipeline.mutex.Unlock()
+				}
+				free <- job.data[:cap(job.data)]
+				select {
+				case done <- result:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	go func() {
+		defer close(results)
+		defer pipeline.finish()
+		// The workers only finish after the reader, draining done waits for
+		// both of them.
+		defer func() {
+			for range done {
+			}
+		}()
+		waiting := make(map[int]PieceResult)
+		next := 0
+		for result := range done {
+			waiting[result.Index] = result
+			for {
+				result, ok := waiting[next]
+				if !ok {
+					break
+				}
+				delete(waiting, next)
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					return
+				}
+				next++
+			}
+		}
+	}()
+	return results
+}
+
+func (pipeline *HashPipeline) finish() {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+	pipeline.stats.Elapsed = time.Since(pipeline.started)
+	pipeline.running = false
+}
+
+// StorageSource reads pieces from a torrent's storage.
+type StorageSource struct {
+	storage Storage
+}
+
+func NewStorageSource(storage Storage) *StorageSource {
+	return &StorageSource{storage: storage}
+}
+
+func (source *StorageSource) ReadPiece(index int, data []byte) error {
+	_, err := source.storage.ReadAt(data, index, 0)
+	return err
+}
+
+// FileSource reads the files of a torrent one after the other through a large
+// buffer, each file is only opened once the previous one is used up.
+type FileSource struct {
+	paths  []string
+	next   int
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func NewFileSource(paths []string) *FileSource {
+	source := &FileSource{paths: paths}
+	source.reader = bufio.NewReaderSize(fileChain{source}, HashReadBuffer)
+	return source
+}
+
+// ReadPiece ignores index, the pieces are read in the order they come in.
+func (source *FileSource) ReadPiece(index int, data []byte) error {
+	_, err := io.ReadFull(source.reader, data)
+	return err
+}
+
+func (source *FileSource) Close() error {
+	if source.file == nil {
+		return nil
+	}
+	err := source.file.Close()
+	source.file = nil
+	return err
+}
+
+// fileChain reads the files of a source as one stream.
+type fileChain struct {
+	source *FileSource
+}
+
+func (chain fileChain) Read(data []byte) (int, error) {
+	source := chain.source
+	for {
+		if source.file == nil {
+			if source.next == len(source.paths) {
+				return 0, io.EOF
+			}
+			file, err := os.Open(source.paths[source.next])
+			if err != nil {
+				return 0, err
+			}
+			source.next++
+			source.file = file
+		}
+		read, err := source.file.Read(data)
+		if err == io.EOF {
+			source.Close()
+			if read > 0 {
+				return read, nil
+			}
+			continue
+		}
+		return read, err
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// cancellingSource cancels the pipeline once it is asked for a piece.
+type cancellingSource struct {
+	source PieceSource
+	at     int
+	cancel context.CancelFunc
+}
+
+func (source *cancellingSource) ReadPiece(index int, data []byte) error {
+	if index == source.at {
+		source.cancel()
+	}
+	return source.source.ReadPiece(index, data)
+}
+
+func TestHashPipelineHashesInOrder(t *testing.T) {
+	data := testData(50*BlockSize + 17)
+	torrent := testTorrent(data, BlockSize)
+	info := &torrent.Metainfo.Info
+	storage := NewMemoryStorage(info)
+	writeAllPieces(t, storage, info, data)
+
+	pipeline := NewHashPipeline(info, 8)
+	var hashes [][]byte
+	for result := range pipeline.Hash(context.Background(), NewStorageSource(storage)) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if result.Index != len(hashes) {
+			t.Fatalf("result order bad result - want %d, got %d", len(hashes), result.Index)
+		}
+		hashes = append(hashes, result.Hash)
+	}
+	if !reflect.DeepEqual(hashes, info.Pieces) {
+		t.Error("hashes do not match the pieces")
+	}
+	stats := pipeline.Stats()
+	if stats.Pieces != len(info.Pieces) || stats.Bytes != int64(len(data)) || stats.Elapsed <= 0 {
+		t.Errorf("stats bad result - got %+v", stats)
+	}
+}
+
+func TestHashPipelineVerify(t *testing.T) {
+	data := testData(6 * BlockSize)
+	torrent := testTorrent(data, 2*BlockSize)
+	info := &torrent.Metainfo.Info
+	storage := NewMemoryStorage(info)
+	data[3*BlockSize] ^= 1
+	writeAllPieces(t, storage, info, data)
+
+	var valid []bool
+	for result := range NewHashPipeline(info, 0).Verify(context.Background(), NewStorageSource(storage)) {
+		valid = append(valid, result.Valid)
+	}
+	if want := []bool{true, false, true}; !reflect.DeepEqual(valid, want) {
+		t.Errorf("verify bad result - want %v, got %v", want, valid)
+	}
+}
+
+func TestHashPipelineCancel(t *testing.T) {
+	data := testData(100 * BlockSize)
+	torrent := testTorrent(data, BlockSize)
+	info := &torrent.Metainfo.Info
+	storage := NewMemoryStorage(info)
+	writeAllPieces(t, storage, info, data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &cancellingSource{source: NewStorageSource(storage), at: 10, cancel: cancel}
+	count := 0
+	for range NewHashPipeline(info, 2).Hash(ctx, source) {
+		count++
+	}
+	if count == len(info.Pieces) {
+		t.Error("pipeline should stop once cancelled")
+	}
+}
+
+func TestFileSourceSpansFiles(t *testing.T) {
+	data := testData(3*BlockSize + 50)
+	torrent := testMultiFileTorrent(data, BlockSize, 100, 0, 2*BlockSize, BlockSize-50)
+	info := &torrent.Metainfo.Info
+	root := t.TempDir()
+	var paths []string
+	begin := 0
+	for _, file := range info.Files {
+		path := filepath.Join(root, file.Path[1])
+		if err := os.WriteFile(path, data[begin:begin+file.Length], 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		begin += file.Length
+	}
+
+	source := NewFileSource(paths)
+	defer source.Close()
+	var hashes [][]byte
+	for result := range NewHashPipeline(info, 0).Hash(context.Background(), source) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		hashes = append(hashes, result.Hash)
+	}
+	if !reflect.DeepEqual(hashes, info.Pieces) {
+		t.Error("hashes do not match the pieces")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// V2Bit is set in the last reserved byte by peers supporting v2 torrents.
+const V2Bit = 0x10
+
+// MaxHashesPerRequest is the most hashes asked for or served in one message.
+const MaxHashesPerRequest = 512
+
+// HashRequestTimeout is how long a peer has to answer for the piece layer of
+// a file before another peer is asked.
+const HashRequestTimeout = 30 * time.Second
+
+type hashRequest struct {
+	peer *PeerConnection
+	sent time.Time
+}
+
+func (peer *PeerConnection) SupportsV2() bool {
+	return peer.Reserved[7]&V2Bit != 0
+}
+
+// pieceLayer is the layer of the merkle trees holding the piece hashes,
+// counted from the blocks at layer 0.
+func (info *Info) pieceLayer() uint32 {
+	layer := uint32(0)
+	for width := BlockSize; width < info.PieceLength; width *= 2 {
+		layer++
+	}
+	return layer
+}
+
+// layerWidth is the number of nodes in the piece layer of a file with count
+// pieces, padded to a power of two.
+func layerWidth(count int) int {
+	width := 1
+	for width < count {
+		width *= 2
+	}
+	return width
+}
+
+func log2(value int) uint32 {
+	layers := uint32(0)
+	for value > 1 {
+		value /= 2
+		layers++
+	}
+	return layers
+}
+
+// layerRequests asks for the missing piece hashes of the pure v2 file
+// holding count pieces from first on, in chunks proven up to the pieces
+// root.
+func layerRequests(info *Info, root []byte, first, count int) []HashRequestPayload {
+	width := layerWidth(count)
+	length := width
+	if length > MaxHashesPerRequest {
+		length = MaxHashesPerRequest
+	}
+	var requests []HashRequestPayload
+	for index := 0; index < count; index += length {
+		end := index + length
+		if end > count {
+			end = count
+		}
+		missing := false
+		for _, hash := range info.Pieces[first+index : first+end] {
+			missing = missing || len(hash) == 0
+		}
+		if !missing {
+			continue
+		}
+		requests = append(requests, HashRequestPayload{
+			PiecesRoot:  root,
+			BaseLayer:   info.pieceLayer(),
+			Index:       uint32(index),
+			Length:      uint32(length),
+			ProofLayers: log2(width),
+		})
+	}
+	return requests
+}
+
+// layerHashes answers a request for piece hashes from the piece layer of a
+// file, false when the request does not fit the layer.
+func layerHashes(info *Info, layer []byte, request HashRequestPayload) ([][]byte, bool) {
+	hashes := splitHashes(layer)
+	width := layerWidth(len(hashes))
+	index, length := int(request.Index), int(request.Length)
+	if request.BaseLayer != info.pieceLayer() || length == 0 || length&(length-1) != 0 ||
+		length > MaxHashesPerRequest || index%length != 0 || index >= width {
+		return nil, false
+	}
+	pad := zeroRoot(info.PieceLength / BlockSize)
+	response := make([][]byte, 0, length)
+	for position := index; position < index+length; position++ {
+		if position < len(hashes) {
+			response = append(response, hashes[position])
+		} else {
+			response = append(response, pad)
+		}
+	}
+	proof := merkleProof(hashes, pad, index, length)
+	// Uncles below the requested hashes are implied by them.
+	uncles := int(request.ProofLayers) - int(log2(length))
+	if uncles < 0 {
+		uncles = 0
+	}
+	if uncles < len(proof) {
+		proof = proof[:uncles]
+	}
+	return append(response, proof...), true
+}
+
+// verifyLayerHashes checks received piece hashes against the pieces root of
+// their file.
+func verifyLayerHashes(info *Info, payload HashesPayload) ([][]byte, bool) {
+	length := int(payload.Length)
+	if payload.BaseLayer != info.pieceLayer() || length == 0 || length&(length-1) != 0 ||
+		len(payload.Hashes) < length || int(payload.Index)%length != 0 {
+		return nil, false
+	}
+	hashes, proof := payload.Hashes[:length], payload.Hashes[length:]
+	if !verifyMerkleProof(payload.PiecesRoot, hashes, int(payload.Index), proof) {
+		return nil, false
+	}
+	return hashes, true
+}
+
+// setLayerHashes fills in verified piece hashes of a file and returns how
+// many were missing. The piece layer is kept once it is complete.
+func (metainfo *Metainfo) setLayerHashes(root []byte, index int, hashes [][]byte) int {
+	info := &metainfo.Info
+	first, count, ok := info.filePieces(root)
+	if !ok {
+		return 0
+	}
+	filled := 0
+	for position, hash := range hashes {
+		piece := index + position
+		if piece >= count {
+			break
+		}
+		if len(info.Pieces[first+piece]) == 0 {
+			info.Pieces[first+piece] = hash
+			filled++
+		}
+	}
+	layer := bytes.Join(info.Pieces[first:first+count], nil)
+	if len(layer) == count*len(root) {
+		if metainfo.PieceLayers == nil {
+			metainfo.PieceLayers = make(map[string][]byte)
+		}
+		metainfo.PieceLayers[string(root)] = layer
+	}
+	return filled
+}
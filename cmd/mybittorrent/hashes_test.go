@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func parseV2(t *testing.T, metainfo map[string]interface{}) *Torrent {
+	bencode := NewBencode()
+	torrent := NewTorrentParser(bencode).ParseBytes([]byte(bencode.encode(metainfo).value))
+	if torrent.Err != nil {
+		t.Fatal(torrent.Err)
+	}
+	return torrent
+}
+
+// testV2Data joins the files of a v2 torrent with the padding between them.
+func testV2Data(info *Info, files []testV2File) []byte {
+	var data []byte
+	for _, file := range info.Files {
+		if file.Padding {
+			data = append(data, make([]byte, file.Length)...)
+		} else {
+			data = append(data, files[0].data...)
+			files = files[1:]
+		}
+	}
+	return data
+}
+
+func TestHashMessages(t *testing.T) {
+	request := HashRequestPayload{
+		PiecesRoot:  bytes.Repeat([]byte{1}, 32),
+		BaseLayer:   1,
+		Index:       4,
+		Length:      2,
+		ProofLayers: 2,
+	}
+	tests := []PeerMessage{
+		{Id: int32(HashRequest), Payload: request},
+		{Id: int32(HashReject), Payload: request},
+		{Id: int32(Hashes), Payload: HashesPayload{
+			HashRequestPayload: request,
+			Hashes:             [][]byte{bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)},
+		}},
+	}
+	for _, message := range tests {
+		buffer, err := serialize(message)
+		if err != nil {
+			t.Fatalf("message %d could not be written: %v", message.Id, err)
+		}
+		got, err := readMessage(bytes.NewReader(buffer))
+		if err != nil {
+			t.Fatalf("message %d could not be read: %v", message.Id, err)
+		}
+		if !reflect.DeepEqual(got, message) {
+			t.Errorf("message bad result - want %v, got %v", message, got)
+		}
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	var layer [][]byte
+	for index := 0; index < 6; index++ {
+		layer = append(layer, bytes.Repeat([]byte{byte(index + 1)}, 32))
+	}
+	pad := zeroRoot(1)
+	root := merkleRoot(layer, 0, pad)
+	tests := []struct {
+		index  int
+		length int
+	}{
+		{0, 1},
+		{4, 2},
+		{4, 4},
+		{0, 8},
+	}
+	for _, test := range tests {
+		hashes := make([][]byte, test.length)
+		for position := range hashes {
+			if test.index+position < len(layer) {
+				hashes[position] = layer[test.index+position]
+			} else {
+				hashes[position] = pad
+			}
+		}
+		proof := merkleProof(layer, pad, test.index, test.length)
+		if !verifyMerkleProof(root, hashes, test.index, proof) {
+			t.Errorf("proof of %d hashes at %d does not verify", test.length, test.index)
+		}
+		if test.length < 8 && verifyMerkleProof(root, hashes, test.index+test.length, proof) {
+			t.Errorf("proof of %d hashes at %d verifies at the wrong index", test.length, test.index)
+		}
+	}
+	tampered := [][]byte{layer[0], layer[0]}
+	if verifyMerkleProof(root, tampered, 0, merkleProof(layer, pad, 0, 2)) {
+		t.Error("tampered hashes should not verify")
+	}
+}
+
+func TestVerifyPieceV2(t *testing.T) {
+	files := testV2Files()
+	torrent := parseV2(t, testV2Metainfo("v2", 2*BlockSize, false, files...))
+	info := &torrent.Metainfo.Info
+	data := testV2Data(info, files)
+
+	for index := range info.Pieces {
+		piece := append([]byte{}, data[index*info.PieceLength:index*info.PieceLength+info.PieceSize(index)]...)
+		if !info.VerifyPiece(index, piece) {
+			t.Errorf("piece %d should verify", index)
+		}
+		piece[0] ^= 1
+		if info.VerifyPiece(index, piece) {
+			t.Errorf("changed piece %d should not verify", index)
+		}
+	}
+}
+
+func TestLayerHashes(t *testing.T) {
+	files := []testV2File{
+		{[]string{"big"}, testData(6*BlockSize - 5)},
+		{[]string{"small"}, testData(10)},
+	}
+	metainfo := testV2Metainfo("v2", BlockSize, false, files...)
+	seeder := parseV2(t, metainfo).Metainfo
+	delete(metainfo, "piece layers")
+	leecher := parseV2(t, metainfo).Metainfo
+	info := &leecher.Info
+	root := info.Files[0].PiecesRoot
+
+	for index := 0; index < 6; index++ {
+		if len(info.Pieces[index]) != 0 {
+			t.Fatalf("piece %d hash should be unknown without piece layers", index)
+		}
+	}
+	first, count, ok := info.filePieces(root)
+	if !ok || first != 0 || count != 6 {
+		t.Fatalf("file pieces bad result - want 0 and 6, got %d and %d", first, count)
+	}
+	requests := layerRequests(info, root, first, count)
+	if len(requests) != 1 || requests[0].Length != 8 || requests[0].ProofLayers != 3 {
+		t.Fatalf("requests bad result - got %+v", requests)
+	}
+	hashes, ok := layerHashes(&seeder.Info, seeder.PieceLayers[string(root)], requests[0])
+	if !ok {
+		t.Fatal("seeder should answer the request")
+	}
+	payload := HashesPayload{HashRequestPayload: requests[0], Hashes: hashes}
+	verified, ok := verifyLayerHashes(info, payload)
+	if !ok {
+		t.Fatal("hashes should verify against the pieces root")
+	}
+	if filled := leecher.setLayerHashes(root, 0, verified); filled != 6 {
+		t.Errorf("filled hashes bad result - want 6, got %d", filled)
+	}
+	if !bytes.Equal(leecher.PieceLayers[string(root)], seeder.PieceLayers[string(root)]) {
+		t.Error("piece layer should be complete")
+	}
+
+	payload.Hashes[0] = bytes.Repeat([]byte{1}, len(root))
+	if _, ok := verifyLayerHashes(info, payload); ok {
+		t.Error("tampered hashes should not verify")
+	}
+	bad := requests[0]
+	bad.Index = 3
+	if _, ok := layerHashes(&seeder.Info, seeder.PieceLayers[string(root)], bad); ok {
+		t.Error("unaligned request should be rejected")
+	}
+}
+
+func TestSessionDownloadV2(t *testing.T) {
+	files := []testV2File{
+		{[]string{"big"}, testData(6*BlockSize - 5)},
+		{[]string{"dir", "small"}, testData(10)},
+	}
+	metainfo := testV2Metainfo("v2", BlockSize, false, files...)
+	torrent := parseV2(t, metainfo)
+	info := &torrent.Metainfo.Info
+	data := testV2Data(info, files)
+	root := t.TempDir()
+
+	storage, err := NewFileStorage(info, root, AllocateSparse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAllPieces(t, storage, info, data)
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(storage, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding should not be created on disk - got %v", err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	delete(metainfo, "piece layers")
+	leecher := NewSession(parseV2(t, metainfo), nil)
+	defer leecher.Close()
+	if err := leecher.Download([]string{"127.0.0.1:" + strconv.Itoa(listener.Port())}); err != nil {
+		t.Fatal(err)
+	}
+
+	if downloaded, err := leecher.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match seeded data (%v)", err)
+	}
+}
+
+func TestSessionReassignsSilentHashRequests(t *testing.T) {
+	files := []testV2File{
+		{[]string{"big"}, testData(6*BlockSize - 5)},
+		{[]string{"small"}, testData(10)},
+	}
+	metainfo := testV2Metainfo("v2", BlockSize, false, files...)
+	delete(metainfo, "piece layers")
+	torrent := parseV2(t, metainfo)
+	root := string(torrent.Metainfo.Info.Files[0].PiecesRoot)
+	session := NewSession(torrent, nil)
+	defer session.Close()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	session.clock = clock
+	var peers []*PeerConnection
+	for index := 0; index < 2; index++ {
+		peer := testPeer(session, 0, 1, 2, 3, 4, 5, 6)
+		peer.Reserved[7] |= V2Bit
+		peer.hashRejects = make(map[string]struct{})
+		peers = append(peers, peer)
+	}
+	silent, other := peers[0], peers[1]
+
+	if messages := session.requestHashes(silent); len(messages) != 1 {
+		t.Fatalf("hash requests bad result - want 1, got %d", len(messages))
+	}
+	if messages := session.requestHashes(other); len(messages) != 0 {
+		t.Errorf("file should stay with the first peer - got %d requests", len(messages))
+	}
+	clock.Advance(HashRequestTimeout)
+	if messages := session.requestHashes(other); len(messages) != 1 {
+		t.Fatalf("hash requests after timeout bad result - want 1, got %d", len(messages))
+	}
+	if owner := session.hashRequests[root].peer; owner != other {
+		t.Error("file should be reassigned to the other peer")
+	}
+	clock.Advance(HashRequestTimeout)
+	if messages := session.requestHashes(silent); len(messages) != 0 {
+		t.Errorf("silent peer should not be asked again - got %d requests", len(messages))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultPort = 6881
+const HandshakeTimeout = 10 * time.Second
+
+type Listener struct {
+	port     int
+	peerId   string
+	mutex    sync.Mutex
+	sessions map[string]*Session
+	listener net.Listener
+	// encryption decides whether incoming peers may use message stream
+	// encryption, or have to.
+	encryption EncryptionPolicy
+}
+
+func NewListener(port int) *Listener {
+	return &Listener{
+		port:     port,
+		peerId:   DefaultPeerId,
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (l *Listener) Register(session *Session) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sessions[string(session.InfoHash())] = session
+	// Peers only knowing the v2 side of a hybrid torrent use the truncated
+	// v2 hash.
+	if info := session.torrent.Metainfo.Info; info.Hybrid {
+		l.sessions[string(info.HashV2[:len(info.Hash)])] = session
+	}
+	if l.listener != nil {
+		session.SetListenPort(l.port)
+	}
+}
+
+func (l *Listener) Unregister(session *Session) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.sessions, string(session.InfoHash()))
+	if info := session.torrent.Metainfo.Info; info.Hybrid {
+		delete(l.sessions, string(info.HashV2[:len(info.Hash)]))
+	}
+}
+
+func (l *Listener) SetEncryption(policy EncryptionPolicy) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.encryption = policy
+}
+
+func (l *Listener) Listen() error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(l.port))
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.listener = listener
+	l.port = listener.Addr().(*net.TCPAddr).Port
+	for _, session := range l.sessions {
+		session.SetListenPort(l.port)
+	}
+	return nil
+}
+
+func (l *Listener) Port() int {
+	return l.port
+}
+
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go l.handle(conn)
+	}
+}
+
+// ServeUTP accepts peers over a uTP socket, usually bound to the same port as
+// the TCP listener.
+func (l *Listener) ServeUTP(socket *UTPSocket) error {
+	for {
+		conn, err := socket.Accept()
+		if err != nil {
+			return err
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	l.mutex.Lock()
+	policy := l.encryption
+	infoHashes := make([][]byte, 0, len(l.sessions))
+	for infoHash := range l.sessions {
+		infoHashes = append(infoHashes, []byte(infoHash))
+	}
+	l.mutex.Unlock()
+	if policy != EncryptionDisabled {
+		encrypted, err := AcceptEncrypted(conn, infoHashes, policy)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = encrypted
+	}
+	handshake, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	l.mutex.Lock()
+	session, ok := l.sessions[string(handshake.InfoHash)]
+	l.mutex.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+	response := &HandshakeMessage{Reserved: reservedBytes(), InfoHash: handshake.InfoHash, PeerId: []byte(l.peerId)}
+	if _, err := conn.Write(response.serialize()); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	peer := NewPeerConnection(conn, handshake, len(session.torrent.Metainfo.Info.Pieces))
+	if err := session.Serve(peer); err != nil {
+		log.Println(peer.Address, err)
+	}
+}
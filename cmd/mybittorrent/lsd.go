@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidLSDMessage = errors.New("invalid local service discovery message")
+
+const LSDAddress = "239.192.152.143:6771"
+const LSDInterval = 5 * time.Minute
+const LSDMinInterval = time.Minute
+const LSDMaxInfoHashes = 20
+const MaxLSDPacket = 1400
+
+type LSDAnnouncement struct {
+	Host       string
+	Port       int
+	InfoHashes [][]byte
+	Cookie     string
+}
+
+// LocalDiscovery announces our torrents to the local network over multicast
+// and adds the peers announcing the same torrents to their sessions.
+type LocalDiscovery struct {
+	port      int
+	cookie    string
+	clock     Clock
+	group     *net.UDPAddr
+	mutex     sync.Mutex
+	sessions  map[string]*Session
+	announced map[string]time.Time
+	received  map[string]time.Time
+	conn      *net.UDPConn
+	sender    net.PacketConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewLocalDiscovery(port int) *LocalDiscovery {
+	group, _ := net.ResolveUDPAddr("udp4", LSDAddress)
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &LocalDiscovery{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		clock:     systemClock{},
+		group:     group,
+		sessions:  make(map[string]*Session),
+		announced: make(map[string]time.Time),
+		received:  make(map[string]time.Time),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (announcement *LSDAnnouncement) encode() []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buffer, "Host: %s\r\n", announcement.Host)
+	fmt.Fprintf(&buffer, "Port: %d\r\n", announcement.Port)
+	for _, infoHash := range announcement.InfoHashes {
+		fmt.Fprintf(&buffer, "Infohash: %s\r\n", hex.EncodeToString(infoHash))
+	}
+	if announcement.Cookie != "" {
+		fmt.Fprintf(&buffer, "cookie: %s\r\n", announcement.Cookie)
+	}
+	buffer.WriteString("\r\n\r\n")
+	return buffer.Bytes()
+}
+
+// parseLSDAnnouncement reads a BT-SEARCH message, header names are case
+// insensitive and info hashes that are not 40 hex digits are skipped.
+func parseLSDAnnouncement(data []byte) (*LSDAnnouncement, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "BT-SEARCH * HTTP/1.1" {
+		return nil, ErrInvalidLSDMessage
+	}
+	announcement := &LSDAnnouncement{}
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, ErrInvalidLSDMessage
+		}
+		value = strings.TrimSpace(value)
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "Host":
+			announcement.Host = value
+		case "Port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, ErrInvalidLSDMessage
+			}
+			announcement.Port = port
+		case "Infohash":
+			infoHash, err := hex.DecodeString(value)
+			if err == nil && len(infoHash) == 20 && len(announcement.InfoHashes) < LSDMaxInfoHashes {
+				announcement.InfoHashes = append(announcement.InfoHashes, infoHash)
+			}
+		case "Cookie":
+			announcement.Cookie = value
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if announcement.Port <= 0 || announcement.Port > 65535 || len(announcement.InfoHashes) == 0 {
+		return nil, ErrInvalidLSDMessage
+	}
+	return announcement, nil
+}
+
+func (lsd *LocalDiscovery) Register(session *Session) {
+	lsd.mutex.Lock()
+	defer lsd.mutex.Unlock()
+	lsd.sessions[string(session.InfoHash())] = session
+}
+
+func (lsd *LocalDiscovery) Unregister(session *Session) {
+	lsd.mutex.Lock()
+	defer lsd.mutex.Unlock()
+	delete(lsd.sessions, string(session.InfoHash()))
+	delete(lsd.announced, string(session.InfoHash()))
+}
+
+func (lsd *LocalDiscovery) Listen() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, lsd.group)
+	if err != nil {
+		return err
+	}
+	sender, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	lsd.conn = conn
+	lsd.sender = sender
+	return nil
+}
+
+func (lsd *LocalDiscovery) Serve() error {
+	buffer := make([]byte, MaxLSDPacket)
+	for {
+		n, source, err := lsd.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-lsd.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+		lsd.handle(buffer[:n], source)
+	}
+}
+
+func (lsd *LocalDiscovery) Close() error {
+	var err error
+	lsd.closeOnce.Do(func() {
+		close(lsd.closed)
+		if lsd.conn != nil {
+			err = lsd.conn.Close()
+			lsd.sender.Close()
+		}
+	})
+	return err
+}
+
+// handle adds the sender of an announcement to the sessions of the torrents
+// it announces. Our own messages are recognized by the cookie, and a peer is
+// only heard once per torrent every LSDMinInterval.
+func (lsd *LocalDiscovery) handle(data []byte, source *net.UDPAddr) {
+	announcement, err := parseLSDAnnouncement(data)
+	if err != nil || announcement.Cookie == lsd.cookie {
+		return
+	}
+	address := net.JoinHostPort(source.IP.String(), strconv.Itoa(announcement.Port))
+	now := lsd.clock.Now()
+	var sessions []*Session
+	lsd.mutex.Lock()
+	for key, received := range lsd.received {
+		if now.Sub(received) >= LSDMinInterval {
+			delete(lsd.received, key)
+		}
+	}
+	for _, infoHash := range announcement.InfoHashes {
+		session, ok := lsd.sessions[string(infoHash)]
+		key := address + string(infoHash)
+		if _, heard := lsd.received[key]; !ok || heard {
+			continue
+		}
+		lsd.received[key] = now
+		sessions = append(sessions, session)
+	}
+	lsd.mutex.Unlock()
+	for _, session := range sessions {
+		session.Peers().Add(address)
+	}
+}
+
+// Announce sends the torrents not announced in the last LSDMinInterval, as
+// many per message as fit.
+func (lsd *LocalDiscovery) Announce() error {
+	if lsd.port <= 0 {
+		return nil
+	}
+	now := lsd.clock.Now()
+	var infoHashes [][]byte
+	lsd.mutex.Lock()
+	for key := range lsd.sessions {
+		if announced, ok := lsd.announced[key]; ok && now.Sub(announced) < LSDMinInterval {
+			continue
+		}
+		lsd.announced[key] = now
+		infoHashes = append(infoHashes, []byte(key))
+	}
+	lsd.mutex.Unlock()
+	for len(infoHashes) > 0 {
+		count := len(infoHashes)
+		if count > LSDMaxInfoHashes {
+			count = LSDMaxInfoHashes
+		}
+		announcement := &LSDAnnouncement{
+			Host:       lsd.group.String(),
+			Port:       lsd.port,
+			InfoHashes: infoHashes[:count],
+			Cookie:     lsd.cookie,
+		}
+		if _, err := lsd.sender.WriteTo(announcement.encode(), lsd.group); err != nil {
+			return err
+		}
+		infoHashes = infoHashes[count:]
+	}
+	return nil
+}
+
+func (lsd *LocalDiscovery) Run(stop <-chan struct{}) {
+	if err := lsd.Announce(); err != nil {
+		log.Println(err)
+	}
+	ticker := time.NewTicker(LSDInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := lsd.Announce(); err != nil {
+				log.Println(err)
+			}
+		case <-stop:
+			return
+		case <-lsd.closed:
+			return
+		}
+	}
+}
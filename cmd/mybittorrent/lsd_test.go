@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnouncement(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	announcement := &LSDAnnouncement{Host: LSDAddress, Port: 6881, InfoHashes: [][]byte{infoHash}, Cookie: "c00k1e"}
+	parsed, err := parseLSDAnnouncement(announcement.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Port != 6881 || parsed.Cookie != "c00k1e" || len(parsed.InfoHashes) != 1 || !bytes.Equal(parsed.InfoHashes[0], infoHash) {
+		t.Errorf("announcement bad result - want %v, got %v", announcement, parsed)
+	}
+
+	tests := []struct {
+		message string
+		valid   bool
+	}{
+		{"BT-SEARCH * HTTP/1.1\r\nhost: 239.192.152.143:6771\r\nport: 51413\r\ninfohash: " + string(bytes.Repeat([]byte("0f"), 20)) + "\r\n\r\n\r\n", true},
+		{"BT-SEARCH * HTTP/1.1\r\nPort: 51413\r\nInfohash: 0f0f\r\n\r\n\r\n", false},
+		{"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + string(bytes.Repeat([]byte("0f"), 20)) + "\r\n\r\n\r\n", false},
+		{"M-SEARCH * HTTP/1.1\r\nPort: 51413\r\n\r\n", false},
+	}
+	for _, test := range tests {
+		if _, err := parseLSDAnnouncement([]byte(test.message)); (err == nil) != test.valid {
+			t.Errorf("%q bad result - want valid %v, got %v", test.message, test.valid, err)
+		}
+	}
+}
+
+func TestLocalDiscoveryHandle(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	session := NewSession(testTorrent(testData(BlockSize), BlockSize), nil)
+	defer session.Close()
+	lsd := NewLocalDiscovery(6881)
+	lsd.clock = clock
+	lsd.Register(session)
+	source := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 6771}
+
+	own := &LSDAnnouncement{Port: 7000, InfoHashes: [][]byte{session.InfoHash()}, Cookie: lsd.cookie}
+	lsd.handle(own.encode(), source)
+	if session.Peers().Len() != 0 {
+		t.Fatal("our own announcement added a peer")
+	}
+	other := &LSDAnnouncement{Port: 7000, InfoHashes: [][]byte{bytes.Repeat([]byte{1}, 20)}}
+	lsd.handle(other.encode(), source)
+	if session.Peers().Len() != 0 {
+		t.Fatal("announcement of another torrent added a peer")
+	}
+
+	announcement := &LSDAnnouncement{Port: 7000, InfoHashes: [][]byte{session.InfoHash()}, Cookie: "other"}
+	lsd.handle(announcement.encode(), source)
+	address, ok := session.Peers().Next()
+	if !ok || address != "192.168.1.20:7000" {
+		t.Fatalf("announced peer bad result - want 192.168.1.20:7000, got %q", address)
+	}
+	session.Peers().Disconnected(address, true)
+	session.Peers().Disconnected(address, true)
+	session.Peers().Disconnected(address, true)
+	lsd.handle(announcement.encode(), source)
+	if session.Peers().Len() != 0 {
+		t.Error("repeated announcement was not rate limited")
+	}
+	clock.Advance(LSDMinInterval)
+	lsd.handle(announcement.encode(), source)
+	if session.Peers().Len() != 1 {
+		t.Error("announcement after the rate limit was ignored")
+	}
+}
+
+func TestLocalDiscoveryAnnounce(t *testing.T) {
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	session := NewSession(testTorrent(testData(BlockSize), BlockSize), nil)
+	defer session.Close()
+	lsd := NewLocalDiscovery(6881)
+	lsd.clock = clock
+	lsd.group = receiver.LocalAddr().(*net.UDPAddr)
+	lsd.sender = sender
+	lsd.Register(session)
+
+	if err := lsd.Announce(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsd.Announce(); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, MaxLSDPacket)
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := receiver.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announcement, err := parseLSDAnnouncement(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announcement.Port != 6881 || announcement.Cookie != lsd.cookie || !bytes.Equal(announcement.InfoHashes[0], session.InfoHash()) {
+		t.Errorf("announcement bad result - got %v", announcement)
+	}
+	receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := receiver.Read(buffer); err == nil {
+		t.Error("torrent announced twice within the minimum interval")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var ErrInvalidMagnet = errors.New("invalid magnet link")
+
+type Magnet struct {
+	InfoHash []byte
+	Name     string
+	Trackers []string
+	Peers    []string
+}
+
+func ParseMagnet(link string) (*Magnet, error) {
+	uri, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if uri.Scheme != "magnet" {
+		return nil, ErrInvalidMagnet
+	}
+	params := uri.Query()
+	magnet := &Magnet{
+		Name:     params.Get("dn"),
+		Trackers: params["tr"],
+		Peers:    params["x.pe"],
+	}
+	for _, topic := range params["xt"] {
+		if !strings.HasPrefix(topic, "urn:btih:") {
+			continue
+		}
+		value := strings.TrimPrefix(topic, "urn:btih:")
+		switch len(value) {
+		case 40:
+			magnet.InfoHash, err = hex.DecodeString(value)
+		case 32:
+			magnet.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(value))
+		default:
+			err = ErrInvalidMagnet
+		}
+		if err != nil {
+			return nil, ErrInvalidMagnet
+		}
+	}
+	if magnet.InfoHash == nil {
+		return nil, ErrInvalidMagnet
+	}
+	return magnet, nil
+}
+
+// Torrent stands in for the real torrent until the metadata is fetched, it
+// only carries what a tracker announce and a handshake need.
+func (magnet *Magnet) Torrent() *Torrent {
+	announce := ""
+	if len(magnet.Trackers) > 0 {
+		announce = magnet.Trackers[0]
+	}
+	return &Torrent{
+		Metainfo: &Metainfo{
+			Announce: announce,
+			Info: Info{
+				Name: magnet.Name,
+				Hash: magnet.InfoHash,
+			},
+		},
+	}
+}
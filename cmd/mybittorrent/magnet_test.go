@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	magnet, err := ParseMagnet("magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&dn=magnet1.gif&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce&x.pe=127.0.0.1:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(magnet.InfoHash) != "ad42ce8109f54c99613ce38f9b4d87e70f24a165" {
+		t.Errorf("info hash bad result - got %x", magnet.InfoHash)
+	}
+	if magnet.Name != "magnet1.gif" {
+		t.Errorf("name bad result - want magnet1.gif, got %v", magnet.Name)
+	}
+	if want := []string{"http://bittorrent-test-tracker.codecrafters.io/announce"}; !reflect.DeepEqual(magnet.Trackers, want) {
+		t.Errorf("trackers bad result - want %v, got %v", want, magnet.Trackers)
+	}
+	if want := []string{"127.0.0.1:6881"}; !reflect.DeepEqual(magnet.Peers, want) {
+		t.Errorf("peers bad result - want %v, got %v", want, magnet.Peers)
+	}
+
+	base32, err := ParseMagnet("magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJILF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(base32.InfoHash) != "ad42ce8109f54c99613ce38f9b4d87e70f24a165" {
+		t.Errorf("base32 info hash bad result - got %x", base32.InfoHash)
+	}
+
+	for _, link := range []string{
+		"http://example.com",
+		"magnet:?dn=missing",
+		"magnet:?xt=urn:btih:abc",
+		"magnet:?xt=urn:btih:zz42ce8109f54c99613ce38f9b4d87e70f24a165",
+	} {
+		if _, err := ParseMagnet(link); err == nil {
+			t.Errorf("%q expected error", link)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -28,14 +34,7 @@ func main() {
 		if parse.Err != nil {
 			log.Fatal(parse.Err)
 		}
-		fmt.Println("Tracker URL: " + parse.Metainfo.Announce)
-		fmt.Println("Length:", parse.Metainfo.Info.Length)
-		fmt.Println("Info Hash:", hex.EncodeToString(parse.Metainfo.Info.Hash))
-		fmt.Println("Piece Length:", parse.Metainfo.Info.PieceLength)
-		fmt.Println("Piece Hashes:")
-		for _, value := range parse.Metainfo.Info.Pieces {
-			fmt.Println(hex.EncodeToString(value))
-		}
+		printInfo(parse)
 	} else if command == "peers" {
 		file := os.Args[2]
 		bencode := NewBencode()
@@ -78,37 +77,620 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		_, err = client.DownloadPiece(&PieceRequest{
+		data, err := client.DownloadPiece(&PieceRequest{
 			Address: peers[0].Address(),
 			Piece:   piece,
 			Torrent: torrent,
-			Output:  output,
 		})
 		if err != nil {
 			log.Fatal(err)
 		}
+		if err := os.WriteFile(output, data, 0644); err != nil {
+			log.Fatal(err)
+		}
 		fmt.Printf("Piece %d downloaded to %v.\n", piece, output)
 	} else if command == "download" {
-		output := os.Args[3]
-		file := os.Args[4]
+		flags := flag.NewFlagSet("download", flag.ExitOnError)
+		outputFlag := flags.String("o", "", "path to write the download to")
+		allocateFlag := flags.String("allocate", AllocateSparse.String(), "file allocation mode, sparse or full")
+		filesFlag := flags.String("files", "", "files to download as index[:skip|low|normal|high], comma separated")
+		lsdFlag := flags.Bool("lsd", false, "also use peers announced on the local network")
+		utpFlag := flags.Bool("utp", false, "try uTP before TCP when connecting to peers")
+		encryptionFlag := flags.String("encryption", EncryptionDisabled.String(), "message stream encryption, disabled, prefer or require")
+		dhtFlag := flags.Bool("dht", false, "also use peers found through the DHT and announce ourselves there")
+		flags.Parse(os.Args[2:])
+		if *outputFlag == "" || flags.NArg() < 1 {
+			log.Fatal("usage: download -o <output> [--allocate sparse|full] [--files 0,2:high] [--lsd] [--utp] [--dht] [--encryption disabled|prefer|require] <torrent>")
+		}
+		output := *outputFlag
+		file := flags.Arg(0)
+		allocation, err := ParseAllocationMode(*allocateFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encryption, err := ParseEncryptionPolicy(*encryptionFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
 		bencode := NewBencode()
 		torrent := NewTorrentParser(bencode).Parse(file)
 		if torrent.Err != nil {
 			log.Fatal(torrent.Err)
 		}
+		var priorities []FilePriority
+		if *filesFlag != "" {
+			priorities, err = ParseFileSelection(*filesFlag, len(torrent.Metainfo.Info.Files))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		var dht *DHT
+		var listener *Listener
+		if *dhtFlag {
+			dht, err = startDHT()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer dht.Close()
+			listener, err = startListener(encryption)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer listener.Close()
+		}
 		client := NewTorrentClient(bencode)
 		peers, err := client.Peers(torrent, "00112233445566778899")
+		if err != nil && dht == nil {
+			log.Fatal(err)
+		} else if err != nil {
+			log.Println(err)
+		}
+		addresses := make([]string, 0, len(peers))
+		for _, peer := range peers {
+			addresses = append(addresses, peer.Address())
+		}
+		storage, err := NewFileStorage(&torrent.Metainfo.Info, output, allocation, priorities)
 		if err != nil {
 			log.Fatal(err)
 		}
-		client.Download(&DownloadRequest{
-			Address: peers[0].Address(),
-			Torrent: torrent,
-			Output:  output,
+		var discovery *LocalDiscovery
+		if *lsdFlag {
+			discovery = NewLocalDiscovery(0)
+			if err := discovery.Listen(); err != nil {
+				log.Fatal(err)
+			}
+			defer discovery.Close()
+			go discovery.Serve()
+		}
+		var utp *UTPSocket
+		if *utpFlag {
+			utp, err = ListenUTP(":0")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer utp.Close()
+		}
+		diskStats, err := client.Download(&DownloadRequest{
+			Addresses:  addresses,
+			Torrent:    torrent,
+			Storage:    storage,
+			Priorities: priorities,
+			Discovery:  discovery,
+			DHT:        dht,
+			Listener:   listener,
+			UTP:        utp,
+			Encryption: encryption,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Downloaded %v to %v.\n", file, output)
+		printDiskStats(diskStats)
+	} else if command == "stream" {
+		flags := flag.NewFlagSet("stream", flag.ExitOnError)
+		outputFlag := flags.String("o", "", "path to write the download to")
+		address := flags.String("http", "127.0.0.1:8080", "address to serve the files on")
+		flags.Parse(os.Args[2:])
+		if *outputFlag == "" || flags.NArg() < 1 {
+			log.Fatal("usage: stream -o <output> [--http address] <torrent>")
+		}
+		bencode := NewBencode()
+		torrent := NewTorrentParser(bencode).Parse(flags.Arg(0))
+		if torrent.Err != nil {
+			log.Fatal(torrent.Err)
+		}
+		storage, err := NewFileStorage(&torrent.Metainfo.Info, *outputFlag, AllocateSparse, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		session := NewSession(torrent, NewSequentialPicker(len(torrent.Metainfo.Info.Pieces)))
+		if err := session.Attach(storage, false); err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		server := NewStreamServer(session)
+		if err := server.Listen(*address); err != nil {
+			log.Fatal(err)
+		}
+		defer server.Close()
+		go func() {
+			if err := server.Serve(); err != nil {
+				log.Println(err)
+			}
+		}()
+		fmt.Printf("Streaming %v on http://%v/\n", torrent.Metainfo.Info.Name, server.Address())
+		client := NewTorrentClient(bencode)
+		peers, err := client.Peers(torrent, DefaultPeerId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addresses := make([]string, 0, len(peers))
+		for _, peer := range peers {
+			addresses = append(addresses, peer.Address())
+		}
+		go func() {
+			if err := session.Download(addresses); err != nil {
+				log.Println(err)
+				return
+			}
+			fmt.Printf("Downloaded %v to %v.\n", torrent.Metainfo.Info.Name, *outputFlag)
+		}()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		<-signals
+	} else if command == "magnet_parse" {
+		magnet, err := ParseMagnet(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, tracker := range magnet.Trackers {
+			fmt.Println("Tracker URL:", tracker)
+		}
+		fmt.Println("Info Hash:", hex.EncodeToString(magnet.InfoHash))
+	} else if command == "magnet_handshake" {
+		magnet, err := ParseMagnet(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		addresses, err := magnetAddresses(NewTorrentClient(NewBencode()), magnet, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peer, err := DialPeer(addresses[0], magnet.InfoHash, DefaultPeerId, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer peer.Close()
+		fmt.Printf("Peer ID: %v\n", hex.EncodeToString(peer.PeerId))
+		registry := NewExtensionRegistry()
+		registry.Register(UtMetadata, NewMetadataExtension(nil))
+		handshake, err := exchangeExtensionHandshake(peer, registry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Peer Metadata Extension ID: %d\n", handshake.M[UtMetadata])
+	} else if command == "magnet_info" {
+		magnet, err := ParseMagnet(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		client := NewTorrentClient(NewBencode())
+		addresses, err := magnetAddresses(client, magnet, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		torrent, err := client.MagnetTorrent(magnet, addresses, DefaultPeerId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printInfo(torrent)
+	} else if command == "magnet_download" {
+		flags := flag.NewFlagSet("magnet_download", flag.ExitOnError)
+		output := flags.String("o", "", "path to write the download to")
+		dhtFlag := flags.Bool("dht", false, "also use peers found through the DHT and announce ourselves there")
+		flags.Parse(os.Args[2:])
+		if *output == "" || flags.NArg() < 1 {
+			log.Fatal("usage: magnet_download -o <output> [--dht] <magnet link>")
+		}
+		magnet, err := ParseMagnet(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		var dht *DHT
+		var listener *Listener
+		if *dhtFlag {
+			dht, err = startDHT()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer dht.Close()
+			listener, err = startListener(EncryptionDisabled)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer listener.Close()
+		}
+		client := NewTorrentClient(NewBencode())
+		addresses, err := magnetAddresses(client, magnet, dht)
+		if err != nil {
+			log.Fatal(err)
+		}
+		torrent, err := client.MagnetTorrent(magnet, addresses, DefaultPeerId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage, err := NewFileStorage(&torrent.Metainfo.Info, *output, AllocateSparse, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		diskStats, err := client.Download(&DownloadRequest{
+			Addresses: addresses,
+			Torrent:   torrent,
+			Storage:   storage,
+			DHT:       dht,
+			Listener:  listener,
 		})
-		fmt.Printf("Downloaded %v to %v.", file, output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Downloaded %v to %v.\n", torrent.Metainfo.Info.Name, *output)
+		printDiskStats(diskStats)
+	} else if command == "dht" {
+		flags := flag.NewFlagSet("dht", flag.ExitOnError)
+		port := flags.Int("port", DefaultPort, "UDP port of the DHT node")
+		bootstrap := flags.String("bootstrap", strings.Join(DefaultBootstrapNodes, ","), "comma separated nodes to bootstrap from")
+		state := flags.String("state", "", "file to load and save the routing table")
+		announce := flags.Int("announce", 0, "announce ourselves as a peer on this port")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 1 {
+			log.Fatal("usage: dht [--port port] [--bootstrap nodes] [--state file] [--announce port] <info hash|magnet link>")
+		}
+		infoHash, err := dhtTarget(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		id := NewNodeId()
+		var saved []DHTNode
+		if *state != "" {
+			savedId, nodes, err := LoadRoutingTable(NewBencode(), *state)
+			if err == nil {
+				id, saved = savedId, nodes
+			} else if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+		}
+		dht := NewDHT(id, *port)
+		if err := dht.Listen(); err != nil {
+			log.Fatal(err)
+		}
+		defer dht.Close()
+		go dht.Serve()
+		dht.Restore(saved)
+		var nodes []string
+		if *bootstrap != "" {
+			nodes = strings.Split(*bootstrap, ",")
+		}
+		if err := dht.Bootstrap(nodes); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Bootstrapped with %d nodes.\n", dht.Table().Len())
+		trace := func(step LookupStep) {
+			distance := 160 - infoHash.prefixLength(step.Node.Id)
+			if step.Err != nil {
+				fmt.Printf("Node %x at %v (distance %d): %v\n", step.Node.Id, step.Node.Address, distance, step.Err)
+				return
+			}
+			fmt.Printf("Node %x at %v (distance %d): %d peers, %d nodes\n", step.Node.Id, step.Node.Address, distance, step.Peers, step.Nodes)
+		}
+		var peers []string
+		if *announce > 0 {
+			peers, err = dht.Announce(infoHash, *announce, trace)
+			if err != nil {
+				log.Println(err)
+			} else {
+				fmt.Printf("Announced on port %d.\n", *announce)
+			}
+		} else {
+			peers = dht.Peers(infoHash, trace)
+		}
+		for _, peer := range peers {
+			fmt.Println("Peer:", peer)
+		}
+		fmt.Printf("Found %d peers for %x.\n", len(peers), infoHash)
+		if *state != "" {
+			if err := dht.Table().Save(NewBencode(), *state); err != nil {
+				log.Println(err)
+			}
+		}
+	} else if command == "seed" {
+		flags := flag.NewFlagSet("seed", flag.ExitOnError)
+		port := flags.Int("port", DefaultPort, "port to accept peer connections on")
+		slots := flags.Int("slots", DefaultUploadSlots, "number of peers to upload to at once")
+		lsd := flags.Bool("lsd", false, "announce the torrent on the local network")
+		utp := flags.Bool("utp", false, "also accept peer connections over uTP")
+		encryptionFlag := flags.String("encryption", EncryptionDisabled.String(), "message stream encryption, disabled, prefer or require")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			log.Fatal("usage: seed [--port port] [--slots slots] [--lsd] [--utp] [--encryption disabled|prefer|require] <torrent> <file>")
+		}
+		encryption, err := ParseEncryptionPolicy(*encryptionFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bencode := NewBencode()
+		torrent := NewTorrentParser(bencode).Parse(flags.Arg(0))
+		if torrent.Err != nil {
+			log.Fatal(torrent.Err)
+		}
+		if _, err := os.Stat(flags.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		storage, err := NewFileStorage(&torrent.Metainfo.Info, flags.Arg(1), AllocateSparse, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		session := NewSession(torrent, nil)
+		session.SetUploadSlots(*slots)
+		if err := session.Attach(storage, false); err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		listener := NewListener(*port)
+		listener.SetEncryption(encryption)
+		listener.Register(session)
+		if err := listener.Listen(); err != nil {
+			log.Fatal(err)
+		}
+		announcer := NewAnnouncer(NewTorrentClient(bencode), session, listener.Port())
+		if _, err := announcer.Announce("started"); err != nil {
+			log.Println(err)
+		}
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		if *lsd {
+			discovery := NewLocalDiscovery(listener.Port())
+			discovery.Register(session)
+			if err := discovery.Listen(); err != nil {
+				log.Fatal(err)
+			}
+			defer discovery.Close()
+			go discovery.Serve()
+			go discovery.Run(stop)
+		}
+		if *utp {
+			socket, err := ListenUTP(fmt.Sprintf(":%d", listener.Port()))
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer socket.Close()
+			go listener.ServeUTP(socket)
+		}
+		go func() {
+			announcer.Run(stop)
+			close(stopped)
+		}()
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt)
+			<-signals
+			close(stop)
+			<-stopped
+			listener.Close()
+		}()
+		fmt.Printf("Seeding %v on port %d.\n", torrent.Metainfo.Info.Name, listener.Port())
+		if err := listener.Serve(); err != nil && !isClosed(stop) {
+			log.Fatal(err)
+		}
+		printDiskStats(session.DiskStats())
+	} else if command == "create" {
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		outputFlag := flags.String("o", "", "path to write the torrent to, defaults to the content name with .torrent")
+		pieceLength := flags.Int("piece-length", 0, "piece length in bytes, picked from the content size when 0")
+		trackersFlag := flags.String("trackers", "", "tracker urls, comma separated")
+		webSeedsFlag := flags.String("web-seeds", "", "web seed urls, comma separated")
+		comment := flags.String("comment", "", "comment stored in the torrent")
+		private := flags.Bool("private", false, "mark the torrent private")
+		source := flags.String("source", "", "source tag stored in the info dictionary")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 1 {
+			log.Fatal("usage: create [-o output] [--piece-length bytes] [--trackers url,...] [--web-seeds url,...] [--comment text] [--private] [--source tag] <file or directory>")
+		}
+		options := CreateOptions{
+			PieceLength: *pieceLength,
+			Comment:     *comment,
+			Private:     *private,
+			Source:      *source,
+		}
+		if *trackersFlag != "" {
+			options.Trackers = strings.Split(*trackersFlag, ",")
+		}
+		if *webSeedsFlag != "" {
+			options.WebSeeds = strings.Split(*webSeedsFlag, ",")
+		}
+		contents, stats, err := CreateTorrent(flags.Arg(0), options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		output := *outputFlag
+		if output == "" {
+			path, err := filepath.Abs(flags.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			output = filepath.Base(path) + ".torrent"
+		}
+		if err := os.WriteFile(output, contents, 0644); err != nil {
+			log.Fatal(err)
+		}
+		torrent := NewTorrentParser(NewBencode()).ParseBytes(contents)
+		if torrent.Err != nil {
+			log.Fatal(torrent.Err)
+		}
+		fmt.Printf("Created %v with info hash %x.\n", output, torrent.Metainfo.Info.Hash)
+		printHashStats(stats)
+	} else if command == "verify" || command == "recheck" {
+		if len(os.Args) < 4 {
+			log.Fatal("usage: " + command + " <torrent> <output>")
+		}
+		file := os.Args[2]
+		output := os.Args[3]
+		torrent := NewTorrentParser(NewBencode()).Parse(file)
+		if torrent.Err != nil {
+			log.Fatal(torrent.Err)
+		}
+		if _, err := os.Stat(output); err != nil {
+			log.Fatal(err)
+		}
+		storage, err := NewFileStorage(&torrent.Metainfo.Info, output, AllocateSparse, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		session := NewSession(torrent, nil)
+		session.SetStorage(storage)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		result, err := session.Recheck(ctx)
+		interrupted := ctx.Err() != nil
+		stop()
+		// Closing the session rewrites the resume data of the storage.
+		if err := session.Close(); err != nil {
+			log.Println(err)
+		}
+		if interrupted {
+			log.Fatal("verification interrupted")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		pieces := len(torrent.Metainfo.Info.Pieces)
+		for index := 0; index < pieces; index++ {
+			status := "missing"
+			if result.Completed.Has(index) {
+				status = "ok"
+			} else if result.Corrupt.Has(index) {
+				status = "corrupt"
+			}
+			fmt.Printf("Piece %d: %v\n", index, status)
+		}
+		fmt.Printf("Verified %d/%d pieces of %v, %d corrupt.\n", result.Completed.Count(pieces), pieces, output, result.Corrupt.Count(pieces))
+		printHashStats(result.Stats)
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
 	}
 }
+
+func isClosed(channel chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
+
+func printHashStats(stats HashStats) {
+	fmt.Printf("Hashed %d bytes in %v (%.1f MiB/s).\n", stats.Bytes, stats.Elapsed.Round(time.Millisecond), stats.Throughput()/(1024*1024))
+}
+
+func printDiskStats(stats DiskStats) {
+	fmt.Printf("Disk queue peaked at %d jobs, read cache hit rate %.1f%% (%d hits, %d misses).\n", stats.PeakQueueDepth, 100*stats.HitRate(), stats.CacheHits, stats.CacheMisses)
+}
+
+func printInfo(torrent *Torrent) {
+	info := &torrent.Metainfo.Info
+	fmt.Println("Tracker URL: " + torrent.Metainfo.Announce)
+	fmt.Println("Length:", info.Length)
+	fmt.Println("Version:", info.Version())
+	if info.MetaVersion == 1 || info.Hybrid {
+		fmt.Println("Info Hash:", hex.EncodeToString(info.Hash))
+	}
+	if info.HashV2 != nil {
+		fmt.Println("Info Hash v2:", hex.EncodeToString(info.HashV2))
+	}
+	fmt.Println("Piece Length:", info.PieceLength)
+	if info.MultiFile {
+		fmt.Println("Files:")
+		for index, file := range info.Files {
+			fmt.Printf("%d: %v (%d)", index, filepath.Join(file.Path...), file.Length)
+			if file.PiecesRoot != nil {
+				fmt.Printf(" %x", file.PiecesRoot)
+			}
+			fmt.Println()
+		}
+	}
+	fmt.Println("Piece Hashes:")
+	for _, value := range info.Pieces {
+		fmt.Println(hex.EncodeToString(value))
+	}
+}
+
+// dhtTarget reads the info hash to look up from a magnet link or its hex
+// form.
+func dhtTarget(value string) (NodeId, error) {
+	var infoHash []byte
+	if strings.HasPrefix(value, "magnet:") {
+		magnet, err := ParseMagnet(value)
+		if err != nil {
+			return NodeId{}, err
+		}
+		infoHash = magnet.InfoHash
+	} else {
+		infoHash, _ = hex.DecodeString(value)
+	}
+	var id NodeId
+	if len(infoHash) != len(id) {
+		return NodeId{}, ErrInvalidInfoHash
+	}
+	copy(id[:], infoHash)
+	return id, nil
+}
+
+// magnetAddresses collects the peers of a magnet link from its trackers, the
+// peers it lists itself and the DHT when not nil.
+func magnetAddresses(client *TorrentClient, magnet *Magnet, dht *DHT) ([]string, error) {
+	addresses := append([]string{}, magnet.Peers...)
+	if dht != nil {
+		var infoHash NodeId
+		copy(infoHash[:], magnet.InfoHash)
+		addresses = append(addresses, dht.Peers(infoHash, nil)...)
+	}
+	peers, err := client.MagnetPeers(magnet, DefaultPeerId)
+	if err != nil && len(addresses) == 0 {
+		return nil, err
+	}
+	for _, peer := range peers {
+		addresses = append(addresses, peer.Address())
+	}
+	if len(addresses) == 0 {
+		return nil, ErrNoPeers
+	}
+	return addresses, nil
+}
+
+// startDHT runs a DHT node on a random port bootstrapped from
+// DefaultBootstrapNodes, its routing table is refreshed until it is closed.
+func startDHT() (*DHT, error) {
+	dht := NewDHT(NewNodeId(), 0)
+	if err := dht.Listen(); err != nil {
+		return nil, err
+	}
+	go dht.Serve()
+	if err := dht.Bootstrap(DefaultBootstrapNodes); err != nil {
+		dht.Close()
+		return nil, err
+	}
+	go dht.Run(nil)
+	return dht, nil
+}
+
+// startListener accepts peers on a random port, for peers that find us
+// through the DHT.
+func startListener(policy EncryptionPolicy) (*Listener, error) {
+	listener := NewListener(0)
+	listener.SetEncryption(policy)
+	if err := listener.Listen(); err != nil {
+		return nil, err
+	}
+	go listener.Serve()
+	return listener, nil
+}
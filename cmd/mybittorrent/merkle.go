@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// merkleRoot hashes a layer of a v2 merkle tree up to its root. The layer is
+// padded with pad to width nodes, or to the next power of two when longer.
+func merkleRoot(layer [][]byte, width int, pad []byte) []byte {
+	size := 1
+	for size < len(layer) || size < width {
+		size *= 2
+	}
+	nodes := make([][]byte, size)
+	copy(nodes, layer)
+	for index := len(layer); index < size; index++ {
+		nodes[index] = pad
+	}
+	for len(nodes) > 1 {
+		parents := make([][]byte, len(nodes)/2)
+		for index := range parents {
+			parents[index] = hashPair(nodes[2*index], nodes[2*index+1])
+		}
+		nodes = parents
+	}
+	return nodes[0]
+}
+
+// zeroRoot returns the root of a subtree of leaves zero leaf hashes, which
+// pads the layers above the blocks.
+func zeroRoot(leaves int) []byte {
+	root := make([]byte, sha256.Size)
+	for width := 1; width < leaves; width *= 2 {
+		root = hashPair(root, root)
+	}
+	return root
+}
+
+func hashPair(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// splitHashes cuts concatenated SHA-256 hashes apart.
+func splitHashes(data []byte) [][]byte {
+	hashes := make([][]byte, 0, len(data)/sha256.Size)
+	for len(data) >= sha256.Size {
+		hashes = append(hashes, data[:sha256.Size])
+		data = data[sha256.Size:]
+	}
+	return hashes
+}
+
+// merkleProof returns the uncle hashes from the root of the subtree holding
+// layer[index:index+length] up to the root of the whole layer, padded with pad
+// to a power of two.
+func merkleProof(layer [][]byte, pad []byte, index, length int) [][]byte {
+	size := 1
+	for size < len(layer) {
+		size *= 2
+	}
+	nodes := make([][]byte, size)
+	copy(nodes, layer)
+	for position := len(layer); position < size; position++ {
+		nodes[position] = pad
+	}
+	var proof [][]byte
+	position := index
+	for len(nodes) > 1 {
+		if len(nodes) <= size/length {
+			proof = append(proof, nodes[position^1])
+		}
+		parents := make([][]byte, len(nodes)/2)
+		for node := range parents {
+			parents[node] = hashPair(nodes[2*node], nodes[2*node+1])
+		}
+		nodes = parents
+		position /= 2
+	}
+	return proof
+}
+
+// verifyMerkleProof checks hashes starting at index of a layer lead to root
+// through the uncle hashes in proof.
+func verifyMerkleProof(root []byte, hashes [][]byte, index int, proof [][]byte) bool {
+	node := merkleRoot(hashes, 0, nil)
+	position := index / len(hashes)
+	for _, uncle := range proof {
+		if position%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		position /= 2
+	}
+	return position == 0 && bytes.Equal(node, root)
+}
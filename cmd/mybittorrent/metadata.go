@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrInvalidMetadataMessage = errors.New("invalid metadata message")
+	ErrInvalidMetadataSize    = errors.New("invalid metadata size")
+	ErrMetadataRejected       = errors.New("metadata request rejected")
+	ErrMetadataHashMismatch   = errors.New("metadata does not match info hash")
+)
+
+const UtMetadata = "ut_metadata"
+const MetadataPieceSize = 16 * 1024
+const MaxMetadataSize = 16 * 1024 * 1024
+
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+type metadataMessage struct {
+	Type      int
+	Piece     int
+	TotalSize int
+	Data      []byte
+}
+
+// MetadataExtension serves our info dictionary to peers that start from a
+// magnet link.
+type MetadataExtension struct {
+	metadata []byte
+}
+
+// MetadataFetcher assembles the info dictionary from the pieces a peer sends
+// and checks it against the info hash.
+type MetadataFetcher struct {
+	infoHash []byte
+	mutex    sync.Mutex
+	size     int
+	pieces   [][]byte
+	received int
+	metadata []byte
+	err      error
+	done     chan struct{}
+}
+
+func NewMetadataExtension(metadata []byte) *MetadataExtension {
+	return &MetadataExtension{metadata: metadata}
+}
+
+func NewMetadataFetcher(infoHash []byte) *MetadataFetcher {
+	return &MetadataFetcher{
+		infoHash: infoHash,
+		done:     make(chan struct{}),
+	}
+}
+
+func metadataPieces(size int) int {
+	return (size + MetadataPieceSize - 1) / MetadataPieceSize
+}
+
+func (message *metadataMessage) encode(bencode *Bencode) []byte {
+	dict := map[string]interface{}{
+		"msg_type": message.Type,
+		"piece":    message.Piece,
+	}
+	if message.Type == metadataData {
+		dict["total_size"] = message.TotalSize
+	}
+	encode := bencode.encode(dict)
+	return append([]byte(encode.value), message.Data...)
+}
+
+func parseMetadataMessage(bencode *Bencode, payload []byte) (*metadataMessage, error) {
+	decode := bencode.Decode(string(payload))
+	if decode.err != nil {
+		return nil, decode.err
+	}
+	dict, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidMetadataMessage
+	}
+	message := &metadataMessage{Data: payload[decode.end:]}
+	if message.Type, ok = dict["msg_type"].(int); !ok {
+		return nil, ErrInvalidMetadataMessage
+	}
+	if message.Piece, ok = dict["piece"].(int); !ok || message.Piece < 0 {
+		return nil, ErrInvalidMetadataMessage
+	}
+	message.TotalSize, _ = dict["total_size"].(int)
+	return message, nil
+}
+
+func (extension *MetadataExtension) PeerHandshake(peer *PeerConnection, handshake *ExtensionHandshake) error {
+	return nil
+}
+
+func (extension *MetadataExtension) HandleMessage(peer *PeerConnection, payload []byte) error {
+	bencode := NewBencode()
+	message, err := parseMetadataMessage(bencode, payload)
+	if err != nil {
+		return err
+	}
+	if message.Type != metadataRequest {
+		return nil
+	}
+	begin := message.Piece * MetadataPieceSize
+	if begin >= len(extension.metadata) {
+		reject := &metadataMessage{Type: metadataReject, Piece: message.Piece}
+		return peer.SendExtended(UtMetadata, reject.encode(bencode))
+	}
+	end := begin + MetadataPieceSize
+	if end > len(extension.metadata) {
+		end = len(extension.metadata)
+	}
+	data := &metadataMessage{
+		Type:      metadataData,
+		Piece:     message.Piece,
+		TotalSize: len(extension.metadata),
+		Data:      extension.metadata[begin:end],
+	}
+	return peer.SendExtended(UtMetadata, data.encode(bencode))
+}
+
+// PeerHandshake learns the metadata size from the peer and requests every
+// piece of it at once, metadata is small enough not to need pipelining.
+func (fetcher *MetadataFetcher) PeerHandshake(peer *PeerConnection, handshake *ExtensionHandshake) error {
+	fetcher.mutex.Lock()
+	if fetcher.pieces == nil {
+		if handshake.MetadataSize <= 0 || handshake.MetadataSize > MaxMetadataSize {
+			fetcher.mutex.Unlock()
+			return ErrInvalidMetadataSize
+		}
+		fetcher.size = handshake.MetadataSize
+		fetcher.pieces = make([][]byte, metadataPieces(fetcher.size))
+	}
+	pieces := len(fetcher.pieces)
+	fetcher.mutex.Unlock()
+	bencode := NewBencode()
+	for piece := 0; piece < pieces; piece++ {
+		request := &metadataMessage{Type: metadataRequest, Piece: piece}
+		if err := peer.SendExtended(UtMetadata, request.encode(bencode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fetcher *MetadataFetcher) HandleMessage(peer *PeerConnection, payload []byte) error {
+	message, err := parseMetadataMessage(NewBencode(), payload)
+	if err != nil {
+		return err
+	}
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	switch message.Type {
+	case metadataReject:
+		fetcher.finish(nil, ErrMetadataRejected)
+		return nil
+	case metadataData:
+	default:
+		return nil
+	}
+	if message.Piece >= len(fetcher.pieces) || message.TotalSize != fetcher.size {
+		return ErrInvalidMetadataMessage
+	}
+	length := fetcher.size - message.Piece*MetadataPieceSize
+	if length > MetadataPieceSize {
+		length = MetadataPieceSize
+	}
+	if len(message.Data) != length {
+		return ErrInvalidMetadataMessage
+	}
+	if fetcher.pieces[message.Piece] == nil {
+		fetcher.pieces[message.Piece] = append([]byte{}, message.Data...)
+		fetcher.received++
+	}
+	if fetcher.received < len(fetcher.pieces) {
+		return nil
+	}
+	metadata := bytes.Join(fetcher.pieces, nil)
+	// Pure v2 torrents are known by their truncated SHA-256 hash.
+	hash := sha1.Sum(metadata)
+	hashV2 := sha256.Sum256(metadata)
+	if !bytes.Equal(hash[:], fetcher.infoHash) && !bytes.Equal(hashV2[:len(fetcher.infoHash)], fetcher.infoHash) {
+		fetcher.finish(nil, ErrMetadataHashMismatch)
+		return nil
+	}
+	fetcher.finish(metadata, nil)
+	return nil
+}
+
+func (fetcher *MetadataFetcher) finish(metadata []byte, err error) {
+	select {
+	case <-fetcher.done:
+		return
+	default:
+	}
+	fetcher.metadata = metadata
+	fetcher.err = err
+	close(fetcher.done)
+}
+
+func (fetcher *MetadataFetcher) Done() <-chan struct{} {
+	return fetcher.done
+}
+
+// Metadata returns the verified metadata once Done is closed.
+func (fetcher *MetadataFetcher) Metadata() ([]byte, error) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	return fetcher.metadata, fetcher.err
+}
+
+// FetchMetadata downloads the info dictionary of a torrent from a single peer.
+func FetchMetadata(address string, infoHash []byte, peerId string) ([]byte, error) {
+	peer, err := DialPeer(address, infoHash, peerId, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer peer.Close()
+	fetcher := NewMetadataFetcher(infoHash)
+	registry := NewExtensionRegistry()
+	registry.Register(UtMetadata, fetcher)
+	if _, err := exchangeExtensionHandshake(peer, registry); err != nil {
+		return nil, err
+	}
+	if !peer.SupportsExtension(UtMetadata) {
+		return nil, ErrExtensionNotSupported
+	}
+	for !isClosed(fetcher.done) {
+		message, err := peer.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if extended, ok := message.Payload.(ExtendedPayload); ok {
+			if err := registry.Handle(peer, extended); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fetcher.Metadata()
+}
+
+// exchangeExtensionHandshake sends our extension handshake and waits for the
+// peer's, passing it through the registry.
+func exchangeExtensionHandshake(peer *PeerConnection, registry *ExtensionRegistry) (*ExtensionHandshake, error) {
+	if !peer.SupportsExtensions() {
+		return nil, ErrExtensionNotSupported
+	}
+	handshake := &ExtensionHandshake{M: registry.Ids(), V: ClientVersion}
+	payload, err := handshake.encode(NewBencode())
+	if err != nil {
+		return nil, err
+	}
+	err = peer.Send(PeerMessage{Id: int32(Extended), Payload: ExtendedPayload{Id: ExtendedHandshakeId, Payload: payload}})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		message, err := peer.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if extended, ok := message.Payload.(ExtendedPayload); ok && extended.Id == ExtendedHandshakeId {
+			if err := registry.Handle(peer, extended); err != nil {
+				return nil, err
+			}
+			return peer.ExtensionHandshake(), nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// testMetadataTorrent builds a torrent through the parser so it carries real
+// metadata and a matching info hash.
+func testMetadataTorrent(t *testing.T, data []byte, pieceLength int) *Torrent {
+	var pieces []byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		pieces = append(pieces, hash[:]...)
+	}
+	encode := NewBencode().encode(map[string]interface{}{
+		"name":         "test.bin",
+		"length":       len(data),
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	})
+	torrent := NewTorrentParser(NewBencode()).ParseMetadata([]byte(encode.value), "")
+	if torrent.Err != nil {
+		t.Fatal(torrent.Err)
+	}
+	return torrent
+}
+
+func TestFetchMetadataFromSeeder(t *testing.T) {
+	data := testData(1000 * 16)
+	torrent := testMetadataTorrent(t, data, 16)
+	metadata := torrent.Metainfo.Info.Metadata
+	if len(metadata) <= MetadataPieceSize {
+		t.Fatalf("metadata should span several pieces - got %d bytes", len(metadata))
+	}
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	fetched, err := FetchMetadata("127.0.0.1:"+strconv.Itoa(listener.Port()), torrent.Metainfo.Info.Hash, "abcdefghijklmnopqrst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, metadata) {
+		t.Errorf("fetched metadata does not match - want %d bytes, got %d", len(metadata), len(fetched))
+	}
+	parsed := NewTorrentParser(NewBencode()).ParseMetadata(fetched, "")
+	if parsed.Err != nil || !bytes.Equal(parsed.Metainfo.Info.Hash, torrent.Metainfo.Info.Hash) {
+		t.Errorf("parsed metadata bad result (%v)", parsed.Err)
+	}
+}
+
+func TestMetadataFetcherRejectsBadData(t *testing.T) {
+	metadata := []byte("d4:name1:ae")
+	hash := sha1.Sum(metadata)
+	bencode := NewBencode()
+	message := func(data []byte, totalSize int) []byte {
+		return (&metadataMessage{Type: metadataData, TotalSize: totalSize, Data: data}).encode(bencode)
+	}
+
+	for name, tc := range map[string]struct {
+		payload []byte
+		err     error
+	}{
+		"wrong size":  {payload: message(metadata[1:], len(metadata)), err: ErrInvalidMetadataMessage},
+		"wrong total": {payload: message(metadata, len(metadata)+1), err: ErrInvalidMetadataMessage},
+		"wrong hash":  {payload: message([]byte("d4:name1:be"), len(metadata))},
+	} {
+		fetcher := NewMetadataFetcher(hash[:])
+		fetcher.size = len(metadata)
+		fetcher.pieces = make([][]byte, 1)
+		if err := fetcher.HandleMessage(nil, tc.payload); !errors.Is(err, tc.err) {
+			t.Errorf("%v expected %v - got %v", name, tc.err, err)
+		}
+		if name == "wrong hash" {
+			if _, err := fetcher.Metadata(); !errors.Is(err, ErrMetadataHashMismatch) {
+				t.Errorf("expected ErrMetadataHashMismatch - got %v", err)
+			}
+		}
+	}
+
+	fetcher := NewMetadataFetcher(hash[:])
+	fetcher.size = len(metadata)
+	fetcher.pieces = make([][]byte, 1)
+	if err := fetcher.HandleMessage(nil, message(metadata, len(metadata))); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetcher.Metadata(); err != nil || !bytes.Equal(got, metadata) {
+		t.Errorf("metadata bad result - want %s, got %s (%v)", metadata, got, err)
+	}
+}
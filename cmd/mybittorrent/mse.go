@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+var (
+	ErrEncryptionHandshake = errors.New("encryption handshake failed")
+	ErrEncryptionRequired  = errors.New("peer does not support encryption")
+	ErrUnknownEncryptedKey = errors.New("encrypted connection for unknown torrent")
+)
+
+type EncryptionPolicy int
+
+const (
+	EncryptionDisabled EncryptionPolicy = iota
+	EncryptionPrefer
+	EncryptionRequire
+)
+
+const msePrime = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563"
+const mseGenerator = 2
+const mseKeyLength = 96
+const msePrivateKeyLength = 20
+const mseMaxPadding = 512
+const mseDiscard = 1024
+
+const (
+	cryptoPlaintext = 1
+	cryptoRC4       = 2
+)
+
+// mseVerification is the constant both sides encrypt to find where the
+// encrypted stream starts after the random padding.
+var mseVerification = make([]byte, 8)
+
+var mseP, _ = new(big.Int).SetString(msePrime, 16)
+
+func ParseEncryptionPolicy(value string) (EncryptionPolicy, error) {
+	switch value {
+	case "disabled":
+		return EncryptionDisabled, nil
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	default:
+		return 0, fmt.Errorf("unknown encryption policy: %v", value)
+	}
+}
+
+func (policy EncryptionPolicy) String() string {
+	switch policy {
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	default:
+		return "disabled"
+	}
+}
+
+// provide returns the crypto methods offered or accepted under the policy.
+func (policy EncryptionPolicy) provide() uint32 {
+	if policy == EncryptionRequire {
+		return cryptoRC4
+	}
+	return cryptoRC4 | cryptoPlaintext
+}
+
+// mseConn reads through the buffer left over from the handshake and, when RC4
+// was selected, encrypts and decrypts everything passing through.
+type mseConn struct {
+	net.Conn
+	reader     io.Reader
+	pending    []byte
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	decrypt    *rc4.Cipher
+	encrypt    *rc4.Cipher
+}
+
+func (conn *mseConn) Read(buffer []byte) (int, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+	if len(conn.pending) > 0 {
+		n := copy(buffer, conn.pending)
+		conn.pending = conn.pending[n:]
+		return n, nil
+	}
+	n, err := conn.reader.Read(buffer)
+	if conn.decrypt != nil {
+		conn.decrypt.XORKeyStream(buffer[:n], buffer[:n])
+	}
+	return n, err
+}
+
+func (conn *mseConn) Write(data []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if conn.encrypt == nil {
+		return conn.Conn.Write(data)
+	}
+	buffer := make([]byte, len(data))
+	conn.encrypt.XORKeyStream(buffer, data)
+	return conn.Conn.Write(buffer)
+}
+
+type mseKeys struct {
+	private *big.Int
+	public  []byte
+}
+
+func newMSEKeys() (*mseKeys, error) {
+	private := make([]byte, msePrivateKeyLength)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	keys := &mseKeys{private: new(big.Int).SetBytes(private), public: make([]byte, mseKeyLength)}
+	new(big.Int).Exp(big.NewInt(mseGenerator), keys.private, mseP).FillBytes(keys.public)
+	return keys, nil
+}
+
+func (keys *mseKeys) secret(public []byte) []byte {
+	secret := make([]byte, mseKeyLength)
+	new(big.Int).Exp(new(big.Int).SetBytes(public), keys.private, mseP).FillBytes(secret)
+	return secret
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+func mseCipher(name string, secret, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	discard := make([]byte, mseDiscard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func msePadding() ([]byte, error) {
+	var length [2]byte
+	if _, err := rand.Read(length[:]); err != nil {
+		return nil, err
+	}
+	padding := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(mseMaxPadding+1))
+	_, err := rand.Read(padding)
+	return padding, err
+}
+
+func xorBytes(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+// synchronize reads up to the end of marker, which follows at most
+// mseMaxPadding bytes of padding.
+func synchronize(reader *bufio.Reader, marker []byte) error {
+	window := make([]byte, 0, mseMaxPadding+len(marker))
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return ErrEncryptionHandshake
+}
+
+// readPadded reads a two byte length followed by that many bytes.
+func readPadded(reader io.Reader, limit int) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	if int(binary.BigEndian.Uint16(length[:])) > limit {
+		return nil, ErrEncryptionHandshake
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(reader, data)
+	return data, err
+}
+
+// EncryptOutgoing runs the initiating side of the message stream encryption
+// handshake for a torrent. The returned connection carries the BitTorrent
+// handshake and everything after it, encrypted unless the peer chose
+// plaintext.
+func EncryptOutgoing(conn net.Conn, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	keys, err := newMSEKeys()
+	if err != nil {
+		return nil, err
+	}
+	padding, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(append([]byte{}, keys.public...), padding...)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	public := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, public); err != nil {
+		return nil, err
+	}
+	secret := keys.secret(public)
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	request := mseHash([]byte("req1"), secret)
+	request = append(request, xorBytes(mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), secret))...)
+	message := append([]byte{}, mseVerification...)
+	message = binary.BigEndian.AppendUint32(message, policy.provide())
+	// Neither padding nor an initial payload, the BitTorrent handshake
+	// follows once the method is selected.
+	message = append(message, 0, 0, 0, 0)
+	encrypt.XORKeyStream(message, message)
+	if _, err := conn.Write(append(request, message...)); err != nil {
+		return nil, err
+	}
+
+	verification := make([]byte, len(mseVerification))
+	decrypt.XORKeyStream(verification, mseVerification)
+	if err := synchronize(reader, verification); err != nil {
+		return nil, err
+	}
+	stream := &mseConn{Conn: conn, reader: reader, decrypt: decrypt}
+	var selected [4]byte
+	if _, err := io.ReadFull(stream, selected[:]); err != nil {
+		return nil, err
+	}
+	if _, err := readPadded(stream, mseMaxPadding); err != nil {
+		return nil, err
+	}
+	switch binary.BigEndian.Uint32(selected[:]) & policy.provide() {
+	case cryptoRC4:
+		stream.encrypt = encrypt
+	case cryptoPlaintext:
+		stream.decrypt = nil
+	default:
+		return nil, ErrEncryptionRequired
+	}
+	return stream, nil
+}
+
+// AcceptEncrypted answers a connection that may open with either a plaintext
+// BitTorrent handshake or the encryption handshake. infoHashes are the
+// torrents the peer may ask for; under EncryptionRequire plaintext peers are
+// refused.
+func AcceptEncrypted(conn net.Conn, infoHashes [][]byte, policy EncryptionPolicy) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(1 + len(ProtocolName))
+	if err != nil {
+		return nil, err
+	}
+	plaintext := prefix[0] == byte(len(ProtocolName)) && string(prefix[1:]) == ProtocolName
+	if plaintext || policy == EncryptionDisabled {
+		if policy == EncryptionRequire {
+			return nil, ErrEncryptionRequired
+		}
+		return &mseConn{Conn: conn, reader: reader}, nil
+	}
+
+	public := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, public); err != nil {
+		return nil, err
+	}
+	keys, err := newMSEKeys()
+	if err != nil {
+		return nil, err
+	}
+	padding, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(append([]byte{}, keys.public...), padding...)); err != nil {
+		return nil, err
+	}
+	secret := keys.secret(public)
+	if err := synchronize(reader, mseHash([]byte("req1"), secret)); err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, err
+	}
+	requested := xorBytes(obfuscated, mseHash([]byte("req3"), secret))
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		if bytes.Equal(mseHash([]byte("req2"), candidate), requested) {
+			infoHash = candidate
+		}
+	}
+	if infoHash == nil {
+		return nil, ErrUnknownEncryptedKey
+	}
+	decrypt := mseCipher("keyA", secret, infoHash)
+	encrypt := mseCipher("keyB", secret, infoHash)
+
+	stream := &mseConn{Conn: conn, reader: reader, decrypt: decrypt}
+	header := make([]byte, len(mseVerification)+4)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(mseVerification)], mseVerification) {
+		return nil, ErrEncryptionHandshake
+	}
+	if _, err := readPadded(stream, mseMaxPadding); err != nil {
+		return nil, err
+	}
+	initial, err := readPadded(stream, HandshakeMessageLen)
+	if err != nil {
+		return nil, err
+	}
+	provided := binary.BigEndian.Uint32(header[len(mseVerification):]) & policy.provide()
+	selected := uint32(cryptoRC4)
+	if provided&cryptoRC4 == 0 {
+		selected = cryptoPlaintext
+	}
+	if provided&selected == 0 {
+		return nil, ErrEncryptionRequired
+	}
+	message := append([]byte{}, mseVerification...)
+	message = binary.BigEndian.AppendUint32(message, selected)
+	message = append(message, 0, 0)
+	encrypt.XORKeyStream(message, message)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	// The initial payload was encrypted either way, what follows it only when
+	// RC4 was selected.
+	stream.pending = initial
+	if selected == cryptoRC4 {
+		stream.encrypt = encrypt
+	} else {
+		stream.decrypt = nil
+	}
+	return stream, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+type mseResult struct {
+	conn net.Conn
+	err  error
+}
+
+// testEncryptedPair runs both sides of the encryption handshake over a pipe.
+func testEncryptedPair(t *testing.T, infoHash []byte, outgoing, incoming EncryptionPolicy, known ...[]byte) (mseResult, mseResult) {
+	left, right := net.Pipe()
+	t.Cleanup(func() {
+		left.Close()
+		right.Close()
+	})
+	accepted := make(chan mseResult, 1)
+	go func() {
+		conn, err := AcceptEncrypted(right, known, incoming)
+		if err != nil {
+			right.Close()
+		}
+		accepted <- mseResult{conn, err}
+	}()
+	conn, err := EncryptOutgoing(left, infoHash, outgoing)
+	if err != nil {
+		left.Close()
+	}
+	return mseResult{conn, err}, <-accepted
+}
+
+func TestEncryptionPolicy(t *testing.T) {
+	for _, policy := range []EncryptionPolicy{EncryptionDisabled, EncryptionPrefer, EncryptionRequire} {
+		parsed, err := ParseEncryptionPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("policy bad result - want %v, got %v (%v)", policy, parsed, err)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("always"); err == nil {
+		t.Error("unknown policy should not parse")
+	}
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	other := bytes.Repeat([]byte{0xcd}, 20)
+	outgoing, incoming := testEncryptedPair(t, infoHash, EncryptionPrefer, EncryptionRequire, other, infoHash)
+	if outgoing.err != nil || incoming.err != nil {
+		t.Fatalf("handshake failed - %v, %v", outgoing.err, incoming.err)
+	}
+	if outgoing.conn.(*mseConn).encrypt == nil || incoming.conn.(*mseConn).encrypt == nil {
+		t.Error("RC4 should be selected when both sides support it")
+	}
+
+	handshake := (&HandshakeMessage{Reserved: reservedBytes(), InfoHash: infoHash, PeerId: []byte(DefaultPeerId)}).serialize()
+	go outgoing.conn.Write(handshake)
+	received := make([]byte, len(handshake))
+	if _, err := io.ReadFull(incoming.conn, received); err != nil || !bytes.Equal(received, handshake) {
+		t.Errorf("outgoing data bad result - want %x, got %x (%v)", handshake, received, err)
+	}
+	go incoming.conn.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(outgoing.conn, reply); err != nil || string(reply) != "reply" {
+		t.Errorf("incoming data bad result - want reply, got %q (%v)", reply, err)
+	}
+}
+
+func TestEncryptedConnectionIsObfuscated(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	handshake := (&HandshakeMessage{Reserved: reservedBytes(), InfoHash: infoHash, PeerId: []byte(DefaultPeerId)}).serialize()
+	go func() {
+		conn, err := EncryptOutgoing(left, infoHash, EncryptionRequire)
+		if err == nil {
+			conn.Write(handshake)
+		}
+		left.Close()
+	}()
+	// Record what goes over the wire while answering the handshake.
+	var wire bytes.Buffer
+	recorder := &recordingConn{Conn: right, record: &wire}
+	conn, err := AcceptEncrypted(recorder, [][]byte{infoHash}, EncryptionRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, _ := io.ReadAll(conn)
+	if !bytes.Equal(received, handshake) {
+		t.Errorf("received data bad result - want %x, got %x", handshake, received)
+	}
+	if bytes.Contains(wire.Bytes(), []byte(ProtocolName)) || bytes.Contains(wire.Bytes(), infoHash) {
+		t.Error("handshake should not be visible on the wire")
+	}
+}
+
+type recordingConn struct {
+	net.Conn
+	record *bytes.Buffer
+}
+
+func (conn *recordingConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	conn.record.Write(buffer[:n])
+	return n, err
+}
+
+func TestEncryptedConnectionPolicies(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	outgoing, incoming := testEncryptedPair(t, infoHash, EncryptionPrefer, EncryptionPrefer, infoHash)
+	if outgoing.err != nil || incoming.err != nil {
+		t.Fatalf("handshake failed - %v, %v", outgoing.err, incoming.err)
+	}
+
+	// Peers asking for a torrent we do not have are dropped.
+	outgoing, incoming = testEncryptedPair(t, infoHash, EncryptionRequire, EncryptionPrefer, bytes.Repeat([]byte{0xcd}, 20))
+	if !errors.Is(incoming.err, ErrUnknownEncryptedKey) {
+		t.Errorf("unknown torrent expected ErrUnknownEncryptedKey - got: %v", incoming.err)
+	}
+	if outgoing.err == nil {
+		t.Error("outgoing handshake should fail for an unknown torrent")
+	}
+}
+
+func TestAcceptPlaintextHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	handshake := &HandshakeMessage{Reserved: reservedBytes(), InfoHash: infoHash, PeerId: []byte(DefaultPeerId)}
+	for _, test := range []struct {
+		policy   EncryptionPolicy
+		accepted bool
+	}{
+		{EncryptionDisabled, true},
+		{EncryptionPrefer, true},
+		{EncryptionRequire, false},
+	} {
+		left, right := net.Pipe()
+		go left.Write(handshake.serialize())
+		conn, err := AcceptEncrypted(right, [][]byte{infoHash}, test.policy)
+		if !test.accepted {
+			if !errors.Is(err, ErrEncryptionRequired) {
+				t.Errorf("%v expected ErrEncryptionRequired - got: %v", test.policy, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v plaintext handshake refused - %v", test.policy, err)
+		} else if received, err := readHandshake(conn); err != nil || !bytes.Equal(received.InfoHash, infoHash) {
+			t.Errorf("%v handshake bad result - %v", test.policy, err)
+		}
+		left.Close()
+		right.Close()
+	}
+}
+
+func TestSessionDownloadEncrypted(t *testing.T) {
+	data := testData(5*BlockSize + 123)
+	torrent := testTorrent(data, 2*BlockSize)
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.SetEncryption(EncryptionRequire)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	leecher := NewSession(torrent, nil)
+	defer leecher.Close()
+	leecher.SetEncryption(EncryptionRequire)
+	if err := leecher.Download([]string{"127.0.0.1:" + strconv.Itoa(listener.Port())}); err != nil {
+		t.Fatal(err)
+	}
+	if downloaded, err := leecher.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match seeded data (%v)", err)
+	}
+}
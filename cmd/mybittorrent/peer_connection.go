@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidHandshake = errors.New("invalid handshake")
+	ErrInfoHashMismatch = errors.New("info hash mismatch")
+)
+
+const ProtocolName = "BitTorrent protocol"
+const DefaultPeerId = "00112233445566778899"
+const DialTimeout = 5 * time.Second
+const ReadTimeout = 2 * time.Minute
+
+type HandshakeMessage struct {
+	Reserved [8]byte
+	InfoHash []byte
+	PeerId   []byte
+}
+
+type PeerConnection struct {
+	Address            string
+	PeerId             []byte
+	Reserved           [8]byte
+	Bitfield           PieceBitfield
+	PeerChoking        bool
+	PeerInterested     bool
+	AmChoking          bool
+	AmInterested       bool
+	conn               net.Conn
+	writeMutex         sync.Mutex
+	requests           map[PiecePayload]struct{}
+	uploaded           int64
+	downloaded         int64
+	connectedAt        time.Time
+	lastBlock          time.Time
+	outgoing           bool
+	allowedFast        PieceBitfield
+	allowedForPeer     PieceBitfield
+	rejected           PieceBitfield
+	suggested          []int
+	hashRejects        map[string]struct{}
+	haves              []uint32
+	announce           chan struct{}
+	removed            chan struct{}
+	extensionMutex     sync.Mutex
+	extensions         map[string]int
+	extensionHandshake *ExtensionHandshake
+}
+
+func NewPeerConnection(conn net.Conn, handshake *HandshakeMessage, pieces int) *PeerConnection {
+	return &PeerConnection{
+		Address:        conn.RemoteAddr().String(),
+		PeerId:         handshake.PeerId,
+		Reserved:       handshake.Reserved,
+		Bitfield:       NewPieceBitfield(pieces),
+		allowedFast:    NewPieceBitfield(pieces),
+		allowedForPeer: NewPieceBitfield(pieces),
+		rejected:       NewPieceBitfield(pieces),
+		PeerChoking:    true,
+		AmChoking:      true,
+		conn:           conn,
+		requests:       make(map[PiecePayload]struct{}),
+		hashRejects:    make(map[string]struct{}),
+	}
+}
+
+func DialPeer(address string, infoHash []byte, peerId string, pieces int) (*PeerConnection, error) {
+	conn, err := net.DialTimeout("tcp", address, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return handshakePeer(conn, address, infoHash, peerId, pieces)
+}
+
+// handshakePeer sets up an outgoing peer over an established connection, of
+// whichever transport.
+func handshakePeer(conn net.Conn, address string, infoHash []byte, peerId string, pieces int) (*PeerConnection, error) {
+	handshake, err := exchangeHandshake(conn, &HandshakeMessage{Reserved: reservedBytes(), InfoHash: infoHash, PeerId: []byte(peerId)})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	peer := NewPeerConnection(conn, handshake, pieces)
+	peer.Address = address
+	peer.outgoing = true
+	return peer, nil
+}
+
+func exchangeHandshake(conn net.Conn, handshake *HandshakeMessage) (*HandshakeMessage, error) {
+	if _, err := conn.Write(handshake.serialize()); err != nil {
+		return nil, err
+	}
+	response, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(response.InfoHash, handshake.InfoHash) {
+		return nil, ErrInfoHashMismatch
+	}
+	return response, nil
+}
+
+// reservedBytes advertises the protocol extensions we support.
+func reservedBytes() [8]byte {
+	var reserved [8]byte
+	reserved[5] |= ExtensionBit
+	reserved[7] |= FastBit
+	reserved[7] |= V2Bit
+	return reserved
+}
+
+func (handshake *HandshakeMessage) serialize() []byte {
+	buffer := make([]byte, 0, HandshakeMessageLen)
+	buffer = append(buffer, byte(len(ProtocolName)))
+	buffer = append(buffer, []byte(ProtocolName)...)
+	buffer = append(buffer, handshake.Reserved[:]...)
+	buffer = append(buffer, handshake.InfoHash...)
+	buffer = append(buffer, handshake.PeerId...)
+	return buffer
+}
+
+func readHandshake(reader io.Reader) (*HandshakeMessage, error) {
+	buffer := make([]byte, HandshakeMessageLen)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return nil, err
+	}
+	if int(buffer[0]) != len(ProtocolName) || string(buffer[1:20]) != ProtocolName {
+		return nil, ErrInvalidHandshake
+	}
+	handshake := &HandshakeMessage{
+		InfoHash: buffer[28:48],
+		PeerId:   buffer[48:HandshakeMessageLen],
+	}
+	copy(handshake.Reserved[:], buffer[20:28])
+	return handshake, nil
+}
+
+func (peer *PeerConnection) Send(message PeerMessage) error {
+	buffer, err := serialize(message)
+	if err != nil {
+		return err
+	}
+	peer.writeMutex.Lock()
+	defer peer.writeMutex.Unlock()
+	_, err = peer.conn.Write(buffer)
+	return err
+}
+
+func (peer *PeerConnection) Receive() (PeerMessage, error) {
+	peer.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	return readMessage(peer.conn)
+}
+
+func (peer *PeerConnection) listenAddress() string {
+	if peer.outgoing {
+		return peer.Address
+	}
+	handshake := peer.ExtensionHandshake()
+	host, _, err := net.SplitHostPort(peer.Address)
+	if handshake == nil || handshake.P <= 0 || err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(handshake.P))
+}
+
+// maxRequests is how many requests may be outstanding at the peer, it never
+// exceeds the queue size the peer announced.
+func (peer *PeerConnection) maxRequests() int {
+	handshake := peer.ExtensionHandshake()
+	if handshake != nil && handshake.Reqq > 0 && handshake.Reqq < MaxPipelinedRequests {
+		return handshake.Reqq
+	}
+	return MaxPipelinedRequests
+}
+
+func (peer *PeerConnection) Close() error {
+	return peer.conn.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidMessage  = errors.New("invalid peer message")
+	ErrMessageTooLarge = errors.New("peer message too large")
+)
+
+type PeerMessage struct {
+	Id      int32
+	Payload interface{}
+}
+
+type PiecePayload struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type PieceBlockPayload struct {
+	Index int32
+	Begin int32
+	Block []byte
+}
+
+type HavePayload struct {
+	Index uint32
+}
+
+// HashRequestPayload asks for length hashes of a v2 file's merkle tree, from
+// index on in the layer base layers above the blocks, along with the uncle
+// hashes of proof layers layers to check them against the pieces root.
+type HashRequestPayload struct {
+	PiecesRoot  []byte
+	BaseLayer   uint32
+	Index       uint32
+	Length      uint32
+	ProofLayers uint32
+}
+
+type HashesPayload struct {
+	HashRequestPayload
+	Hashes [][]byte
+}
+
+type MessageType int32
+
+const (
+	Choke MessageType = iota
+	Unchoke
+	Interested
+	NotInterested
+	Have
+	Bitfield
+	Request
+	Piece
+	Cancel
+)
+
+const (
+	SuggestPiece MessageType = iota + 0x0D
+	HaveAll
+	HaveNone
+	RejectRequest
+	AllowedFast
+)
+
+const Extended MessageType = 20
+
+const (
+	HashRequest MessageType = iota + 21
+	Hashes
+	HashReject
+)
+
+const hashRequestLength = 48
+
+const KeepAlive MessageType = -1
+
+const MaxMessageLength = BlockSize + 1024*1024
+
+func serialize(message PeerMessage) ([]byte, error) {
+	if message.Id == int32(KeepAlive) {
+		return make([]byte, 4), nil
+	}
+	var buf bytes.Buffer
+	switch payload := message.Payload.(type) {
+	case nil:
+	case PieceBlockPayload:
+		binary.Write(&buf, binary.BigEndian, payload.Index)
+		binary.Write(&buf, binary.BigEndian, payload.Begin)
+		buf.Write(payload.Block)
+	case PieceBitfield:
+		buf.Write(payload)
+	case ExtendedPayload:
+		buf.WriteByte(payload.Id)
+		buf.Write(payload.Payload)
+	case HashRequestPayload:
+		payload.write(&buf)
+	case HashesPayload:
+		payload.write(&buf)
+		for _, hash := range payload.Hashes {
+			buf.Write(hash)
+		}
+	case []byte:
+		buf.Write(payload)
+	default:
+		if err := binary.Write(&buf, binary.BigEndian, message.Payload); err != nil {
+			return nil, err
+		}
+	}
+	data := buf.Bytes()
+	buffer := make([]byte, uint32(len(data))+5)
+	binary.BigEndian.PutUint32(buffer[:4], uint32(len(data)+1))
+	buffer[4] = byte(message.Id)
+	copy(buffer[5:], data)
+	return buffer, nil
+}
+
+func deserialize(buffer []byte) (PeerMessage, error) {
+	if len(buffer) == 0 {
+		return PeerMessage{Id: int32(KeepAlive)}, nil
+	}
+	id := int32(buffer[0])
+	body := buffer[1:]
+	var payload interface{}
+	switch id {
+	case int32(Have), int32(SuggestPiece), int32(AllowedFast):
+		if len(body) != 4 {
+			return PeerMessage{}, ErrInvalidMessage
+		}
+		payload = HavePayload{Index: binary.BigEndian.Uint32(body)}
+	case int32(Bitfield):
+		payload = PieceBitfield(body)
+	case int32(Request), int32(Cancel), int32(RejectRequest):
+		if len(body) != 12 {
+			return PeerMessage{}, ErrInvalidMessage
+		}
+		payload = PiecePayload{
+			Index:  binary.BigEndian.Uint32(body[0:4]),
+			Begin:  binary.BigEndian.Uint32(body[4:8]),
+			Length: binary.BigEndian.Uint32(body[8:12]),
+		}
+	case int32(Piece):
+		if len(body) < 8 {
+			return PeerMessage{}, ErrInvalidMessage
+		}
+		payload = PieceBlockPayload{
+			Index: int32(binary.BigEndian.Uint32(body[0:4])),
+			Begin: int32(binary.BigEndian.Uint32(body[4:8])),
+			Block: body[8:],
+		}
+	case int32(Extended):
+		if len(body) < 1 {
+			return PeerMessage{}, ErrInvalidMessage
+		}
+		payload = ExtendedPayload{Id: body[0], Payload: body[1:]}
+	case int32(HashRequest), int32(HashReject):
+		if len(body) != hashRequestLength {
+			return PeerMessage{}, ErrInvalidMessage
+		}
+		payload = readHashRequest(body)
+	case int32(Hashes):
+		if len(body) < hashRequestLength || (len(body)-hashRequestLength)%32 != 0 {
+			return PeerMessage{}, ErrInvalidMessage
+		}
+		payload = HashesPayload{
+			HashRequestPayload: readHashRequest(body),
+			Hashes:             splitHashes(body[hashRequestLength:]),
+		}
+	default:
+		payload = body
+	}
+	return PeerMessage{
+		Id:      id,
+		Payload: payload,
+	}, nil
+}
+
+func (payload HashRequestPayload) write(buf *bytes.Buffer) {
+	buf.Write(payload.PiecesRoot)
+	binary.Write(buf, binary.BigEndian, []uint32{payload.BaseLayer, payload.Index, payload.Length, payload.ProofLayers})
+}
+
+func readHashRequest(body []byte) HashRequestPayload {
+	return HashRequestPayload{
+		PiecesRoot:  body[0:32],
+		BaseLayer:   binary.BigEndian.Uint32(body[32:36]),
+		Index:       binary.BigEndian.Uint32(body[36:40]),
+		Length:      binary.BigEndian.Uint32(body[40:44]),
+		ProofLayers: binary.BigEndian.Uint32(body[44:48]),
+	}
+}
+
+func readMessage(reader io.Reader) (PeerMessage, error) {
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return PeerMessage{}, err
+	}
+	lengthPrefix := binary.BigEndian.Uint32(buffer)
+	if lengthPrefix > MaxMessageLength {
+		return PeerMessage{}, ErrMessageTooLarge
+	}
+	payloadBuffer := make([]byte, lengthPrefix)
+	if _, err := io.ReadFull(reader, payloadBuffer); err != nil {
+		return PeerMessage{}, err
+	}
+	return deserialize(payloadBuffer)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrInvalidPexMessage = errors.New("invalid peer exchange message")
+
+const UtPex = "ut_pex"
+const PexInterval = time.Minute
+const PexMinInterval = 45 * time.Second
+const PexMaxPeers = 50
+
+const (
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUtp        = 0x04
+	PexHolepunch  = 0x08
+	PexOutgoing   = 0x10
+)
+
+type PexPeer struct {
+	Address string
+	Flags   byte
+}
+
+type PexMessage struct {
+	Added   []PexPeer
+	Dropped []string
+}
+
+// PexExtension tells connected peers which peers we are connected to and adds
+// the peers they tell us about to the connection manager.
+type PexExtension struct {
+	session  *Session
+	mutex    sync.Mutex
+	sent     map[*PeerConnection]map[string]byte
+	received map[*PeerConnection]time.Time
+}
+
+func NewPexExtension(session *Session) *PexExtension {
+	return &PexExtension{
+		session:  session,
+		sent:     make(map[*PeerConnection]map[string]byte),
+		received: make(map[*PeerConnection]time.Time),
+	}
+}
+
+func (message *PexMessage) encode(bencode *Bencode) []byte {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+	for _, peer := range message.Added {
+		if compact, ok := compactAddress(peer.Address); ok {
+			if len(compact) == 6 {
+				added = append(added, compact...)
+				addedFlags = append(addedFlags, peer.Flags)
+			} else {
+				added6 = append(added6, compact...)
+				added6Flags = append(added6Flags, peer.Flags)
+			}
+		}
+	}
+	for _, address := range message.Dropped {
+		if compact, ok := compactAddress(address); ok {
+			if len(compact) == 6 {
+				dropped = append(dropped, compact...)
+			} else {
+				dropped6 = append(dropped6, compact...)
+			}
+		}
+	}
+	encode := bencode.encode(map[string]interface{}{
+		"added":    string(added),
+		"added.f":  string(addedFlags),
+		"added6":   string(added6),
+		"added6.f": string(added6Flags),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	})
+	return []byte(encode.value)
+}
+
+func parsePexMessage(bencode *Bencode, payload []byte) (*PexMessage, error) {
+	decode := bencode.Decode(string(payload))
+	if decode.err != nil {
+		return nil, decode.err
+	}
+	dict, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidPexMessage
+	}
+	message := &PexMessage{}
+	for _, family := range []struct {
+		added, flags, dropped string
+		size                  int
+	}{
+		{added: "added", flags: "added.f", dropped: "dropped", size: 6},
+		{added: "added6", flags: "added6.f", dropped: "dropped6", size: 18},
+	} {
+		added, _ := dict[family.added].(string)
+		flags, _ := dict[family.flags].(string)
+		dropped, _ := dict[family.dropped].(string)
+		if len(added)%family.size != 0 || len(dropped)%family.size != 0 {
+			return nil, ErrInvalidPexMessage
+		}
+		if len(flags) != len(added)/family.size {
+			flags = ""
+		}
+		for index := 0; index*family.size < len(added); index++ {
+			peer := PexPeer{Address: parseCompactAddress([]byte(added[index*family.size : (index+1)*family.size]))}
+			if flags != "" {
+				peer.Flags = flags[index]
+			}
+			message.Added = append(message.Added, peer)
+		}
+		for index := 0; index*family.size < len(dropped); index++ {
+			message.Dropped = append(message.Dropped, parseCompactAddress([]byte(dropped[index*family.size:(index+1)*family.size])))
+		}
+	}
+	return message, nil
+}
+
+// compactAddress packs an address as its IP followed by the port, six bytes
+// for IPv4 and eighteen for IPv6.
+func compactAddress(address string) ([]byte, bool) {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port)), true
+}
+
+func parseCompactAddress(compact []byte) string {
+	ip := net.IP(compact[:len(compact)-2])
+	port := binary.BigEndian.Uint16(compact[len(compact)-2:])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// PeerHandshake starts tracking what the peer was told, the next tick sends
+// it every peer we know.
+func (extension *PexExtension) PeerHandshake(peer *PeerConnection, handshake *ExtensionHandshake) error {
+	extension.mutex.Lock()
+	defer extension.mutex.Unlock()
+	if _, ok := extension.sent[peer]; !ok {
+		extension.sent[peer] = make(map[string]byte)
+	}
+	return nil
+}
+
+// HandleMessage accepts at most one message a peer per PexMinInterval and no
+// more than PexMaxPeers addresses from it.
+func (extension *PexExtension) HandleMessage(peer *PeerConnection, payload []byte) error {
+	now := extension.session.clock.Now()
+	extension.mutex.Lock()
+	last, ok := extension.received[peer]
+	if ok && now.Sub(last) < PexMinInterval {
+		extension.mutex.Unlock()
+		return nil
+	}
+	extension.received[peer] = now
+	extension.mutex.Unlock()
+	message, err := parsePexMessage(NewBencode(), payload)
+	if err != nil {
+		return err
+	}
+	seeding := extension.session.isDone()
+	var addresses []string
+	for _, added := range message.Added {
+		if len(addresses) == PexMaxPeers {
+			break
+		}
+		if seeding && added.Flags&PexSeed != 0 {
+			continue
+		}
+		addresses = append(addresses, added.Address)
+	}
+	extension.session.manager.Add(addresses...)
+	return nil
+}
+
+// Tick sends every peer that supports the extension the peers connected or
+// dropped since its last message.
+func (extension *PexExtension) Tick() {
+	connected, addresses := extension.session.pexPeers()
+	extension.mutex.Lock()
+	messages := make(map[*PeerConnection]*PexMessage)
+	for peer, sent := range extension.sent {
+		if _, ok := addresses[peer]; !ok {
+			delete(extension.sent, peer)
+			delete(extension.received, peer)
+			continue
+		}
+		message := &PexMessage{}
+		for address, flags := range connected {
+			if _, ok := sent[address]; ok || address == addresses[peer] || len(message.Added) == PexMaxPeers {
+				continue
+			}
+			message.Added = append(message.Added, PexPeer{Address: address, Flags: flags})
+			sent[address] = flags
+		}
+		for address := range sent {
+			if _, ok := connected[address]; ok || len(message.Dropped) == PexMaxPeers {
+				continue
+			}
+			message.Dropped = append(message.Dropped, address)
+			delete(sent, address)
+		}
+		if len(message.Added) > 0 || len(message.Dropped) > 0 {
+			messages[peer] = message
+		}
+	}
+	extension.mutex.Unlock()
+	bencode := NewBencode()
+	for peer, message := range messages {
+		if err := peer.SendExtended(UtPex, message.encode(bencode)); err != nil {
+			log.Println(peer.Address, err)
+		}
+	}
+}
+
+func (extension *PexExtension) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(PexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			extension.Tick()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	message := &PexMessage{
+		Added: []PexPeer{
+			{Address: "10.0.0.1:6881", Flags: PexOutgoing},
+			{Address: "[2001:db8::1]:51413", Flags: PexSeed | PexUtp},
+		},
+		Dropped: []string{"10.0.0.2:6882", "[2001:db8::2]:1"},
+	}
+	bencode := NewBencode()
+	parsed, err := parsePexMessage(bencode, message.encode(bencode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, message) {
+		t.Errorf("pex message bad result - want %v, got %v", message, parsed)
+	}
+
+	for _, payload := range []string{"le", "d5:added5:abcdee", "d8:dropped67:" + string(make([]byte, 7)) + "e"} {
+		if _, err := parsePexMessage(bencode, []byte(payload)); err == nil {
+			t.Errorf("%q expected error", payload)
+		}
+	}
+}
+
+func TestPexAcceptsLimitedPeers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	session := NewSession(testTorrent(testData(100), 32), nil)
+	defer session.Close()
+	session.clock = clock
+	peer := testPeer(session)
+
+	message := &PexMessage{}
+	for index := 0; index < PexMaxPeers+10; index++ {
+		message.Added = append(message.Added, PexPeer{Address: "10.0.1." + strconv.Itoa(index+1) + ":6881"})
+	}
+	payload := message.encode(NewBencode())
+	if err := session.pex.HandleMessage(peer, payload); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.Peers().Len(); got != PexMaxPeers {
+		t.Errorf("candidates bad result - want %d, got %d", PexMaxPeers, got)
+	}
+
+	message.Added = []PexPeer{{Address: "10.0.2.1:6881"}}
+	payload = message.encode(NewBencode())
+	session.pex.HandleMessage(peer, payload)
+	if got := session.Peers().Len(); got != PexMaxPeers {
+		t.Errorf("messages within PexMinInterval should be ignored - got %d candidates", got)
+	}
+	clock.Advance(PexMinInterval)
+	session.pex.HandleMessage(peer, payload)
+	if got := session.Peers().Len(); got != PexMaxPeers+1 {
+		t.Errorf("candidates bad result - want %d, got %d", PexMaxPeers+1, got)
+	}
+
+	clock.Advance(PexMinInterval)
+	if err := session.pex.HandleMessage(peer, []byte("i1e")); err == nil {
+		t.Error("expected error for malformed message")
+	}
+}
+
+func pexTestPeer(t *testing.T, session *Session, address string) (*PeerConnection, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	peer := NewPeerConnection(local, &HandshakeMessage{Reserved: reservedBytes()}, len(session.torrent.Metainfo.Info.Pieces))
+	peer.Address = address
+	peer.outgoing = true
+	peer.setExtensions(&ExtensionHandshake{M: map[string]int{UtPex: 9}})
+	session.peers[peer] = struct{}{}
+	session.pex.PeerHandshake(peer, peer.ExtensionHandshake())
+	return peer, remote
+}
+
+func readPex(t *testing.T, conn net.Conn) *PexMessage {
+	message, err := readMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extended, ok := message.Payload.(ExtendedPayload)
+	if !ok || extended.Id != 9 {
+		t.Fatalf("expected pex message - got %v", message)
+	}
+	pex, err := parsePexMessage(NewBencode(), extended.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pex
+}
+
+func TestPexSendsAddedAndDropped(t *testing.T) {
+	session := NewSession(testTorrent(testData(100), 32), nil)
+	defer session.Close()
+	_, first := pexTestPeer(t, session, "10.0.0.1:6881")
+	second, secondRemote := pexTestPeer(t, session, "10.0.0.2:6881")
+	second.Bitfield = bitfieldOf(4, 0, 1, 2, 3)
+	go io.Copy(io.Discard, secondRemote)
+
+	go session.pex.Tick()
+	message := readPex(t, first)
+	want := []PexPeer{{Address: "10.0.0.2:6881", Flags: PexOutgoing | PexSeed}}
+	if !reflect.DeepEqual(message.Added, want) || len(message.Dropped) != 0 {
+		t.Errorf("added bad result - want %v, got %v", want, message)
+	}
+
+	session.mutex.Lock()
+	delete(session.peers, second)
+	session.mutex.Unlock()
+	go session.pex.Tick()
+	message = readPex(t, first)
+	if len(message.Added) != 0 || !reflect.DeepEqual(message.Dropped, []string{"10.0.0.2:6881"}) {
+		t.Errorf("dropped bad result - want 10.0.0.2:6881, got %v", message)
+	}
+}
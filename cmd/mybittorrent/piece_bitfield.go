@@ -0,0 +1,51 @@
+package main
+
+type PieceBitfield []byte
+
+func NewPieceBitfield(length int) PieceBitfield {
+	return make(PieceBitfield, (length+7)/8)
+}
+
+func (bitfield PieceBitfield) Has(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitfield) {
+		return false
+	}
+	return bitfield[byteIndex]>>(7-uint(index%8))&1 != 0
+}
+
+func (bitfield PieceBitfield) Set(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitfield) {
+		return
+	}
+	bitfield[byteIndex] |= 1 << (7 - uint(index%8))
+}
+
+func (bitfield PieceBitfield) Clear(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitfield) {
+		return
+	}
+	bitfield[byteIndex] &^= 1 << (7 - uint(index%8))
+}
+
+func (bitfield PieceBitfield) Count(length int) int {
+	count := 0
+	for index := 0; index < length; index++ {
+		if bitfield.Has(index) {
+			count++
+		}
+	}
+	return count
+}
+
+func (bitfield PieceBitfield) Complete(length int) bool {
+	return bitfield.Count(length) == length
+}
+
+func (bitfield PieceBitfield) Copy() PieceBitfield {
+	response := make(PieceBitfield, len(bitfield))
+	copy(response, bitfield)
+	return response
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const RandomFirstPieces = 4
+
+// PiecePicker decides which piece a peer should download next. Implementations
+// are not safe for concurrent use, the caller is expected to serialize access.
+type PiecePicker interface {
+	AddBitfield(bitfield PieceBitfield)
+	RemoveBitfield(bitfield PieceBitfield)
+	AddHave(index int)
+	Pick(available PieceBitfield) (int, bool)
+	Release(index int, partial bool)
+	Complete(index int)
+	Reset(index int)
+	SetPriority(index int, priority FilePriority)
+}
+
+type pickerState struct {
+	pieces     int
+	completed  PieceBitfield
+	picked     PieceBitfield
+	partial    PieceBitfield
+	priorities []FilePriority
+	done       int
+}
+
+type SequentialPicker struct {
+	pickerState
+}
+
+type RarestFirstPicker struct {
+	pickerState
+	availability []int
+	random       *rand.Rand
+}
+
+func newPickerState(pieces int) pickerState {
+	priorities := make([]FilePriority, pieces)
+	for index := range priorities {
+		priorities[index] = PriorityNormal
+	}
+	return pickerState{
+		pieces:     pieces,
+		completed:  NewPieceBitfield(pieces),
+		picked:     NewPieceBitfield(pieces),
+		partial:    NewPieceBitfield(pieces),
+		priorities: priorities,
+	}
+}
+
+func NewSequentialPicker(pieces int) *SequentialPicker {
+	return &SequentialPicker{
+		pickerState: newPickerState(pieces),
+	}
+}
+
+func NewRarestFirstPicker(pieces int) *RarestFirstPicker {
+	return &RarestFirstPicker{
+		pickerState:  newPickerState(pieces),
+		availability: make([]int, pieces),
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (state *pickerState) candidate(index int, available PieceBitfield) bool {
+	return available.Has(index) && !state.completed.Has(index) && !state.picked.Has(index) &&
+		state.priorities[index] != PrioritySkip
+}
+
+func (state *pickerState) pickPartial(available PieceBitfield) (int, bool) {
+	found := false
+	best := 0
+	for index := 0; index < state.pieces; index++ {
+		if state.partial.Has(index) && state.candidate(index, available) &&
+			(!found || state.priorities[index] > state.priorities[best]) {
+			best = index
+			found = true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	state.picked.Set(best)
+	return best, true
+}
+
+func (state *pickerState) SetPriority(index int, priority FilePriority) {
+	if index >= 0 && index < state.pieces {
+		state.priorities[index] = priority
+	}
+}
+
+func (state *pickerState) Release(index int, partial bool) {
+	state.picked.Clear(index)
+	if partial {
+		state.partial.Set(index)
+	} else {
+		state.partial.Clear(index)
+	}
+}
+
+func (state *pickerState) Complete(index int) {
+	if index < 0 || index >= state.pieces || state.completed.Has(index) {
+		return
+	}
+	state.completed.Set(index)
+	state.picked.Clear(index)
+	state.partial.Clear(index)
+	state.done++
+}
+
+// Reset makes a completed piece pickable again, for data that turned out to
+// be bad.
+func (state *pickerState) Reset(index int) {
+	if index < 0 || index >= state.pieces || !state.completed.Has(index) {
+		return
+	}
+	state.completed.Clear(index)
+	state.done--
+}
+
+func (picker *SequentialPicker) AddBitfield(bitfield PieceBitfield) {}
+
+func (picker *SequentialPicker) RemoveBitfield(bitfield PieceBitfield) {}
+
+func (picker *SequentialPicker) AddHave(index int) {}
+
+func (picker *SequentialPicker) Pick(available PieceBitfield) (int, bool) {
+	if index, ok := picker.pickPartial(available); ok {
+		return index, true
+	}
+	found := false
+	best := 0
+	for index := 0; index < picker.pieces; index++ {
+		if picker.candidate(index, available) && (!found || picker.priorities[index] > picker.priorities[best]) {
+			best = index
+			found = true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	picker.picked.Set(best)
+	return best, true
+}
+
+func (picker *RarestFirstPicker) AddBitfield(bitfield PieceBitfield) {
+	for index := range picker.availability {
+		if bitfield.Has(index) {
+			picker.availability[index]++
+		}
+	}
+}
+
+func (picker *RarestFirstPicker) RemoveBitfield(bitfield PieceBitfield) {
+	for index := range picker.availability {
+		if bitfield.Has(index) && picker.availability[index] > 0 {
+			picker.availability[index]--
+		}
+	}
+}
+
+func (picker *RarestFirstPicker) AddHave(index int) {
+	if index >= 0 && index < len(picker.availability) {
+		picker.availability[index]++
+	}
+}
+
+func (picker *RarestFirstPicker) Pick(available PieceBitfield) (int, bool) {
+	if index, ok := picker.pickPartial(available); ok {
+		return index, true
+	}
+	found := false
+	rarest := 0
+	ties := 0
+	for index := 0; index < picker.pieces; index++ {
+		if !picker.candidate(index, available) {
+			continue
+		}
+		if found && picker.priorities[index] < picker.priorities[rarest] {
+			continue
+		}
+		if found && picker.priorities[index] > picker.priorities[rarest] {
+			found = false
+			ties = 0
+		}
+		if picker.done < RandomFirstPieces {
+			// Until a few pieces are complete any piece will do, random selection
+			// gets us something to trade as soon as possible.
+			ties++
+			if picker.random.Intn(ties) == 0 {
+				rarest = index
+			}
+			found = true
+			continue
+		}
+		if !found || picker.availability[index] < picker.availability[rarest] {
+			rarest = index
+			ties = 1
+			found = true
+		} else if picker.availability[index] == picker.availability[rarest] {
+			ties++
+			if picker.random.Intn(ties) == 0 {
+				rarest = index
+			}
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	picker.picked.Set(rarest)
+	return rarest, true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func bitfieldOf(pieces int, indexes ...int) PieceBitfield {
+	bitfield := NewPieceBitfield(pieces)
+	for _, index := range indexes {
+		bitfield.Set(index)
+	}
+	return bitfield
+}
+
+func TestSequentialPicker(t *testing.T) {
+	picker := NewSequentialPicker(4)
+	available := bitfieldOf(4, 1, 2, 3)
+
+	for _, want := range []int{1, 2, 3} {
+		index, ok := picker.Pick(available)
+		if !ok || index != want {
+			t.Errorf("sequential pick bad result - want %d, got %d (%v)", want, index, ok)
+		}
+	}
+
+	if index, ok := picker.Pick(available); ok {
+		t.Errorf("expected no piece left - got %d", index)
+	}
+}
+
+func TestPickerPrefersPartialPieces(t *testing.T) {
+	for name, picker := range map[string]PiecePicker{
+		"sequential":   NewSequentialPicker(8),
+		"rarest first": NewRarestFirstPicker(8),
+	} {
+		available := bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6, 7)
+		picker.AddBitfield(available)
+		picker.AddBitfield(bitfieldOf(8, 0, 1, 2, 3, 4, 5))
+		for index := 0; index < 6; index++ {
+			picker.Complete(index)
+		}
+		picker.Release(7, true)
+
+		index, ok := picker.Pick(available)
+		if !ok || index != 7 {
+			t.Errorf("%v partial pick bad result - want 7, got %d (%v)", name, index, ok)
+		}
+	}
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	picker := NewRarestFirstPicker(6)
+	picker.random = rand.New(rand.NewSource(1))
+	for index := 0; index < RandomFirstPieces; index++ {
+		picker.Complete(index)
+	}
+	picker.AddBitfield(bitfieldOf(6, 4, 5))
+	picker.AddBitfield(bitfieldOf(6, 4, 5))
+	picker.AddBitfield(bitfieldOf(6, 4))
+
+	index, ok := picker.Pick(bitfieldOf(6, 4, 5))
+	if !ok || index != 5 {
+		t.Errorf("rarest pick bad result - want 5, got %d (%v)", index, ok)
+	}
+
+	picker.Release(5, false)
+	picker.AddHave(5)
+	picker.AddHave(5)
+	index, ok = picker.Pick(bitfieldOf(6, 4, 5))
+	if !ok || index != 4 {
+		t.Errorf("rarest pick after have bad result - want 4, got %d (%v)", index, ok)
+	}
+
+	picker.RemoveBitfield(bitfieldOf(6, 5))
+	picker.RemoveBitfield(bitfieldOf(6, 5))
+	picker.RemoveBitfield(bitfieldOf(6, 5))
+	picker.Release(4, false)
+	index, ok = picker.Pick(bitfieldOf(6, 4, 5))
+	if !ok || index != 5 {
+		t.Errorf("rarest pick after removal bad result - want 5, got %d (%v)", index, ok)
+	}
+}
+
+func TestRarestFirstPickerRandomFirstPieces(t *testing.T) {
+	picker := NewRarestFirstPicker(64)
+	picker.random = rand.New(rand.NewSource(1))
+	available := NewPieceBitfield(64)
+	for index := 0; index < 64; index++ {
+		available.Set(index)
+	}
+	picker.AddBitfield(bitfieldOf(64, 0))
+
+	picked := make(map[int]bool)
+	for i := 0; i < RandomFirstPieces; i++ {
+		index, ok := picker.Pick(available)
+		if !ok {
+			t.Fatal("expected a piece to be picked")
+		}
+		picked[index] = true
+		picker.Release(index, false)
+	}
+
+	if len(picked) < 2 {
+		t.Errorf("random first pieces bad result - want several distinct pieces, got %v", picked)
+	}
+}
+
+func TestPickerFollowsPriorities(t *testing.T) {
+	for name, picker := range map[string]PiecePicker{
+		"sequential":   NewSequentialPicker(5),
+		"rarest first": NewRarestFirstPicker(5),
+	} {
+		available := bitfieldOf(5, 0, 1, 2, 3, 4)
+		picker.AddBitfield(available)
+		picker.SetPriority(0, PrioritySkip)
+		picker.SetPriority(1, PriorityLow)
+		picker.SetPriority(3, PriorityHigh)
+
+		var got []int
+		for {
+			index, ok := picker.Pick(available)
+			if !ok {
+				break
+			}
+			got = append(got, index)
+		}
+		if len(got) != 4 || got[0] != 3 || got[3] != 1 {
+			t.Errorf("%v priority picks bad result - want 3 first, 1 last and no 0, got %v", name, got)
+		}
+	}
+}
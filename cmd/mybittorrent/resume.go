@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+)
+
+var ErrInvalidResumeData = errors.New("invalid resume data")
+
+const ResumeExtension = ".resume"
+
+type ResumeData struct {
+	InfoHash []byte
+	Pieces   PieceBitfield
+	Files    []ResumeFile
+}
+
+type ResumeFile struct {
+	Path   string
+	Length int64
+	Mtime  int64
+}
+
+func ResumePath(output string) string {
+	return output + ResumeExtension
+}
+
+func NewResumeFile(path string) (ResumeFile, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return ResumeFile{}, err
+	}
+	return ResumeFile{
+		Path:   path,
+		Length: stat.Size(),
+		Mtime:  stat.ModTime().UnixNano(),
+	}, nil
+}
+
+func LoadResumeData(bencode *Bencode, path string) (*ResumeData, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) == 0 {
+		return nil, ErrInvalidResumeData
+	}
+	decode := bencode.Decode(string(contents))
+	if decode.err != nil {
+		return nil, decode.err
+	}
+	dict, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidResumeData
+	}
+	infoHash, ok := dict["info hash"].(string)
+	if !ok {
+		return nil, ErrInvalidResumeData
+	}
+	pieces, ok := dict["pieces"].(string)
+	if !ok {
+		return nil, ErrInvalidResumeData
+	}
+	files, ok := dict["files"].([]interface{})
+	if !ok {
+		return nil, ErrInvalidResumeData
+	}
+	resume := &ResumeData{
+		InfoHash: []byte(infoHash),
+		Pieces:   PieceBitfield(pieces),
+	}
+	for _, value := range files {
+		file, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidResumeData
+		}
+		path, _ := file["path"].(string)
+		length, _ := file["length"].(int)
+		mtime, _ := file["mtime"].(int)
+		resume.Files = append(resume.Files, ResumeFile{
+			Path:   path,
+			Length: int64(length),
+			Mtime:  int64(mtime),
+		})
+	}
+	return resume, nil
+}
+
+func (resume *ResumeData) Save(bencode *Bencode, path string) error {
+	files := make([]interface{}, 0, len(resume.Files))
+	for _, file := range resume.Files {
+		files = append(files, map[string]interface{}{
+			"path":   file.Path,
+			"length": int(file.Length),
+			"mtime":  int(file.Mtime),
+		})
+	}
+	encode := bencode.encode(map[string]interface{}{
+		"info hash": string(resume.InfoHash),
+		"pieces":    string(resume.Pieces),
+		"files":     files,
+	})
+	if encode.err != nil {
+		return encode.err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, []byte(encode.value), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// Matches reports whether the resume data was written for this torrent and
+// the files on disk are untouched since, so the pieces can be trusted without
+// hashing them again.
+func (resume *ResumeData) Matches(infoHash []byte, pieces int) bool {
+	if !bytes.Equal(resume.InfoHash, infoHash) || len(resume.Pieces) != len(NewPieceBitfield(pieces)) {
+		return false
+	}
+	if len(resume.Files) == 0 {
+		return false
+	}
+	for _, file := range resume.Files {
+		current, err := NewResumeFile(file.Path)
+		if err != nil || current != file {
+			return false
+		}
+	}
+	return true
+}
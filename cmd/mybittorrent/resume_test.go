@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openFileStorage(t *testing.T, torrent *Torrent, path string) Storage {
+	storage, err := NewFileStorage(&torrent.Metainfo.Info, path, AllocateSparse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewResumeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume := &ResumeData{
+		InfoHash: []byte("01234567890123456789"),
+		Pieces:   bitfieldOf(10, 0, 3, 9),
+		Files:    []ResumeFile{file},
+	}
+
+	if err := resume.Save(NewBencode(), ResumePath(path)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadResumeData(NewBencode(), ResumePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(loaded.Pieces) != string(resume.Pieces) {
+		t.Errorf("pieces bad result - want %v, got %v", resume.Pieces, loaded.Pieces)
+	}
+	if len(loaded.Files) != 1 || loaded.Files[0] != file {
+		t.Errorf("files bad result - want %v, got %v", resume.Files, loaded.Files)
+	}
+	if !loaded.Matches(resume.InfoHash, 10) {
+		t.Error("resume data should match untouched files")
+	}
+	if loaded.Matches([]byte("98765432109876543210"), 10) {
+		t.Error("resume data should not match another info hash")
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Matches(resume.InfoHash, 10) {
+		t.Error("resume data should not match a modified file")
+	}
+}
+
+func TestSessionOpenUsesResumeData(t *testing.T) {
+	data := testData(4 * BlockSize)
+	torrent := testTorrent(data, BlockSize)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewSession(torrent, nil)
+	if err := first.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt a piece without touching the modification time, resume data
+	// is trusted so the piece is still considered complete.
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, data...)
+	corrupted[BlockSize] ^= 0xff
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := NewSession(torrent, nil)
+	if err := resumed.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if count := resumed.Completed().Count(4); count != 4 {
+		t.Errorf("resumed pieces bad result - want 4, got %d", count)
+	}
+
+	rechecked := NewSession(torrent, nil)
+	if err := rechecked.Attach(openFileStorage(t, torrent, path), true); err != nil {
+		t.Fatal(err)
+	}
+	defer rechecked.Close()
+	completed := rechecked.Completed()
+	if completed.Has(1) || completed.Count(4) != 3 {
+		t.Errorf("rechecked pieces bad result - want all but piece 1, got %08b", completed)
+	}
+	if rechecked.Left() != BlockSize {
+		t.Errorf("left bad result - want %d, got %d", BlockSize, rechecked.Left())
+	}
+}
+
+func TestSessionRecheckClearsStalePieces(t *testing.T) {
+	data := testData(4 * BlockSize)
+	torrent := testTorrent(data, BlockSize)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := NewSession(torrent, nil)
+	if err := first.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Piece 1 is corrupted and piece 3 wiped behind the resume data's back.
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := append([]byte{}, data...)
+	changed[BlockSize] ^= 0xff
+	copy(changed[3*BlockSize:], make([]byte, BlockSize))
+	if err := os.WriteFile(path, changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	session := NewSession(torrent, NewSequentialPicker(4))
+	if err := session.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	result, err := session.Recheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Completed.Count(4) != 2 || !result.Completed.Has(0) || !result.Completed.Has(2) {
+		t.Errorf("completed pieces bad result - want 0 and 2, got %08b", result.Completed)
+	}
+	if result.Corrupt.Count(4) != 1 || !result.Corrupt.Has(1) {
+		t.Errorf("corrupt pieces bad result - want 1, got %08b", result.Corrupt)
+	}
+	if session.Completed().Count(4) != 2 || session.Left() != 2*BlockSize {
+		t.Errorf("session bad result - got %08b with %d left", session.Completed(), session.Left())
+	}
+	if request, ok := session.nextRequest(testPeer(session, 1)); !ok || request.Index != 1 {
+		t.Errorf("rechecked piece should be requested again - got %v (%v)", request, ok)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := openFileStorage(t, torrent, path)
+	defer storage.Close()
+	completion, ok := storage.Completion()
+	if !ok || completion.Count(4) != 2 || completion.Has(1) || completion.Has(3) {
+		t.Errorf("resume data bad result - want 0 and 2, got %08b (%v)", completion, ok)
+	}
+}
+
+func TestSessionWritesPiecesAsTheyComplete(t *testing.T) {
+	data := testData(4 * BlockSize)
+	torrent := testTorrent(data, 2*BlockSize)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	session := NewSession(torrent, NewSequentialPicker(2))
+	if err := session.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	peer := testPeer(session, 0, 1)
+
+	for i := 0; i < 2; i++ {
+		request, ok := session.nextRequest(peer)
+		if !ok {
+			t.Fatal("expected a request")
+		}
+		peer.requests[request] = struct{}{}
+		deliver(session, peer, data, request)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written[:2*BlockSize]) != string(data[:2*BlockSize]) {
+		t.Error("completed piece should be written to disk")
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resume, err := LoadResumeData(NewBencode(), ResumePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resume.Pieces.Has(0) || resume.Pieces.Has(1) {
+		t.Errorf("resume pieces bad result - want only piece 0, got %08b", resume.Pieces)
+	}
+}
@@ -0,0 +1,1414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDownloadIncomplete = errors.New("download incomplete")
+	ErrInvalidRequest     = errors.New("invalid block request")
+	ErrInvalidPriorities  = errors.New("file priorities do not match the torrent files")
+	ErrSessionClosed      = errors.New("session closed")
+)
+
+const MaxPipelinedRequests = 5
+const EndgameBlocks = 20
+const MaxRequestLength = 128 * 1024
+const StreamReadahead = 4
+const FlushInterval = 5 * time.Second
+
+type Stats struct {
+	Downloaded int64
+	Uploaded   int64
+	Duplicate  int64
+	Wasted     int64
+}
+
+type Session struct {
+	torrent    *Torrent
+	picker     PiecePicker
+	peerId     string
+	port       int
+	mutex      sync.Mutex
+	completed  PieceBitfield
+	wanted     PieceBitfield
+	remaining  int
+	missing    int
+	progress   map[int]*pieceProgress
+	waiters    map[int]chan struct{}
+	storage    Storage
+	disk       *DiskIO
+	commits    []int
+	peers      map[*PeerConnection]struct{}
+	stats      Stats
+	clock      Clock
+	choker     *Choker
+	extensions *ExtensionRegistry
+	manager    *ConnectionManager
+	encryption EncryptionPolicy
+	webSeeds   []string
+	// unhashed counts the pieces of a pure v2 torrent whose hash is still to
+	// be fetched from peers, hashRequests the peer asked for each file and
+	// when.
+	unhashed     int
+	hashRequests map[string]hashRequest
+	pex          *PexExtension
+	started      sync.Once
+	done         chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+	lastFlush    time.Time
+}
+
+type outgoingMessage struct {
+	peer    *PeerConnection
+	message PeerMessage
+	read    *PiecePayload
+}
+
+type pieceProgress struct {
+	index     int
+	length    int
+	received  []bool
+	requested []int
+	missing   int
+	owner     *PeerConnection
+}
+
+func NewSession(torrent *Torrent, picker PiecePicker) *Session {
+	info := torrent.Metainfo.Info
+	pieces := len(info.Pieces)
+	if picker == nil {
+		picker = NewRarestFirstPicker(pieces)
+	}
+	clock := systemClock{}
+	storage := NewMemoryStorage(&torrent.Metainfo.Info)
+	wanted := NewPieceBitfield(pieces)
+	unhashed := 0
+	for index := 0; index < pieces; index++ {
+		wanted.Set(index)
+		if len(info.Pieces[index]) == 0 {
+			unhashed++
+		}
+	}
+	session := &Session{
+		torrent:      torrent,
+		picker:       picker,
+		peerId:       DefaultPeerId,
+		completed:    NewPieceBitfield(pieces),
+		wanted:       wanted,
+		remaining:    pieces,
+		missing:      (info.Length + BlockSize - 1) / BlockSize,
+		progress:     make(map[int]*pieceProgress),
+		waiters:      make(map[int]chan struct{}),
+		storage:      storage,
+		disk:         newSessionDisk(storage, &torrent.Metainfo.Info),
+		peers:        make(map[*PeerConnection]struct{}),
+		clock:        clock,
+		choker:       NewChoker(clock, DefaultUploadSlots),
+		extensions:   NewExtensionRegistry(),
+		manager:      NewConnectionManager(clock),
+		unhashed:     unhashed,
+		hashRequests: make(map[string]hashRequest),
+		done:         make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	if len(info.Metadata) > 0 {
+		session.extensions.Register(UtMetadata, NewMetadataExtension(info.Metadata))
+	}
+	session.pex = NewPexExtension(session)
+	session.extensions.Register(UtPex, session.pex)
+	return session
+}
+
+func (s *Session) SetUploadSlots(slots int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.choker = NewChoker(s.clock, slots)
+}
+
+// SetEncryption sets whether outgoing connections use message stream
+// encryption.
+func (s *Session) SetEncryption(policy EncryptionPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.encryption = policy
+}
+
+// AddWebSeeds adds HTTP mirrors the next Download fetches pieces from next to
+// the peers.
+func (s *Session) AddWebSeeds(addresses ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.webSeeds = append(s.webSeeds, addresses...)
+}
+
+// Extensions returns the registry extension handlers are added to, they are
+// announced to every peer connected afterwards.
+func (s *Session) Extensions() *ExtensionRegistry {
+	return s.extensions
+}
+
+// Peers returns the pool of addresses the session connects to.
+func (s *Session) Peers() *ConnectionManager {
+	return s.manager
+}
+
+// SetListenPort sets the port announced to peers in the extension handshake.
+func (s *Session) SetListenPort(port int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.port = port
+}
+
+func (s *Session) extensionHandshake() PeerMessage {
+	s.mutex.Lock()
+	handshake := &ExtensionHandshake{
+		M:            s.extensions.Ids(),
+		V:            ClientVersion,
+		P:            s.port,
+		Reqq:         MaxPeerRequests,
+		MetadataSize: len(s.torrent.Metainfo.Info.Metadata),
+	}
+	s.mutex.Unlock()
+	payload, _ := handshake.encode(NewBencode())
+	return PeerMessage{Id: int32(Extended), Payload: ExtendedPayload{Id: ExtendedHandshakeId, Payload: payload}}
+}
+
+func newSessionDisk(storage Storage, info *Info) *DiskIO {
+	return NewDiskIO(storage, info, DefaultDiskWorkers, DefaultDiskQueue, DefaultReadCachePieces)
+}
+
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mutex.Lock()
+		disk := s.disk
+		s.mutex.Unlock()
+		err = disk.Close()
+	})
+	return err
+}
+
+func (s *Session) DiskStats() DiskStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.disk.Stats()
+}
+
+func (s *Session) InfoHash() []byte {
+	return s.torrent.Metainfo.Info.Hash
+}
+
+// SetStorage sets the storage the torrent data is written to and served from
+// without looking at what it holds, Attach also finds the completed pieces.
+func (s *Session) SetStorage(storage Storage) {
+	s.mutex.Lock()
+	previous := s.disk
+	s.storage = storage
+	s.disk = newSessionDisk(storage, &s.torrent.Metainfo.Info)
+	s.mutex.Unlock()
+	previous.Close()
+}
+
+// Attach sets the storage the torrent data is written to and served from.
+// Pieces the storage already records as complete are trusted, otherwise, or
+// when recheck is set, they are found by hashing the stored data.
+func (s *Session) Attach(storage Storage, recheck bool) error {
+	s.SetStorage(storage)
+	if !recheck {
+		if completion, ok := storage.Completion(); ok {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			for index := range s.torrent.Metainfo.Info.Pieces {
+				if completion.Has(index) {
+					s.markCompleted(index)
+				}
+			}
+			s.recount()
+			return nil
+		}
+	}
+	_, err := s.Recheck(context.Background())
+	return err
+}
+
+// RecheckResult is what Recheck found in the stored data. Pieces that are
+// neither complete nor corrupt are missing, they were never written.
+type RecheckResult struct {
+	Completed PieceBitfield
+	Corrupt   PieceBitfield
+	Stats     HashStats
+}
+
+// Recheck hashes the stored data against the torrent and rebuilds the set of
+// completed pieces from it, pieces that were complete and no longer verify
+// are downloaded again. The data is hashed without holding the session lock,
+// and the session is left as it was when hashing fails or ctx is cancelled.
+func (s *Session) Recheck(ctx context.Context) (*RecheckResult, error) {
+	info := &s.torrent.Metainfo.Info
+	s.mutex.Lock()
+	storage := s.storage
+	s.mutex.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pipeline := NewHashPipeline(info, 0)
+	result := &RecheckResult{
+		Completed: NewPieceBitfield(len(info.Pieces)),
+		Corrupt:   NewPieceBitfield(len(info.Pieces)),
+	}
+	var failure error
+	for piece := range pipeline.Verify(ctx, NewStorageSource(storage)) {
+		switch {
+		case failure != nil || piece.Err == io.EOF || piece.Err == io.ErrUnexpectedEOF:
+		case piece.Err != nil:
+			failure = piece.Err
+			cancel()
+		case piece.Valid:
+			result.Completed.Set(piece.Index)
+		case !piece.Empty:
+			result.Corrupt.Set(piece.Index)
+		}
+	}
+	if failure == nil {
+		failure = ctx.Err()
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	result.Stats = pipeline.Stats()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index := range info.Pieces {
+		if result.Completed.Has(index) {
+			continue
+		}
+		if err := storage.ClearComplete(index); err != nil {
+			return nil, err
+		}
+		s.markIncomplete(index)
+	}
+	for index := range info.Pieces {
+		if !result.Completed.Has(index) {
+			continue
+		}
+		if err := storage.MarkComplete(index); err != nil {
+			return nil, err
+		}
+		s.markCompleted(index)
+	}
+	s.recount()
+	return result, storage.Flush()
+}
+
+// markIncomplete forgets a completed piece whose data turned out to be bad.
+func (s *Session) markIncomplete(index int) {
+	if !s.completed.Has(index) {
+		return
+	}
+	s.completed.Clear(index)
+	s.picker.Reset(index)
+	if s.wanted.Has(index) {
+		s.remaining++
+	}
+}
+
+func (s *Session) markCompleted(index int) {
+	if s.completed.Has(index) {
+		return
+	}
+	s.completed.Set(index)
+	s.picker.Complete(index)
+	if waiter, ok := s.waiters[index]; ok {
+		close(waiter)
+		delete(s.waiters, index)
+	}
+	if !s.wanted.Has(index) {
+		return
+	}
+	s.remaining--
+	if s.remaining == 0 && !s.isDone() {
+		close(s.done)
+	}
+}
+
+// SetFilePriorities chooses which files are downloaded and which come first.
+// The session is done once every piece overlapping a file that is not skipped
+// is complete, so it has to be called before the download finishes.
+func (s *Session) SetFilePriorities(priorities []FilePriority) error {
+	info := &s.torrent.Metainfo.Info
+	if len(priorities) != len(info.Files) {
+		return ErrInvalidPriorities
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, priority := range PiecePriorities(info, priorities) {
+		s.picker.SetPriority(index, priority)
+		if priority == PrioritySkip {
+			s.wanted.Clear(index)
+		} else {
+			s.wanted.Set(index)
+		}
+	}
+	s.recount()
+	return nil
+}
+
+// WaitPiece blocks until a piece is verified, moving it and the few pieces
+// after it to the front of the picker so readers do not wait on the rest of
+// the download.
+func (s *Session) WaitPiece(ctx context.Context, index int) error {
+	s.mutex.Lock()
+	if index < 0 || index >= len(s.torrent.Metainfo.Info.Pieces) {
+		s.mutex.Unlock()
+		return ErrOutOfBounds
+	}
+	if s.completed.Has(index) {
+		s.mutex.Unlock()
+		return nil
+	}
+	waiter, ok := s.waiters[index]
+	if !ok {
+		waiter = make(chan struct{})
+		s.waiters[index] = waiter
+	}
+	s.prioritize(index, priorityDeadline)
+	for next := index + 1; next <= index+StreamReadahead && next < len(s.torrent.Metainfo.Info.Pieces); next++ {
+		s.prioritize(next, PriorityHigh)
+	}
+	s.mutex.Unlock()
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (s *Session) prioritize(index int, priority FilePriority) {
+	if s.completed.Has(index) {
+		return
+	}
+	s.picker.SetPriority(index, priority)
+	if !s.wanted.Has(index) {
+		s.wanted.Set(index)
+		s.recount()
+	}
+}
+
+// ReadAt reads verified data of a piece, going through the disk cache.
+func (s *Session) ReadAt(data []byte, piece int, offset int) (int, error) {
+	s.mutex.Lock()
+	disk := s.disk
+	s.mutex.Unlock()
+	block, err := disk.ReadBlock(piece, offset, len(data))
+	if err != nil {
+		return 0, err
+	}
+	return copy(data, block), nil
+}
+
+// recount works out the wanted pieces and blocks that are still missing.
+func (s *Session) recount() {
+	s.remaining = 0
+	s.missing = 0
+	for index := range s.torrent.Metainfo.Info.Pieces {
+		if !s.wanted.Has(index) || s.completed.Has(index) {
+			continue
+		}
+		s.remaining++
+		s.missing += s.pieceBlocks(index)
+		if progress, ok := s.progress[index]; ok {
+			s.missing -= len(progress.received) - progress.missing
+		}
+	}
+	if s.remaining == 0 && !s.isDone() {
+		close(s.done)
+	}
+}
+
+func (s *Session) Completed() PieceBitfield {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.completed.Copy()
+}
+
+func (s *Session) Left() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := s.torrent.Metainfo.Info
+	var left int64
+	for index := range info.Pieces {
+		if !s.completed.Has(index) {
+			left += int64(info.PieceSize(index))
+		}
+	}
+	return left
+}
+
+// connect dials a peer and runs the handshakes. Under EncryptionPrefer a peer
+// failing the encryption handshake is dialed again in plaintext.
+func (s *Session) connect(address string) (*PeerConnection, error) {
+	info := s.torrent.Metainfo.Info
+	s.mutex.Lock()
+	policy := s.encryption
+	s.mutex.Unlock()
+	conn, err := s.manager.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	if policy != EncryptionDisabled {
+		conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+		encrypted, err := EncryptOutgoing(conn, info.Hash, policy)
+		if err != nil {
+			conn.Close()
+			if policy == EncryptionRequire {
+				return nil, err
+			}
+			if conn, err = s.manager.Dial(address); err != nil {
+				return nil, err
+			}
+		} else {
+			conn = encrypted
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return handshakePeer(conn, address, info.Hash, s.peerId, len(info.Pieces))
+}
+
+// Download connects to peers from the connection manager, starting with
+// addresses, until every wanted piece is complete. Peers learned while it runs
+// are dialed as connection slots free up, and peers that went away once their
+// retry backoff passes. Web seeds are fetched from alongside the peers.
+func (s *Session) Download(addresses []string) error {
+	if s.isDone() {
+		return nil
+	}
+	s.manager.Add(addresses...)
+	var wg sync.WaitGroup
+	var dialedMutex sync.Mutex
+	var dialed []*PeerConnection
+	exited := make(chan struct{})
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	exit := func() {
+		select {
+		case exited <- struct{}{}:
+		case <-stop:
+		}
+	}
+	s.mutex.Lock()
+	webSeeds := s.webSeeds
+	s.mutex.Unlock()
+	active := len(webSeeds)
+	for _, address := range webSeeds {
+		wg.Add(1)
+		go func(seed *WebSeed) {
+			defer wg.Done()
+			defer exit()
+			if err := seed.Run(stop); err != nil && !s.isDone() {
+				log.Println(seed.url, err)
+			}
+		}(NewWebSeed(s, address))
+	}
+	for {
+		for active < MaxConnections {
+			address, ok := s.manager.Next()
+			if !ok {
+				break
+			}
+			active++
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+				defer exit()
+				peer, err := s.connect(address)
+				if err != nil {
+					log.Println(address, err)
+					s.manager.Disconnected(address, true)
+					return
+				}
+				// A dial finishing after the download is done would never be
+				// closed by the done branch below.
+				dialedMutex.Lock()
+				if s.isDone() {
+					dialedMutex.Unlock()
+					peer.Close()
+					s.manager.Disconnected(address, false)
+					return
+				}
+				dialed = append(dialed, peer)
+				dialedMutex.Unlock()
+				if err := s.Serve(peer); err != nil && !s.isDone() {
+					log.Println(address, err)
+				}
+				s.manager.Disconnected(address, false)
+			}(address)
+		}
+		retryAt, waiting := s.manager.NextRetry()
+		if active == 0 && !waiting {
+			if s.isDone() {
+				return nil
+			}
+			return ErrDownloadIncomplete
+		}
+		// Peers waiting out their backoff are dialed once it passes, unless
+		// every connection slot is taken.
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if waiting && active < MaxConnections {
+			timer = time.NewTimer(retryAt.Sub(s.manager.clock.Now()))
+			retry = timer.C
+		}
+		select {
+		case <-s.done:
+			dialedMutex.Lock()
+			for _, peer := range dialed {
+				peer.Close()
+			}
+			dialedMutex.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		case <-exited:
+			active--
+		case <-s.manager.Wake():
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *Session) Data() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := s.torrent.Metainfo.Info
+	data := make([]byte, info.Length)
+	for index := range info.Pieces {
+		begin := index * info.PieceLength
+		if _, err := s.storage.ReadAt(data[begin:begin+info.PieceSize(index)], index, 0); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (s *Session) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+func (s *Session) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) addPeer(peer *PeerConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peer.connectedAt = s.clock.Now()
+	s.peers[peer] = struct{}{}
+	peer.announce = make(chan struct{}, 1)
+	peer.removed = make(chan struct{})
+	go s.announceHaves(peer)
+	s.started.Do(func() {
+		go s.runChoker()
+		go s.pex.Run(s.closed)
+	})
+}
+
+// pexPeers returns the listen addresses of the connected peers with their
+// exchange flags, along with the address of each peer. Incoming peers are
+// only reachable when they told us their port.
+func (s *Session) pexPeers() (map[string]byte, map[*PeerConnection]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pieces := len(s.torrent.Metainfo.Info.Pieces)
+	connected := make(map[string]byte)
+	addresses := make(map[*PeerConnection]string)
+	for peer := range s.peers {
+		address := peer.listenAddress()
+		addresses[peer] = address
+		if address == "" {
+			continue
+		}
+		var flags byte
+		if peer.outgoing {
+			flags |= PexOutgoing
+		}
+		if peer.Bitfield.Complete(pieces) {
+			flags |= PexSeed
+		}
+		connected[address] = flags
+	}
+	return connected, addresses
+}
+
+func (s *Session) runChoker() {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.send(nil, s.rechoke())
+		}
+	}
+}
+
+func (s *Session) rechoke() []outgoingMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peers := make([]*PeerConnection, 0, len(s.peers))
+	for peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	var messages []outgoingMessage
+	for _, peer := range s.choker.Rechoke(peers, s.isDone()) {
+		id := Unchoke
+		if peer.AmChoking {
+			id = Choke
+		}
+		messages = append(messages, outgoingMessage{peer: peer, message: PeerMessage{Id: int32(id)}})
+	}
+	return messages
+}
+
+func (s *Session) removePeer(peer *PeerConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.peers, peer)
+	s.picker.RemoveBitfield(peer.Bitfield)
+	s.releasePeer(peer)
+	for root, request := range s.hashRequests {
+		if request.peer == peer {
+			delete(s.hashRequests, root)
+		}
+	}
+	if peer.removed != nil {
+		close(peer.removed)
+	}
+	peer.Close()
+}
+
+// Serve runs the message loop of an established peer connection until it fails
+// or is closed.
+func (s *Session) Serve(peer *PeerConnection) error {
+	s.addPeer(peer)
+	defer s.removePeer(peer)
+	for _, message := range s.introduction(peer) {
+		if err := peer.Send(message); err != nil {
+			return err
+		}
+	}
+	if peer.SupportsExtensions() {
+		if err := peer.Send(s.extensionHandshake()); err != nil {
+			return err
+		}
+	}
+	for {
+		message, err := peer.Receive()
+		if err != nil {
+			return err
+		}
+		if extended, ok := message.Payload.(ExtendedPayload); ok {
+			if err := s.extensions.Handle(peer, extended); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := checkFastMessage(peer, message); err != nil {
+			return err
+		}
+		if err := s.send(peer, s.handleMessage(peer, message)); err != nil {
+			return err
+		}
+		s.commitPieces()
+		if err := s.requestBlocks(peer); err != nil {
+			return err
+		}
+	}
+}
+
+// introduction returns the messages telling a new peer what we have, fast
+// peers also learn which pieces they may request while we choke them.
+func (s *Session) introduction(peer *PeerConnection) []PeerMessage {
+	pieces := len(s.torrent.Metainfo.Info.Pieces)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := s.completed.Count(pieces)
+	var messages []PeerMessage
+	switch {
+	case peer.SupportsFast() && count == pieces:
+		messages = append(messages, PeerMessage{Id: int32(HaveAll)})
+	case peer.SupportsFast() && count == 0:
+		messages = append(messages, PeerMessage{Id: int32(HaveNone)})
+	case count > 0:
+		messages = append(messages, PeerMessage{Id: int32(Bitfield), Payload: s.completed.Copy()})
+	}
+	if !peer.SupportsFast() {
+		return messages
+	}
+	for _, index := range AllowedFastSet(peerIP(peer), s.torrent.Metainfo.Info.Hash, pieces, AllowedFastCount) {
+		peer.allowedForPeer.Set(index)
+		messages = append(messages, PeerMessage{Id: int32(AllowedFast), Payload: HavePayload{Index: uint32(index)}})
+	}
+	return messages
+}
+
+// send delivers messages outside the session lock, reading the blocks of
+// served requests from disk first. Only failures to write to sender are
+// reported, other peers notice a broken connection in their own loop.
+func (s *Session) send(sender *PeerConnection, messages []outgoingMessage) error {
+	for _, outgoing := range messages {
+		if outgoing.read != nil {
+			request := outgoing.read
+			block, err := s.disk.ReadBlock(int(request.Index), int(request.Begin), int(request.Length))
+			if err != nil {
+				log.Println(outgoing.peer.Address, err)
+				continue
+			}
+			s.mutex.Lock()
+			s.stats.Uploaded += int64(len(block))
+			outgoing.peer.uploaded += int64(len(block))
+			s.mutex.Unlock()
+			outgoing.message = PeerMessage{
+				Id: int32(Piece),
+				Payload: PieceBlockPayload{
+					Index: int32(request.Index),
+					Begin: int32(request.Begin),
+					Block: block,
+				},
+			}
+		}
+		if err := outgoing.peer.Send(outgoing.message); err != nil && outgoing.peer == sender {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitPieces hands completed pieces to the disk workers. It blocks while
+// their queue is full, which keeps the calling peer from reading further.
+func (s *Session) commitPieces() {
+	s.mutex.Lock()
+	commits := s.commits
+	s.commits = nil
+	disk := s.disk
+	s.mutex.Unlock()
+	for _, index := range commits {
+		index := index
+		err := disk.CommitPiece(index, func(ok bool, err error) {
+			s.pieceVerified(index, ok, err)
+		})
+		if err != nil {
+			s.pieceVerified(index, false, err)
+		}
+	}
+}
+
+// announceHaves sends the Have messages queued in peer.haves, which the
+// session mutex guards, until the peer is removed. Every peer has its own, so
+// a peer that stops reading holds up neither the disk workers nor the other
+// peers.
+func (s *Session) announceHaves(peer *PeerConnection) {
+	for {
+		select {
+		case <-peer.announce:
+		case <-peer.removed:
+			return
+		}
+		s.mutex.Lock()
+		haves := peer.haves
+		peer.haves = nil
+		s.mutex.Unlock()
+		for _, index := range haves {
+			if err := peer.Send(PeerMessage{Id: int32(Have), Payload: HavePayload{Index: uint32(index)}}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// pieceVerified records the outcome of a commit and queues Have messages for
+// the peers, it is called from the disk workers.
+func (s *Session) pieceVerified(index int, ok bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !ok {
+		if err != nil {
+			log.Printf("piece %d could not be written: %v\n", index, err)
+		} else {
+			log.Printf("piece %d failed hash check\n", index)
+			s.stats.Wasted += int64(s.torrent.Metainfo.Info.PieceSize(index))
+		}
+		s.missing += s.pieceBlocks(index)
+		s.picker.Release(index, false)
+		return
+	}
+	s.markCompleted(index)
+	if s.remaining == 0 || s.clock.Now().Sub(s.lastFlush) >= FlushInterval {
+		s.lastFlush = s.clock.Now()
+		if err := s.storage.Flush(); err != nil {
+			log.Println(err)
+		}
+	}
+	for other := range s.peers {
+		if other.Bitfield.Has(index) {
+			continue
+		}
+		other.haves = append(other.haves, uint32(index))
+		select {
+		case other.announce <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Session) handleMessage(peer *PeerConnection, message PeerMessage) []outgoingMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch MessageType(message.Id) {
+	case Choke:
+		peer.PeerChoking = true
+		if peer.SupportsFast() {
+			// Fast peers reject the requests they drop, only the pieces we can
+			// no longer request from them go back to the picker.
+			s.disown(peer, peer.allowedFast)
+		} else {
+			s.releasePeer(peer)
+		}
+	case Unchoke:
+		peer.PeerChoking = false
+		for index := range peer.rejected {
+			peer.rejected[index] = 0
+		}
+	case Interested:
+		peer.PeerInterested = true
+		if peer.AmChoking && s.unchoked() < s.choker.Slots() {
+			peer.AmChoking = false
+			return []outgoingMessage{{peer: peer, message: PeerMessage{Id: int32(Unchoke)}}}
+		}
+	case NotInterested:
+		peer.PeerInterested = false
+	case Have:
+		index := int(message.Payload.(HavePayload).Index)
+		if !peer.Bitfield.Has(index) && s.torrent.ContainsPiece(index) {
+			peer.Bitfield.Set(index)
+			s.picker.AddHave(index)
+		}
+		return s.updateInterest(peer)
+	case Bitfield:
+		s.picker.RemoveBitfield(peer.Bitfield)
+		copy(peer.Bitfield, message.Payload.(PieceBitfield))
+		s.picker.AddBitfield(peer.Bitfield)
+		return s.updateInterest(peer)
+	case HaveAll, HaveNone:
+		s.picker.RemoveBitfield(peer.Bitfield)
+		for index := range s.torrent.Metainfo.Info.Pieces {
+			if MessageType(message.Id) == HaveAll {
+				peer.Bitfield.Set(index)
+			} else {
+				peer.Bitfield.Clear(index)
+			}
+		}
+		s.picker.AddBitfield(peer.Bitfield)
+		return s.updateInterest(peer)
+	case SuggestPiece:
+		index := int(message.Payload.(HavePayload).Index)
+		if peer.SupportsFast() && s.torrent.ContainsPiece(index) && len(peer.suggested) < MaxSuggestedPieces {
+			peer.suggested = append(peer.suggested, index)
+		}
+	case AllowedFast:
+		if peer.SupportsFast() {
+			peer.allowedFast.Set(int(message.Payload.(HavePayload).Index))
+		}
+	case RejectRequest:
+		s.rejectRequest(peer, message.Payload.(PiecePayload))
+	case Request:
+		return s.serveRequest(peer, message.Payload.(PiecePayload))
+	case Piece:
+		return s.receiveBlock(peer, message.Payload.(PieceBlockPayload))
+	case HashRequest:
+		return s.serveHashes(peer, message.Payload.(HashRequestPayload))
+	case Hashes:
+		s.receiveHashes(peer, message.Payload.(HashesPayload))
+	case HashReject:
+		root := string(message.Payload.(HashRequestPayload).PiecesRoot)
+		if s.hashRequests[root].peer == peer {
+			delete(s.hashRequests, root)
+			peer.hashRejects[root] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (s *Session) unchoked() int {
+	count := 0
+	for peer := range s.peers {
+		if !peer.AmChoking {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Session) updateInterest(peer *PeerConnection) []outgoingMessage {
+	interested := false
+	for index := range s.torrent.Metainfo.Info.Pieces {
+		if peer.Bitfield.Has(index) && !s.completed.Has(index) {
+			interested = true
+			break
+		}
+	}
+	if interested == peer.AmInterested {
+		return nil
+	}
+	peer.AmInterested = interested
+	id := NotInterested
+	if interested {
+		id = Interested
+	}
+	return []outgoingMessage{{peer: peer, message: PeerMessage{Id: int32(id)}}}
+}
+
+// serveRequest reads the requested block unless we choke the peer, fast
+// peers are told about the requests we drop and may request their allowed
+// fast pieces while choked.
+func (s *Session) serveRequest(peer *PeerConnection, request PiecePayload) []outgoingMessage {
+	index := int(request.Index)
+	choked := peer.AmChoking && !(peer.SupportsFast() && peer.allowedForPeer.Has(index))
+	if choked || !s.completed.Has(index) {
+		return s.reject(peer, request)
+	}
+	if err := s.validateRequest(request); err != nil {
+		log.Println(peer.Address, err)
+		return s.reject(peer, request)
+	}
+	return []outgoingMessage{{peer: peer, read: &request}}
+}
+
+func (s *Session) reject(peer *PeerConnection, request PiecePayload) []outgoingMessage {
+	if !peer.SupportsFast() {
+		return nil
+	}
+	return []outgoingMessage{{peer: peer, message: PeerMessage{Id: int32(RejectRequest), Payload: request}}}
+}
+
+func (s *Session) validateRequest(request PiecePayload) error {
+	info := s.torrent.Metainfo.Info
+	index := int(request.Index)
+	if !s.torrent.ContainsPiece(index) || request.Length == 0 || request.Length > MaxRequestLength ||
+		int64(request.Begin)+int64(request.Length) > int64(info.PieceSize(index)) {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+func (s *Session) requestBlocks(peer *PeerConnection) error {
+	s.mutex.Lock()
+	messages := s.requestHashes(peer)
+	for (!peer.PeerChoking || peer.SupportsFast()) && len(peer.requests) < peer.maxRequests() {
+		request, ok := s.nextRequest(peer)
+		if !ok {
+			break
+		}
+		peer.requests[request] = struct{}{}
+		messages = append(messages, PeerMessage{Id: int32(Request), Payload: request})
+	}
+	s.mutex.Unlock()
+	for _, message := range messages {
+		if err := peer.Send(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) nextRequest(peer *PeerConnection) (PiecePayload, bool) {
+	available := s.requestable(peer)
+	for _, progress := range s.progress {
+		if progress.owner != peer || !available.Has(progress.index) {
+			continue
+		}
+		if request, ok := s.requestFrom(progress, peer, false); ok {
+			return request, true
+		}
+	}
+	index, ok := s.pickSuggested(peer, available)
+	if !ok {
+		index, ok = s.picker.Pick(available)
+	}
+	if !ok {
+		return s.endgameRequest(peer, available)
+	}
+	progress, ok := s.progress[index]
+	if !ok {
+		progress = s.newProgress(index)
+		s.progress[index] = progress
+	}
+	progress.owner = peer
+	return s.requestFrom(progress, peer, false)
+}
+
+// endgameRequest hands out blocks that are already requested from other peers
+// once only a few are missing, so a slow peer cannot stall the download.
+func (s *Session) endgameRequest(peer *PeerConnection, available PieceBitfield) (PiecePayload, bool) {
+	if s.missing > EndgameBlocks {
+		return PiecePayload{}, false
+	}
+	for _, progress := range s.progress {
+		if !available.Has(progress.index) {
+			continue
+		}
+		if request, ok := s.requestFrom(progress, peer, true); ok {
+			return request, true
+		}
+	}
+	return PiecePayload{}, false
+}
+
+// requestable returns the pieces we may request from the peer, that is its
+// allowed fast set while it chokes us and never the pieces it rejected.
+func (s *Session) requestable(peer *PeerConnection) PieceBitfield {
+	available := peer.Bitfield.Copy()
+	for index := range available {
+		if peer.PeerChoking {
+			if index < len(peer.allowedFast) {
+				available[index] &= peer.allowedFast[index]
+			} else {
+				available[index] = 0
+			}
+		}
+		if index < len(peer.rejected) {
+			available[index] &^= peer.rejected[index]
+		}
+	}
+	if s.unhashed > 0 {
+		for index, hash := range s.torrent.Metainfo.Info.Pieces {
+			if len(hash) == 0 {
+				available.Clear(index)
+			}
+		}
+	}
+	return available
+}
+
+// requestHashes asks a v2 peer for the piece layers still missing, each file
+// from one peer at a time.
+func (s *Session) requestHashes(peer *PeerConnection) []PeerMessage {
+	if s.unhashed == 0 || !peer.SupportsV2() {
+		return nil
+	}
+	info := &s.torrent.Metainfo.Info
+	var messages []PeerMessage
+	for _, file := range info.Files {
+		root := string(file.PiecesRoot)
+		if file.Padding || file.Length <= info.PieceLength {
+			continue
+		}
+		if request, ok := s.hashRequests[root]; ok {
+			if s.clock.Now().Sub(request.sent) < HashRequestTimeout {
+				continue
+			}
+			// The peer never answered, it is not asked for the file again.
+			request.peer.hashRejects[root] = struct{}{}
+			delete(s.hashRequests, root)
+		}
+		if _, rejected := peer.hashRejects[root]; rejected {
+			continue
+		}
+		first, count, _ := info.filePieces(file.PiecesRoot)
+		requests := layerRequests(info, file.PiecesRoot, first, count)
+		if len(requests) == 0 {
+			continue
+		}
+		s.hashRequests[root] = hashRequest{peer: peer, sent: s.clock.Now()}
+		for _, request := range requests {
+			messages = append(messages, PeerMessage{Id: int32(HashRequest), Payload: request})
+		}
+	}
+	return messages
+}
+
+// serveHashes answers a hash request from the piece layers we have.
+func (s *Session) serveHashes(peer *PeerConnection, request HashRequestPayload) []outgoingMessage {
+	layer, ok := s.torrent.Metainfo.PieceLayers[string(request.PiecesRoot)]
+	var hashes [][]byte
+	if ok {
+		hashes, ok = layerHashes(&s.torrent.Metainfo.Info, layer, request)
+	}
+	if !ok {
+		return []outgoingMessage{{peer: peer, message: PeerMessage{Id: int32(HashReject), Payload: request}}}
+	}
+	payload := HashesPayload{HashRequestPayload: request, Hashes: hashes}
+	return []outgoingMessage{{peer: peer, message: PeerMessage{Id: int32(Hashes), Payload: payload}}}
+}
+
+// receiveHashes stores piece hashes proven against their file's pieces root,
+// which makes the pieces requestable.
+func (s *Session) receiveHashes(peer *PeerConnection, payload HashesPayload) {
+	root := string(payload.PiecesRoot)
+	hashes, ok := verifyLayerHashes(&s.torrent.Metainfo.Info, payload)
+	if !ok {
+		log.Println(peer.Address, "sent invalid piece hashes")
+		if s.hashRequests[root].peer == peer {
+			delete(s.hashRequests, root)
+		}
+		peer.hashRejects[root] = struct{}{}
+		return
+	}
+	s.unhashed -= s.torrent.Metainfo.setLayerHashes(payload.PiecesRoot, int(payload.Index), hashes)
+	if _, ok := s.torrent.Metainfo.PieceLayers[root]; ok {
+		delete(s.hashRequests, root)
+	} else if request := s.hashRequests[root]; request.peer == peer {
+		// A peer answering part of the layer gets time for the rest.
+		request.sent = s.clock.Now()
+		s.hashRequests[root] = request
+	}
+}
+
+// pickSuggested tries the pieces the peer suggested first, each suggestion is
+// only tried once.
+func (s *Session) pickSuggested(peer *PeerConnection, available PieceBitfield) (int, bool) {
+	for len(peer.suggested) > 0 {
+		index := peer.suggested[0]
+		peer.suggested = peer.suggested[1:]
+		if !available.Has(index) {
+			continue
+		}
+		only := NewPieceBitfield(len(s.torrent.Metainfo.Info.Pieces))
+		only.Set(index)
+		if index, ok := s.picker.Pick(only); ok {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Session) pieceBlocks(index int) int {
+	return (s.torrent.Metainfo.Info.PieceSize(index) + BlockSize - 1) / BlockSize
+}
+
+func (s *Session) newProgress(index int) *pieceProgress {
+	blocks := s.pieceBlocks(index)
+	return &pieceProgress{
+		index:     index,
+		length:    s.torrent.Metainfo.Info.PieceSize(index),
+		received:  make([]bool, blocks),
+		requested: make([]int, blocks),
+		missing:   blocks,
+	}
+}
+
+func (s *Session) requestFrom(progress *pieceProgress, peer *PeerConnection, endgame bool) (PiecePayload, bool) {
+	for block := range progress.requested {
+		if progress.received[block] || (progress.requested[block] > 0 && !endgame) {
+			continue
+		}
+		request := progress.blockRequest(block)
+		if _, ok := peer.requests[request]; ok {
+			continue
+		}
+		progress.requested[block]++
+		return request, true
+	}
+	return PiecePayload{}, false
+}
+
+func (progress *pieceProgress) blockRequest(block int) PiecePayload {
+	begin := block * BlockSize
+	length := BlockSize
+	if begin+length > progress.length {
+		length = progress.length - begin
+	}
+	return PiecePayload{
+		Index:  uint32(progress.index),
+		Begin:  uint32(begin),
+		Length: uint32(length),
+	}
+}
+
+func (s *Session) receiveBlock(peer *PeerConnection, payload PieceBlockPayload) []outgoingMessage {
+	request := PiecePayload{
+		Index:  uint32(payload.Index),
+		Begin:  uint32(payload.Begin),
+		Length: uint32(len(payload.Block)),
+	}
+	s.stats.Downloaded += int64(len(payload.Block))
+	peer.downloaded += int64(len(payload.Block))
+	peer.lastBlock = s.clock.Now()
+	_, requested := peer.requests[request]
+	delete(peer.requests, request)
+	progress, ok := s.progress[int(payload.Index)]
+	if !ok || !requested {
+		if s.completed.Has(int(payload.Index)) || ok {
+			s.stats.Duplicate += int64(len(payload.Block))
+		}
+		return nil
+	}
+	block := int(payload.Begin) / BlockSize
+	progress.requested[block]--
+	if progress.received[block] {
+		s.stats.Duplicate += int64(len(payload.Block))
+		return nil
+	}
+	if err := s.disk.WriteBlock(progress.index, int(payload.Begin), payload.Block); err != nil {
+		log.Println(peer.Address, err)
+		return nil
+	}
+	progress.received[block] = true
+	progress.missing--
+	s.missing--
+	messages := s.cancelRequests(peer, request)
+	if progress.missing == 0 {
+		delete(s.progress, progress.index)
+		s.commits = append(s.commits, progress.index)
+	}
+	return messages
+}
+
+func (s *Session) cancelRequests(receiver *PeerConnection, request PiecePayload) []outgoingMessage {
+	var cancels []outgoingMessage
+	for peer := range s.peers {
+		if peer == receiver {
+			continue
+		}
+		if _, ok := peer.requests[request]; !ok {
+			continue
+		}
+		delete(peer.requests, request)
+		if progress, ok := s.progress[int(request.Index)]; ok {
+			progress.requested[int(request.Begin)/BlockSize]--
+		}
+		cancels = append(cancels, outgoingMessage{
+			peer:    peer,
+			message: PeerMessage{Id: int32(Cancel), Payload: request},
+		})
+	}
+	return cancels
+}
+
+// rejectRequest frees a block the peer will not send, so it can be requested
+// from someone else right away. The peer is not asked for the piece again.
+func (s *Session) rejectRequest(peer *PeerConnection, request PiecePayload) {
+	if _, ok := peer.requests[request]; !ok {
+		return
+	}
+	delete(peer.requests, request)
+	peer.rejected.Set(int(request.Index))
+	progress, ok := s.progress[int(request.Index)]
+	if !ok {
+		return
+	}
+	progress.requested[int(request.Begin)/BlockSize]--
+	if progress.owner == peer {
+		progress.owner = nil
+		s.picker.Release(progress.index, progress.missing < len(progress.received))
+	}
+}
+
+func (s *Session) addWebSeed(peer *PeerConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.picker.AddBitfield(peer.Bitfield)
+}
+
+func (s *Session) removeWebSeed(peer *PeerConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.picker.RemoveBitfield(peer.Bitfield)
+	s.releasePeer(peer)
+}
+
+// claimPiece hands a whole piece to a source fetching pieces at once, like a
+// web seed, with all its missing blocks requested by peer.
+func (s *Session) claimPiece(peer *PeerConnection) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index, ok := s.picker.Pick(s.requestable(peer))
+	if !ok {
+		return 0, false
+	}
+	progress, ok := s.progress[index]
+	if !ok {
+		progress = s.newProgress(index)
+		s.progress[index] = progress
+	}
+	progress.owner = peer
+	for block := range progress.requested {
+		if progress.received[block] {
+			continue
+		}
+		progress.requested[block]++
+		peer.requests[progress.blockRequest(block)] = struct{}{}
+	}
+	return index, true
+}
+
+// receivePiece stores a piece fetched by claimPiece block by block.
+func (s *Session) receivePiece(peer *PeerConnection, index int, piece []byte) {
+	s.mutex.Lock()
+	var messages []outgoingMessage
+	for begin := 0; begin < len(piece); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(piece) {
+			end = len(piece)
+		}
+		payload := PieceBlockPayload{Index: int32(index), Begin: int32(begin), Block: piece[begin:end]}
+		messages = append(messages, s.receiveBlock(peer, payload)...)
+	}
+	s.mutex.Unlock()
+	s.send(nil, messages)
+	s.commitPieces()
+}
+
+// abandonPieces returns the blocks claimed by peer after a failed fetch.
+func (s *Session) abandonPieces(peer *PeerConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.releasePeer(peer)
+}
+
+func (s *Session) releasePeer(peer *PeerConnection) {
+	for request := range peer.requests {
+		if progress, ok := s.progress[int(request.Index)]; ok {
+			progress.requested[int(request.Begin)/BlockSize]--
+		}
+	}
+	peer.requests = make(map[PiecePayload]struct{})
+	s.disown(peer, nil)
+}
+
+// disown returns the pieces owned by the peer to the picker, except those in
+// keep.
+func (s *Session) disown(peer *PeerConnection, keep PieceBitfield) {
+	for _, progress := range s.progress {
+		if progress.owner != peer || keep.Has(progress.index) {
+			continue
+		}
+		progress.owner = nil
+		s.picker.Release(progress.index, progress.missing < len(progress.received))
+	}
+}
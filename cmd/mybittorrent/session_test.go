@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testTorrent(data []byte, pieceLength int) *Torrent {
+	var pieces [][]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		pieces = append(pieces, hash[:])
+	}
+	return &Torrent{
+		Metainfo: &Metainfo{
+			Info: Info{
+				Length:      len(data),
+				Name:        "test.bin",
+				PieceLength: pieceLength,
+				Hash:        make([]byte, 20),
+				Pieces:      pieces,
+				Files:       []File{{Length: len(data), Path: []string{"test.bin"}}},
+			},
+		},
+	}
+}
+
+func testData(length int) []byte {
+	data := make([]byte, length)
+	for index := range data {
+		data[index] = byte(index * 7)
+	}
+	return data
+}
+
+func testPeer(session *Session, has ...int) *PeerConnection {
+	pieces := len(session.torrent.Metainfo.Info.Pieces)
+	peer := &PeerConnection{
+		Bitfield: NewPieceBitfield(pieces),
+		requests: make(map[PiecePayload]struct{}),
+	}
+	for _, index := range has {
+		peer.Bitfield.Set(index)
+	}
+	session.peers[peer] = struct{}{}
+	session.picker.AddBitfield(peer.Bitfield)
+	return peer
+}
+
+func deliver(session *Session, peer *PeerConnection, data []byte, request PiecePayload) []outgoingMessage {
+	pieceLength := session.torrent.Metainfo.Info.PieceLength
+	begin := int(request.Index)*pieceLength + int(request.Begin)
+	session.mutex.Lock()
+	messages := session.receiveBlock(peer, PieceBlockPayload{
+		Index: int32(request.Index),
+		Begin: int32(request.Begin),
+		Block: data[begin : begin+int(request.Length)],
+	})
+	session.mutex.Unlock()
+	session.commitPieces()
+	session.disk.Drain()
+	return messages
+}
+
+func TestSessionEndgame(t *testing.T) {
+	data := testData(4 * BlockSize)
+	session := NewSession(testTorrent(data, 2*BlockSize), NewSequentialPicker(2))
+	defer session.Close()
+	slow := testPeer(session, 0, 1)
+	fast := testPeer(session, 0, 1)
+
+	var slowRequests []PiecePayload
+	for {
+		request, ok := session.nextRequest(slow)
+		if !ok {
+			break
+		}
+		slow.requests[request] = struct{}{}
+		slowRequests = append(slowRequests, request)
+	}
+	if len(slowRequests) != 4 {
+		t.Fatalf("slow peer requests bad result - want 4, got %d", len(slowRequests))
+	}
+
+	for range slowRequests {
+		duplicate, ok := session.nextRequest(fast)
+		if !ok {
+			t.Fatal("expected endgame request for fast peer")
+		}
+		fast.requests[duplicate] = struct{}{}
+	}
+	if _, ok := session.nextRequest(fast); ok {
+		t.Error("fast peer should not request the same block twice")
+	}
+
+	for _, request := range slowRequests {
+		cancels := deliver(session, fast, data, request)
+		if len(cancels) != 1 || cancels[0].peer != slow || cancels[0].message.Id != int32(Cancel) {
+			t.Errorf("cancel bad result - want cancel to slow peer, got %v", cancels)
+		}
+	}
+	if !session.isDone() {
+		t.Fatal("expected download to be complete")
+	}
+	if downloaded, err := session.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match (%v)", err)
+	}
+
+	deliver(session, slow, data, slowRequests[0])
+	stats := session.Stats()
+	if stats.Duplicate != BlockSize {
+		t.Errorf("duplicate bytes bad result - want %d, got %d", BlockSize, stats.Duplicate)
+	}
+	if stats.Downloaded != int64(len(data)+BlockSize) {
+		t.Errorf("downloaded bytes bad result - want %d, got %d", len(data)+BlockSize, stats.Downloaded)
+	}
+}
+
+func TestSessionStalledPeerDoesNotBlockCommits(t *testing.T) {
+	data := testData(4 * BlockSize)
+	torrent := testTorrent(data, 2*BlockSize)
+	session := NewSession(torrent, NewSequentialPicker(2))
+	defer session.Close()
+	source := testPeer(session, 0, 1)
+	// Nothing ever reads from the stalled peer, writes to it block forever.
+	stalledConn, stalledRemote := net.Pipe()
+	defer stalledRemote.Close()
+	stalled := NewPeerConnection(stalledConn, &HandshakeMessage{}, 2)
+	session.addPeer(stalled)
+	healthyConn, healthyRemote := net.Pipe()
+	defer healthyRemote.Close()
+	healthy := NewPeerConnection(healthyConn, &HandshakeMessage{}, 2)
+	session.addPeer(healthy)
+	haves := make(chan PeerMessage, 2)
+	go func() {
+		for {
+			message, err := readMessage(healthyRemote)
+			if err != nil {
+				return
+			}
+			haves <- message
+		}
+	}()
+
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		for {
+			request, ok := session.nextRequest(source)
+			if !ok {
+				return
+			}
+			source.requests[request] = struct{}{}
+			deliver(session, source, data, request)
+		}
+	}()
+	select {
+	case <-committed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("commits blocked on a stalled peer")
+	}
+	if !session.isDone() {
+		t.Error("expected download to be complete")
+	}
+	for index := 0; index < 2; index++ {
+		select {
+		case message := <-haves:
+			if message.Id != int32(Have) {
+				t.Errorf("message bad result - want have, got %v", message.Id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("healthy peer was not told about the piece")
+		}
+	}
+}
+
+func TestSessionNoEndgameWithManyBlocksMissing(t *testing.T) {
+	data := testData(64 * BlockSize)
+	session := NewSession(testTorrent(data, 32*BlockSize), NewSequentialPicker(2))
+	defer session.Close()
+	slow := testPeer(session, 0)
+	fast := testPeer(session, 0)
+
+	request, ok := session.nextRequest(slow)
+	if !ok {
+		t.Fatal("expected a request for the slow peer")
+	}
+	slow.requests[request] = struct{}{}
+
+	next, ok := session.nextRequest(fast)
+	if ok && next == request {
+		t.Errorf("block %v requested twice outside endgame", request)
+	}
+}
+
+func TestSessionDownloadFromSeeder(t *testing.T) {
+	data := testData(5*BlockSize + 123)
+	torrent := testTorrent(data, 2*BlockSize)
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	leecher := NewSession(torrent, nil)
+	defer leecher.Close()
+	if err := leecher.Download([]string{"127.0.0.1:" + strconv.Itoa(listener.Port())}); err != nil {
+		t.Fatal(err)
+	}
+
+	if downloaded, err := leecher.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match seeded data (%v)", err)
+	}
+	if uploaded := seeder.Stats().Uploaded; uploaded != int64(len(data)) {
+		t.Errorf("uploaded bytes bad result - want %d, got %d", len(data), uploaded)
+	}
+}
+
+func TestSessionClosesLateDials(t *testing.T) {
+	data := testData(3 * BlockSize)
+	torrent := testTorrent(data, 2*BlockSize)
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	leecher := NewSession(torrent, nil)
+	defer leecher.Close()
+	// The late peer only answers the handshake once the download is done and
+	// then keeps the connection alive for as long as it is open.
+	late, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	go func() {
+		conn, err := late.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := readHandshake(conn); err != nil {
+			return
+		}
+		<-leecher.done
+		handshake := &HandshakeMessage{Reserved: reservedBytes(), InfoHash: torrent.Metainfo.Info.Hash, PeerId: []byte(DefaultPeerId)}
+		if _, err := conn.Write(handshake.serialize()); err != nil {
+			return
+		}
+		for {
+			if _, err := conn.Write(make([]byte, 4)); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- leecher.Download([]string{
+			"127.0.0.1:" + strconv.Itoa(listener.Port()),
+			late.Addr().String(),
+		})
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not return after completing")
+	}
+}
+
+func TestSessionRedialsDisconnectedPeer(t *testing.T) {
+	data := testData(5*BlockSize + 123)
+	torrent := testTorrent(data, 2*BlockSize)
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	// The proxy drops the first connection right after the handshake and
+	// forwards the later ones to the seeder.
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		for first := true; ; first = false {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(listener.Port()))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go io.Copy(upstream, conn)
+			go func(first bool) {
+				defer conn.Close()
+				defer upstream.Close()
+				if first {
+					io.CopyN(conn, upstream, HandshakeMessageLen)
+					return
+				}
+				io.Copy(conn, upstream)
+			}(first)
+		}
+	}()
+
+	leecher := NewSession(torrent, nil)
+	defer leecher.Close()
+	leecher.Peers().retryInterval = 10 * time.Millisecond
+	result := make(chan error, 1)
+	go func() {
+		result <- leecher.Download([]string{proxy.Addr().String()})
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not finish after the peer came back")
+	}
+	if downloaded, err := leecher.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match seeded data (%v)", err)
+	}
+}
+
+func TestSessionSelectiveDownload(t *testing.T) {
+	data := testData(5*BlockSize + 100)
+	torrent := testMultiFileTorrent(data, BlockSize, BlockSize+100, 3*BlockSize, BlockSize)
+	info := &torrent.Metainfo.Info
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := NewBlobStorage(info, path, AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(blob, true); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	root := t.TempDir()
+	priorities := []FilePriority{PriorityNormal, PrioritySkip, PriorityHigh}
+	storage, err := NewFileStorage(info, root, AllocateSparse, priorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecher := NewSession(torrent, nil)
+	defer leecher.Close()
+	if err := leecher.SetFilePriorities(priorities); err != nil {
+		t.Fatal(err)
+	}
+	if err := leecher.Attach(storage, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := leecher.Download([]string{"127.0.0.1:" + strconv.Itoa(listener.Port())}); err != nil {
+		t.Fatal(err)
+	}
+
+	completed := leecher.Completed()
+	for index, want := range []bool{true, true, false, false, true, true} {
+		if completed.Has(index) != want {
+			t.Errorf("piece %d completion bad result - want %v, got %v", index, want, completed.Has(index))
+		}
+	}
+	leecher.Close()
+	for index, file := range info.Files {
+		contents, err := os.ReadFile(filepath.Join(root, "dir", file.Path[1]))
+		if priorities[index] == PrioritySkip {
+			if !os.IsNotExist(err) {
+				t.Errorf("skipped file %d should not be created - got %v", index, err)
+			}
+			continue
+		}
+		begin := int(NewFileMapping(info).FileOffset(index))
+		if err != nil || !bytes.Equal(contents, data[begin:begin+file.Length]) {
+			t.Errorf("file %d does not match seeded data (%v)", index, err)
+		}
+	}
+}
+
+func TestSessionRejectsPrioritiesForOtherFiles(t *testing.T) {
+	session := NewSession(testTorrent(testData(100), 32), nil)
+	defer session.Close()
+	if err := session.SetFilePriorities([]FilePriority{PriorityNormal, PriorityNormal}); !errors.Is(err, ErrInvalidPriorities) {
+		t.Errorf("expected ErrInvalidPriorities - got %v", err)
+	}
+}
+
+func TestSessionRejectsOutOfBoundsRequest(t *testing.T) {
+	data := testData(3 * BlockSize)
+	session := NewSession(testTorrent(data, 2*BlockSize), nil)
+	defer session.Close()
+
+	for _, request := range []PiecePayload{
+		{Index: 1, Begin: 0, Length: BlockSize + 1},
+		{Index: 1, Begin: BlockSize, Length: 1},
+		{Index: 1, Begin: 0, Length: 0},
+		{Index: 2, Begin: 0, Length: 1},
+	} {
+		if err := session.validateRequest(request); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%v expected ErrInvalidRequest - got: %v", request, err)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrOutOfBounds = errors.New("storage access out of bounds")
+
+// Storage holds the torrent data addressed by piece and offset within the
+// piece, so the download engine never deals with files directly.
+type Storage interface {
+	ReadAt(data []byte, piece int, offset int) (int, error)
+	WriteAt(data []byte, piece int, offset int) (int, error)
+	// Completion returns the pieces the storage knows to be complete, ok is
+	// false when it has no trustworthy record and the data must be rechecked.
+	Completion() (PieceBitfield, bool)
+	MarkComplete(piece int) error
+	ClearComplete(piece int) error
+	Flush() error
+	Close() error
+}
+
+type MemoryStorage struct {
+	info      *Info
+	mutex     sync.Mutex
+	data      []byte
+	completed PieceBitfield
+}
+
+type FileStorage struct {
+	*diskStorage
+}
+
+type BlobStorage struct {
+	*diskStorage
+}
+
+type diskStorage struct {
+	info      *Info
+	path      string
+	mutex     sync.Mutex
+	files     []*os.File
+	paths     []string
+	mapping   *FileMapping
+	parts     *os.File
+	completed PieceBitfield
+	dirty     bool
+}
+
+func NewMemoryStorage(info *Info) *MemoryStorage {
+	return &MemoryStorage{
+		info:      info,
+		data:      make([]byte, info.Length),
+		completed: NewPieceBitfield(len(info.Pieces)),
+	}
+}
+
+// NewFileStorage lays the torrent out as it is described in the metainfo, path
+// is the file itself for single file torrents and the root directory
+// otherwise. Files skipped by priorities are not created, the parts of
+// boundary pieces that fall into them go to a parts file next to path.
+func NewFileStorage(info *Info, path string, mode AllocationMode, priorities []FilePriority) (*FileStorage, error) {
+	paths := []string{path}
+	if info.MultiFile {
+		paths = paths[:0]
+		for _, file := range info.Files {
+			paths = append(paths, filepath.Join(append([]string{path}, file.Path...)...))
+		}
+	}
+	skipped := make([]bool, len(paths))
+	for index, priority := range priorities {
+		if index < len(skipped) && priority == PrioritySkip {
+			skipped[index] = true
+		}
+	}
+	// Padding only ever holds zeros, it is kept in the parts file like the
+	// data of skipped files rather than created next to the real files.
+	if info.MultiFile {
+		for index, file := range info.Files {
+			skipped[index] = skipped[index] || file.Padding
+		}
+	}
+	storage, err := openDiskStorage(info, path, paths, skipped, NewFileMapping(info), mode)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{diskStorage: storage}, nil
+}
+
+// NewBlobStorage keeps the whole torrent in a single file no matter how many
+// files it describes.
+func NewBlobStorage(info *Info, path string, mode AllocationMode) (*BlobStorage, error) {
+	mapping := newFileMapping(int64(info.PieceLength), []int64{int64(info.Length)})
+	storage, err := openDiskStorage(info, path, []string{path}, []bool{false}, mapping, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStorage{diskStorage: storage}, nil
+}
+
+func PartsPath(path string) string {
+	return path + ".parts"
+}
+
+func pieceOffset(info *Info, data []byte, piece int, offset int) (int64, error) {
+	if piece < 0 || piece >= len(info.Pieces) || offset < 0 || offset+len(data) > info.PieceSize(piece) {
+		return 0, ErrOutOfBounds
+	}
+	return int64(piece)*int64(info.PieceLength) + int64(offset), nil
+}
+
+func (storage *MemoryStorage) ReadAt(data []byte, piece int, offset int) (int, error) {
+	start, err := pieceOffset(storage.info, data, piece, offset)
+	if err != nil {
+		return 0, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return copy(data, storage.data[start:]), nil
+}
+
+func (storage *MemoryStorage) WriteAt(data []byte, piece int, offset int) (int, error) {
+	start, err := pieceOffset(storage.info, data, piece, offset)
+	if err != nil {
+		return 0, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return copy(storage.data[start:], data), nil
+}
+
+func (storage *MemoryStorage) Completion() (PieceBitfield, bool) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.completed.Copy(), true
+}
+
+func (storage *MemoryStorage) MarkComplete(piece int) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.completed.Set(piece)
+	return nil
+}
+
+func (storage *MemoryStorage) ClearComplete(piece int) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.completed.Clear(piece)
+	return nil
+}
+
+func (storage *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (storage *MemoryStorage) Close() error {
+	return nil
+}
+
+func (storage *MemoryStorage) Bytes() []byte {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return append([]byte{}, storage.data...)
+}
+
+func openDiskStorage(info *Info, path string, paths []string, skipped []bool, mapping *FileMapping, mode AllocationMode) (*diskStorage, error) {
+	storage := &diskStorage{
+		info:      info,
+		path:      path,
+		paths:     paths,
+		mapping:   mapping,
+		completed: NewPieceBitfield(len(info.Pieces)),
+	}
+	for index, name := range paths {
+		if skipped[index] {
+			// Skipped files are only used when an earlier run left them behind.
+			file, err := os.OpenFile(name, os.O_RDWR, 0644)
+			if err != nil && !os.IsNotExist(err) {
+				storage.Close()
+				return nil, err
+			}
+			storage.files = append(storage.files, file)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			storage.Close()
+			return nil, err
+		}
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+		storage.files = append(storage.files, file)
+		if err := allocate(file, mapping.FileLength(index), mode); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+	return storage, nil
+}
+
+func (storage *diskStorage) ReadAt(data []byte, piece int, offset int) (int, error) {
+	segments, err := storage.mapping.Segments(piece, int64(offset), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	return storage.each(data, segments, func(file *os.File, data []byte, offset int64) (int, error) {
+		return file.ReadAt(data, offset)
+	})
+}
+
+func (storage *diskStorage) WriteAt(data []byte, piece int, offset int) (int, error) {
+	segments, err := storage.mapping.Segments(piece, int64(offset), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	storage.mutex.Lock()
+	storage.dirty = true
+	storage.mutex.Unlock()
+	return storage.each(data, segments, func(file *os.File, data []byte, offset int64) (int, error) {
+		return file.WriteAt(data, offset)
+	})
+}
+
+func (storage *diskStorage) each(data []byte, segments []FileSegment, access func(*os.File, []byte, int64) (int, error)) (int, error) {
+	total := 0
+	for _, segment := range segments {
+		file, offset := storage.files[segment.File], segment.Offset
+		if file == nil {
+			parts, err := storage.partsFile()
+			if err != nil {
+				return total, err
+			}
+			file, offset = parts, storage.mapping.FileOffset(segment.File)+segment.Offset
+		}
+		n, err := access(file, data[:segment.Length], offset)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		data = data[segment.Length:]
+	}
+	return total, nil
+}
+
+// partsFile holds the data of skipped files at their offset in the torrent,
+// it is sparse and only created once a boundary piece needs it.
+func (storage *diskStorage) partsFile() (*os.File, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if storage.parts != nil {
+		return storage.parts, nil
+	}
+	parts, err := os.OpenFile(PartsPath(storage.path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	storage.parts = parts
+	return parts, nil
+}
+
+func (storage *diskStorage) Completion() (PieceBitfield, bool) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	resume, err := LoadResumeData(NewBencode(), ResumePath(storage.path))
+	if err != nil || !resume.Matches(storage.info.Hash, len(storage.info.Pieces)) {
+		return nil, false
+	}
+	for index := range storage.info.Pieces {
+		if resume.Pieces.Has(index) {
+			storage.completed.Set(index)
+		}
+	}
+	return storage.completed.Copy(), true
+}
+
+func (storage *diskStorage) MarkComplete(piece int) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.completed.Set(piece)
+	storage.dirty = true
+	return nil
+}
+
+func (storage *diskStorage) ClearComplete(piece int) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.completed.Clear(piece)
+	storage.dirty = true
+	return nil
+}
+
+// Flush syncs the files and records the completed pieces next to them, so
+// the next run can resume without hashing everything again.
+func (storage *diskStorage) Flush() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if !storage.dirty {
+		return nil
+	}
+	resume := &ResumeData{
+		InfoHash: storage.info.Hash,
+		Pieces:   storage.completed.Copy(),
+	}
+	for index, file := range storage.files {
+		if file == nil {
+			continue
+		}
+		if err := storage.recordFile(resume, file, storage.paths[index]); err != nil {
+			return err
+		}
+	}
+	if storage.parts != nil {
+		if err := storage.recordFile(resume, storage.parts, PartsPath(storage.path)); err != nil {
+			return err
+		}
+	}
+	if err := resume.Save(NewBencode(), ResumePath(storage.path)); err != nil {
+		return err
+	}
+	storage.dirty = false
+	return nil
+}
+
+func (storage *diskStorage) recordFile(resume *ResumeData, file *os.File, path string) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	resumeFile, err := NewResumeFile(path)
+	if err != nil {
+		return err
+	}
+	resume.Files = append(resume.Files, resumeFile)
+	return nil
+}
+
+func (storage *diskStorage) Close() error {
+	err := storage.Flush()
+	for _, file := range append(storage.files, storage.parts) {
+		if file == nil {
+			continue
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testMultiFileTorrent(data []byte, pieceLength int, lengths ...int) *Torrent {
+	torrent := testTorrent(data, pieceLength)
+	info := &torrent.Metainfo.Info
+	info.Name = "root"
+	info.MultiFile = true
+	info.Files = nil
+	for index, length := range lengths {
+		info.Files = append(info.Files, File{
+			Length: length,
+			Path:   []string{"dir", string(rune('a' + index))},
+		})
+	}
+	return torrent
+}
+
+func writeAllPieces(t *testing.T, storage Storage, info *Info, data []byte) {
+	for index := range info.Pieces {
+		begin := index * info.PieceLength
+		if _, err := storage.WriteAt(data[begin:begin+info.PieceSize(index)], index, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileStorageSplitsPiecesAcrossFiles(t *testing.T) {
+	data := testData(100)
+	torrent := testMultiFileTorrent(data, 32, 10, 0, 50, 40)
+	info := &torrent.Metainfo.Info
+	root := t.TempDir()
+
+	storage, err := NewFileStorage(info, root, AllocateSparse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAllPieces(t, storage, info, data)
+
+	block := make([]byte, 20)
+	if _, err := storage.ReadAt(block, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, data[36:56]) {
+		t.Errorf("read bad result - want %v, got %v", data[36:56], block)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := 0
+	for _, file := range info.Files {
+		contents, err := os.ReadFile(filepath.Join(root, "dir", file.Path[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, data[begin:begin+file.Length]) {
+			t.Errorf("%v bad contents - want %v, got %v", file.Path, data[begin:begin+file.Length], contents)
+		}
+		begin += file.Length
+	}
+}
+
+func TestBlobStorageKeepsSingleFile(t *testing.T) {
+	data := testData(100)
+	torrent := testMultiFileTorrent(data, 32, 10, 50, 40)
+	info := &torrent.Metainfo.Info
+	path := filepath.Join(t.TempDir(), "blob")
+
+	storage, err := NewBlobStorage(info, path, AllocateFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAllPieces(t, storage, info, data)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Errorf("blob bad contents - want %v, got %v", data, contents)
+	}
+}
+
+func TestStorageRejectsOutOfBounds(t *testing.T) {
+	data := testData(100)
+	torrent := testTorrent(data, 32)
+	info := &torrent.Metainfo.Info
+	blob, err := NewBlobStorage(info, filepath.Join(t.TempDir(), "blob"), AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	for name, storage := range map[string]Storage{"memory": NewMemoryStorage(info), "blob": blob} {
+		for _, tc := range []struct {
+			piece  int
+			offset int
+			length int
+		}{
+			{piece: -1, offset: 0, length: 1},
+			{piece: 4, offset: 0, length: 1},
+			{piece: 3, offset: 0, length: 5},
+			{piece: 0, offset: 30, length: 3},
+			{piece: 0, offset: -1, length: 1},
+		} {
+			buffer := make([]byte, tc.length)
+			if _, err := storage.WriteAt(buffer, tc.piece, tc.offset); !errors.Is(err, ErrOutOfBounds) {
+				t.Errorf("%v write %v expected ErrOutOfBounds - got: %v", name, tc, err)
+			}
+			if _, err := storage.ReadAt(buffer, tc.piece, tc.offset); !errors.Is(err, ErrOutOfBounds) {
+				t.Errorf("%v read %v expected ErrOutOfBounds - got: %v", name, tc, err)
+			}
+		}
+	}
+}
+
+func TestFileStorageCompletion(t *testing.T) {
+	data := testData(100)
+	torrent := testMultiFileTorrent(data, 32, 60, 40)
+	info := &torrent.Metainfo.Info
+	root := t.TempDir()
+
+	storage, err := NewFileStorage(info, root, AllocateSparse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.Completion(); ok {
+		t.Error("fresh storage should not report a completion")
+	}
+	writeAllPieces(t, storage, info, data)
+	storage.MarkComplete(0)
+	storage.MarkComplete(2)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStorage(info, root, AllocateSparse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	completion, ok := reopened.Completion()
+	if !ok {
+		t.Fatal("expected completion from resume data")
+	}
+	if !completion.Has(0) || completion.Has(1) || !completion.Has(2) || completion.Has(3) {
+		t.Errorf("completion bad result - want pieces 0 and 2, got %08b", completion)
+	}
+}
+
+func TestFileStorageSkippedFiles(t *testing.T) {
+	data := testData(100)
+	torrent := testMultiFileTorrent(data, 32, 10, 50, 40)
+	info := &torrent.Metainfo.Info
+	root := t.TempDir()
+
+	storage, err := NewFileStorage(info, root, AllocateSparse, []FilePriority{PriorityNormal, PrioritySkip, PriorityNormal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAllPieces(t, storage, info, data)
+	for index := range info.Pieces {
+		piece := make([]byte, info.PieceSize(index))
+		if _, err := storage.ReadAt(piece, index, 0); err != nil {
+			t.Fatal(err)
+		}
+		begin := index * info.PieceLength
+		if !bytes.Equal(piece, data[begin:begin+len(piece)]) {
+			t.Errorf("piece %d bad result - want %v, got %v", index, data[begin:begin+len(piece)], piece)
+		}
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "dir", "b")); !os.IsNotExist(err) {
+		t.Errorf("skipped file should not be created - got %v", err)
+	}
+	if _, err := os.Stat(PartsPath(root)); err != nil {
+		t.Errorf("expected parts file for boundary pieces - got %v", err)
+	}
+	contents, err := os.ReadFile(filepath.Join(root, "dir", "c"))
+	if err != nil || !bytes.Equal(contents, data[60:]) {
+		t.Errorf("wanted file bad contents - want %v, got %v (%v)", data[60:], contents, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSeek = errors.New("invalid seek position")
+
+// StreamServer serves the files of a torrent over HTTP while it downloads,
+// reads wait for the pieces they need and move them to the front of the
+// picker.
+type StreamServer struct {
+	session  *Session
+	info     *Info
+	mapping  *FileMapping
+	listener net.Listener
+	server   *http.Server
+}
+
+// FileReader reads one file of a torrent as it is being downloaded.
+type FileReader struct {
+	ctx     context.Context
+	session *Session
+	info    *Info
+	start   int64
+	length  int64
+	offset  int64
+}
+
+func NewStreamServer(session *Session) *StreamServer {
+	info := &session.torrent.Metainfo.Info
+	server := &StreamServer{
+		session: session,
+		info:    info,
+		mapping: NewFileMapping(info),
+	}
+	server.server = &http.Server{Handler: server}
+	return server
+}
+
+func (server *StreamServer) NewReader(ctx context.Context, file int) *FileReader {
+	return &FileReader{
+		ctx:     ctx,
+		session: server.session,
+		info:    server.info,
+		start:   server.mapping.FileOffset(file),
+		length:  server.mapping.FileLength(file),
+	}
+}
+
+func (server *StreamServer) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server.listener = listener
+	return nil
+}
+
+func (server *StreamServer) Address() string {
+	return server.listener.Addr().String()
+}
+
+func (server *StreamServer) Serve() error {
+	err := server.server.Serve(server.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (server *StreamServer) Close() error {
+	return server.server.Close()
+}
+
+// ServeHTTP lists the files at the root and serves each file at its index,
+// http.ServeContent takes care of range requests.
+func (server *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		for index, file := range server.info.Files {
+			name := filepath.Join(file.Path...)
+			fmt.Fprintf(w, "<a href=\"/%d/%v\">%v</a> (%d)<br>\n", index, html.EscapeString(name), html.EscapeString(name), file.Length)
+		}
+		return
+	}
+	indexValue, _, _ := strings.Cut(path, "/")
+	index, err := strconv.Atoi(indexValue)
+	if err != nil || index < 0 || index >= len(server.info.Files) {
+		http.NotFound(w, r)
+		return
+	}
+	file := server.info.Files[index]
+	name := file.Path[len(file.Path)-1]
+	http.ServeContent(w, r, name, time.Time{}, server.NewReader(r.Context(), index))
+}
+
+func (reader *FileReader) Read(data []byte) (int, error) {
+	if reader.offset >= reader.length {
+		return 0, io.EOF
+	}
+	position := reader.start + reader.offset
+	pieceLength := int64(reader.info.PieceLength)
+	piece := int(position / pieceLength)
+	begin := position % pieceLength
+	length := int64(reader.info.PieceSize(piece)) - begin
+	if remaining := reader.length - reader.offset; length > remaining {
+		length = remaining
+	}
+	if length > int64(len(data)) {
+		length = int64(len(data))
+	}
+	if err := reader.session.WaitPiece(reader.ctx, piece); err != nil {
+		return 0, err
+	}
+	n, err := reader.session.ReadAt(data[:length], piece, int(begin))
+	reader.offset += int64(n)
+	return n, err
+}
+
+func (reader *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.length
+	default:
+		return 0, ErrInvalidSeek
+	}
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+	reader.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFileReaderWaitsForPieces(t *testing.T) {
+	data := testData(4 * BlockSize)
+	torrent := testMultiFileTorrent(data, BlockSize, BlockSize+10, 3*BlockSize-10)
+	session := NewSession(torrent, NewSequentialPicker(4))
+	defer session.Close()
+	peer := testPeer(session, 0, 1, 2, 3)
+
+	reader := NewStreamServer(session).NewReader(context.Background(), 1)
+	if _, err := reader.Seek(2*BlockSize-10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(reader)
+		results <- result{data: data, err: err}
+	}()
+	for waiting := false; !waiting; {
+		session.mutex.Lock()
+		_, waiting = session.waiters[3]
+		session.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	var requests []PiecePayload
+	for {
+		session.mutex.Lock()
+		request, ok := session.nextRequest(peer)
+		session.mutex.Unlock()
+		if !ok {
+			break
+		}
+		peer.requests[request] = struct{}{}
+		requests = append(requests, request)
+	}
+	if len(requests) == 0 || requests[0].Index != 3 {
+		t.Fatalf("expected the awaited piece to be requested first - got %v", requests)
+	}
+	for _, request := range requests {
+		deliver(session, peer, data, request)
+	}
+
+	select {
+	case read := <-results:
+		if read.err != nil || !bytes.Equal(read.data, data[3*BlockSize:]) {
+			t.Errorf("streamed data bad result (%v)", read.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader did not finish once the piece was verified")
+	}
+}
+
+func TestFileReaderCancel(t *testing.T) {
+	session := NewSession(testTorrent(testData(100), 32), nil)
+	defer session.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader := NewStreamServer(session).NewReader(ctx, 0)
+	if _, err := reader.Read(make([]byte, 10)); err != context.Canceled {
+		t.Errorf("expected context.Canceled - got %v", err)
+	}
+}
+
+func TestStreamServerRangeRequest(t *testing.T) {
+	data := testData(3*BlockSize + 50)
+	torrent := testMultiFileTorrent(data, BlockSize, 100, 3*BlockSize-50)
+	session := NewSession(torrent, nil)
+	defer session.Close()
+	storage := NewMemoryStorage(&torrent.Metainfo.Info)
+	writeAllPieces(t, storage, &torrent.Metainfo.Info, data)
+	if err := session.Attach(storage, true); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewStreamServer(session))
+	defer server.Close()
+
+	request, err := http.NewRequest("GET", server.URL+"/1/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Range", "bytes=16000-17000")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		t.Errorf("status bad result - want %d, got %d", http.StatusPartialContent, response.StatusCode)
+	}
+	if want := data[100+16000 : 100+17001]; !bytes.Equal(body, want) {
+		t.Errorf("range body bad result - want %d bytes, got %d", len(want), len(body))
+	}
+
+	response, err = http.Get(server.URL + "/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("status bad result - want %d, got %d", http.StatusNotFound, response.StatusCode)
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 )
 
+var (
+	ErrInvalidTrackerResponse = errors.New("invalid tracker response")
+	ErrNoTrackers             = errors.New("no trackers")
+	ErrNoPeers                = errors.New("no peers")
+)
+
 type TorrentClient struct {
 	bencode    *Bencode
 	httpClient *http.Client
@@ -32,6 +37,20 @@ type Peer struct {
 	Port uint16
 }
 
+type AnnounceRequest struct {
+	PeerId     string
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+}
+
+type AnnounceResponse struct {
+	Interval int
+	Peers    []Peer
+}
+
 type Handshake struct {
 	PeerId string
 	Err    error
@@ -41,46 +60,29 @@ type PieceRequest struct {
 	Address string
 	Piece   int
 	Torrent *Torrent
-	Output  string
 }
 
 type DownloadRequest struct {
-	Address string
-	Torrent *Torrent
-	Output  string
-}
-
-type PeerMessage struct {
-	Id      int32
-	Payload interface{}
-}
-
-type PiecePayload struct {
-	Index  uint32
-	Begin  uint32
-	Length uint32
-}
-
-type PieceBlockPayload struct {
-	Index int32
-	Begin int32
-	Block []byte
+	Addresses []string
+	Torrent   *Torrent
+	Storage   Storage
+	Picker    PiecePicker
+	// Priorities selects the files to download, nil downloads all of them.
+	Priorities []FilePriority
+	// Discovery adds the peers found on the local network when not nil.
+	Discovery *LocalDiscovery
+	// DHT adds the peers found through the DHT when not nil.
+	DHT *DHT
+	// Listener accepts peers for the torrent while it downloads when not
+	// nil, its port is announced on the DHT.
+	Listener *Listener
+	// UTP is tried before TCP when connecting to peers when not nil.
+	UTP *UTPSocket
+	// Encryption sets whether peers are connected to with message stream
+	// encryption.
+	Encryption EncryptionPolicy
 }
 
-type MessageType int32
-
-const (
-	Choke MessageType = iota
-	Unchoke
-	Interested
-	NotInterested
-	Have
-	Bitfield
-	Request
-	Piece
-	Cancel
-)
-
 const HandshakeMessageLen = 68
 const BlockSize = 16 * 1024
 
@@ -98,42 +100,109 @@ func (tc *TorrentClient) ConnectToPeer(address string) error {
 }
 
 func (tc *TorrentClient) Peers(torrent *Torrent, peerId string) ([]Peer, error) {
-	url, err := trackerUrl(torrent, peerId)
+	response, err := tc.Announce(torrent, &AnnounceRequest{
+		PeerId: peerId,
+		Port:   DefaultPort,
+		Left:   int64(torrent.Metainfo.Info.Length),
+	})
 	if err != nil {
 		return make([]Peer, 0), err
 	}
+	return response.Peers, nil
+}
+
+// MagnetPeers asks the trackers of a magnet link for peers, the first tracker
+// that answers wins.
+func (tc *TorrentClient) MagnetPeers(magnet *Magnet, peerId string) ([]Peer, error) {
+	err := ErrNoTrackers
+	for _, tracker := range magnet.Trackers {
+		torrent := magnet.Torrent()
+		torrent.Metainfo.Announce = tracker
+		var response *AnnounceResponse
+		// The length is unknown until the metadata arrives, anything above zero
+		// keeps the tracker from taking us for a seeder.
+		response, err = tc.Announce(torrent, &AnnounceRequest{
+			PeerId: peerId,
+			Port:   DefaultPort,
+			Left:   1,
+		})
+		if err == nil {
+			return response.Peers, nil
+		}
+	}
+	return nil, err
+}
+
+// MagnetTorrent fetches the metadata of a magnet link from the first peer
+// able to provide it.
+func (tc *TorrentClient) MagnetTorrent(magnet *Magnet, addresses []string, peerId string) (*Torrent, error) {
+	err := ErrNoPeers
+	for _, address := range addresses {
+		var metadata []byte
+		metadata, err = FetchMetadata(address, magnet.InfoHash, peerId)
+		if err != nil {
+			log.Println(address, err)
+			continue
+		}
+		torrent := NewTorrentParser(tc.bencode).ParseMetadata(metadata, magnet.Torrent().Metainfo.Announce)
+		if torrent.Err != nil {
+			return nil, torrent.Err
+		}
+		return torrent, nil
+	}
+	return nil, err
+}
+
+func (tc *TorrentClient) Announce(torrent *Torrent, request *AnnounceRequest) (*AnnounceResponse, error) {
+	url, err := trackerUrl(torrent, request)
+	if err != nil {
+		return nil, err
+	}
 	body, err := tc.trackerDoGet(url)
 	if err != nil {
-		return make([]Peer, 0), err
+		return nil, err
 	}
 	decode := tc.bencode.Decode(string(body))
 	if decode.err != nil {
-		return make([]Peer, 0), err
+		return nil, decode.err
+	}
+	tracker, ok := decode.value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidTrackerResponse
 	}
-	tracker := decode.value.(map[string]interface{})
-	peers := []byte(tracker["peers"].(string))
-	response := make([]Peer, 0)
-	for i := 0; i < len(peers); i = i + 6 {
+	if reason, ok := tracker["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker failure: %v", reason)
+	}
+	interval, _ := tracker["interval"].(int)
+	peers, _ := tracker["peers"].(string)
+	response := &AnnounceResponse{
+		Interval: interval,
+		Peers:    make([]Peer, 0),
+	}
+	for i := 0; i+6 <= len(peers); i = i + 6 {
 		ip := fmt.Sprintf("%d.%d.%d.%d", peers[i], peers[i+1], peers[i+2], peers[i+3])
-		port := binary.BigEndian.Uint16(peers[i+4 : i+6])
-		response = append(response, Peer{IP: ip, Port: port})
+		port := binary.BigEndian.Uint16([]byte(peers[i+4 : i+6]))
+		response.Peers = append(response.Peers, Peer{IP: ip, Port: port})
 	}
 	return response, nil
 }
 
-func trackerUrl(torrent *Torrent, peerId string) (*url.URL, error) {
+func trackerUrl(torrent *Torrent, request *AnnounceRequest) (*url.URL, error) {
 	baseUrl, err := url.Parse(torrent.Metainfo.Announce)
 	if err != nil {
 		return nil, err
 	}
 	params := url.Values{}
 	params.Add("info_hash", string(torrent.Metainfo.Info.Hash))
-	params.Add("peer_id", peerId)
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", strconv.Itoa(torrent.Metainfo.Info.Length))
+	params.Add("peer_id", request.PeerId)
+	params.Add("port", strconv.Itoa(request.Port))
+	params.Add("uploaded", strconv.FormatInt(request.Uploaded, 10))
+	params.Add("downloaded", strconv.FormatInt(request.Downloaded, 10))
+	params.Add("left", strconv.FormatInt(request.Left, 10))
 	params.Add("compact", "1")
+	if request.Event != "" {
+		params.Add("event", request.Event)
+	}
 	baseUrl.RawQuery = params.Encode()
 	return baseUrl, nil
 }
@@ -159,7 +228,8 @@ func (tc *TorrentClient) Handshake(torrent *Torrent, address string) *Handshake
 	var handshake []byte
 	handshake = append(handshake, byte(19))
 	handshake = append(handshake, []byte("BitTorrent protocol")...)
-	handshake = append(handshake, make([]byte, 8)...)
+	reserved := reservedBytes()
+	handshake = append(handshake, reserved[:]...)
 	handshake = append(handshake, torrent.Metainfo.Info.Hash...)
 	handshake = append(handshake, []byte("00112233445566778899")...)
 	if tc.connection == nil {
@@ -187,13 +257,13 @@ func (tc *TorrentClient) DownloadPiece(request *PieceRequest) ([]byte, error) {
 	tc.ConnectToPeer(request.Address)
 	defer tc.connection.Close()
 	tc.Handshake(request.Torrent, request.Address)
-	tc.waitForMessage(Bitfield, tc.connection)
+	tc.waitForMessage(tc.connection, Bitfield, HaveAll, HaveNone)
 	message := PeerMessage{
 		Id:      int32(Interested),
 		Payload: struct{}{},
 	}
 	tc.sendMessage(message, tc.connection)
-	tc.waitForMessage(Unchoke, tc.connection)
+	tc.waitForMessage(tc.connection, Unchoke)
 	if !request.Torrent.ContainsPiece(request.Piece) {
 		return nil, errors.New("info.pieces does not contain piece")
 	}
@@ -214,26 +284,57 @@ func (tc *TorrentClient) DownloadPiece(request *PieceRequest) ([]byte, error) {
 		}
 		data = append(data, buffer...)
 	}
-	os.WriteFile(request.Output, data, os.ModePerm)
 	return data, nil
 }
 
-func (tc *TorrentClient) Download(request *DownloadRequest) error {
-	var data []byte
-	for piece := range request.Torrent.Metainfo.Info.Pieces {
-		piece, err := tc.DownloadPiece(&PieceRequest{
-			Address: request.Address,
-			Piece:   piece,
-			Torrent: request.Torrent,
-			Output:  request.Output,
-		})
-		if err != nil {
-			return err
+// Download runs a session for the request until the download is complete and
+// reports how the disk kept up.
+func (tc *TorrentClient) Download(request *DownloadRequest) (DiskStats, error) {
+	session := NewSession(request.Torrent, request.Picker)
+	if request.Priorities != nil {
+		if err := session.SetFilePriorities(request.Priorities); err != nil {
+			session.Close()
+			return DiskStats{}, err
 		}
-		data = append(data, piece...)
 	}
-	os.WriteFile(request.Output, data, os.ModePerm)
-	return nil
+	if err := session.Attach(request.Storage, false); err != nil {
+		session.Close()
+		return DiskStats{}, err
+	}
+	session.SetEncryption(request.Encryption)
+	session.AddWebSeeds(request.Torrent.Metainfo.URLList...)
+	if request.UTP != nil {
+		session.Peers().SetUTP(request.UTP)
+	}
+	if request.Discovery != nil {
+		request.Discovery.Register(session)
+		defer request.Discovery.Unregister(session)
+	}
+	port := 0
+	if request.Listener != nil {
+		request.Listener.Register(session)
+		defer request.Listener.Unregister(session)
+		port = request.Listener.Port()
+	}
+	if request.DHT != nil {
+		// The first lookup runs before dialing, a trackerless torrent has no
+		// other peers to start from.
+		var infoHash NodeId
+		copy(infoHash[:], request.Torrent.Metainfo.Info.Hash)
+		if err := request.DHT.LookupPeers(infoHash, port, session.Peers()); err != nil {
+			log.Println(err)
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go request.DHT.FeedPeers(infoHash, port, session.Peers(), stop)
+	}
+	err := session.Download(request.Addresses)
+	stats := session.DiskStats()
+	if err != nil {
+		session.Close()
+		return stats, err
+	}
+	return stats, session.Close()
 }
 
 func (tc *TorrentClient) pieceBlock(piece int, blockNumber int, blockLength int, connection net.Conn) ([]byte, error) {
@@ -266,78 +367,42 @@ func (tc *TorrentClient) sendMessage(message PeerMessage, connection net.Conn) e
 }
 
 func (tc *TorrentClient) ReadPieceBlock(connection net.Conn) ([]byte, error) {
-	buffer := make([]byte, 4)
-	if _, err := connection.Read(buffer); err != nil {
-		return nil, err
-	}
-	lengthPrefix := binary.BigEndian.Uint32(buffer)
-	payloadBuffer := make([]byte, lengthPrefix)
-	_, err := io.ReadFull(connection, payloadBuffer)
-	if err != nil {
-		return nil, err
-	}
-	message, err := deserialize(payloadBuffer)
-	if err != nil {
-		return nil, err
-	}
-	if payload, ok := message.Payload.(PieceBlockPayload); ok {
-		return payload.Block, nil
+	for {
+		message, err := readMessage(connection)
+		if err != nil {
+			return nil, err
+		}
+		if payload, ok := message.Payload.(PieceBlockPayload); ok {
+			return payload.Block, nil
+		}
+		if message.Id == int32(Choke) {
+			return nil, errors.New("expected PieceBlockPayload")
+		}
+		if message.Id == int32(RejectRequest) {
+			return nil, ErrRequestRejected
+		}
 	}
-	return nil, errors.New("expected PieceBlockPayload")
 }
 
-func (tc *TorrentClient) waitForMessage(messageType MessageType, connection net.Conn) error {
-	buffer := make([]byte, 4)
-	if _, err := connection.Read(buffer); err != nil {
-		return err
-	}
-	lengthPrefix := binary.BigEndian.Uint32(buffer)
-	payloadBuf := make([]byte, lengthPrefix)
-	if _, err := connection.Read(payloadBuf); err != nil {
-		return err
-	}
-	message, err := deserialize(payloadBuf)
-	if err != nil {
-		return err
-	}
-	if message.Id != int32(messageType) {
-		return err
+// waitForMessage reads until one of the message types arrives. A rejected
+// request means the awaited message will never come.
+func (tc *TorrentClient) waitForMessage(connection net.Conn, messageTypes ...MessageType) error {
+	for {
+		message, err := readMessage(connection)
+		if err != nil {
+			return err
+		}
+		for _, messageType := range messageTypes {
+			if message.Id == int32(messageType) {
+				return nil
+			}
+		}
+		if message.Id == int32(RejectRequest) {
+			return ErrRequestRejected
+		}
 	}
-	return nil
 }
 
 func (request *PieceRequest) pieceLength() int {
-	rest := request.Torrent.Metainfo.Info.Length - (request.Torrent.Metainfo.Info.PieceLength * request.Piece)
-	if rest >= request.Torrent.Metainfo.Info.PieceLength {
-		return request.Torrent.Metainfo.Info.PieceLength
-	}
-	return rest
-}
-
-func serialize(message PeerMessage) ([]byte, error) {
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, message.Payload)
-	data := buf.Bytes()
-	buffer := make([]byte, uint32(len(data))+5)
-	binary.BigEndian.PutUint32(buffer[:4], uint32(len(data)+1))
-	buffer[4] = byte(message.Id)
-	copy(buffer[5:], data)
-	return buffer, nil
-}
-
-func deserialize(buffer []byte) (PeerMessage, error) {
-	id := int32(buffer[0])
-	var payload interface{}
-	switch id {
-	case int32(Piece):
-		payload = PieceBlockPayload{
-			Index: 0,
-			Begin: 0,
-			Block: buffer[9:],
-		}
-	}
-	return PeerMessage{
-		Id:      id,
-		Payload: payload,
-	}, nil
+	return request.Torrent.Metainfo.Info.PieceSize(request.Piece)
 }
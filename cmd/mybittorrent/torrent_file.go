@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -21,13 +26,40 @@ type Info struct {
 	Length      int
 	Name        string
 	PieceLength int
-	Hash        []byte
-	Pieces      [][]byte
+	// Hash is the info hash the torrent is known by to peers and trackers,
+	// for pure v2 torrents the v2 hash truncated to 20 bytes.
+	Hash []byte
+	// HashV2 is the SHA-256 info hash of v2 and hybrid torrents.
+	HashV2      []byte
+	MetaVersion int
+	// Hybrid torrents carry both the v1 piece hashes and the v2 file tree.
+	Hybrid bool
+	// Pieces are SHA-1 hashes for v1 and hybrid torrents and the SHA-256
+	// piece layer hashes for pure v2 torrents, nil while not known.
+	Pieces    [][]byte
+	Files     []File
+	MultiFile bool
+	// Metadata is the bencoded info dictionary the hash is taken from.
+	Metadata []byte
+}
+
+type File struct {
+	Length int
+	Path   []string
+	// PiecesRoot is the merkle root of a v2 file, nil for empty files.
+	PiecesRoot []byte
+	// Padding files only align the next file to a piece boundary.
+	Padding bool
 }
 
 type Metainfo struct {
 	Announce string
 	Info     Info
+	// PieceLayers maps the pieces root of v2 files larger than a piece to
+	// the concatenated hashes of their pieces.
+	PieceLayers map[string][]byte
+	// URLList holds the web seeds serving the torrent's files over HTTP.
+	URLList []string
 }
 
 type Torrent struct {
@@ -54,13 +86,17 @@ func (torrentFile *TorrentParser) Parse(filename string) *Torrent {
 			Err:      ErrInvalidTorrentFile,
 		}
 	}
-	bencode := torrentFile.bencode
-	decode := bencode.Decode(string(fileContents))
+	return torrentFile.ParseBytes(fileContents)
+}
+
+// ParseBytes parses the contents of a .torrent file.
+func (torrentFile *TorrentParser) ParseBytes(contents []byte) *Torrent {
+	decode := torrentFile.bencode.Decode(string(contents))
 	if decode.err != nil {
 		log.Println(decode.err)
 		return &Torrent{
 			Metainfo: nil,
-			Err:      err,
+			Err:      decode.err,
 		}
 	}
 	metainfo, ok := decode.value.(map[string]interface{})
@@ -79,32 +115,174 @@ func (torrentFile *TorrentParser) Parse(filename string) *Torrent {
 			Err:      ErrInvalidMetainfo,
 		}
 	}
-	length, ok := info["length"].(int)
+	announce, _ := metainfo["announce"].(string)
+	torrent := torrentFile.torrent(info, announce)
+	if torrent.Err != nil {
+		return torrent
+	}
+	torrent.Metainfo.URLList = urlList(metainfo["url-list"])
+	if torrent.Metainfo.Info.MetaVersion == 2 {
+		layers, err := pieceLayers(&torrent.Metainfo.Info, metainfo["piece layers"])
+		if err != nil {
+			fmt.Println("piece layers are invalid")
+			return &Torrent{
+				Metainfo: nil,
+				Err:      err,
+			}
+		}
+		torrent.Metainfo.PieceLayers = layers
+	}
+	return torrent
+}
+
+// urlList reads the url-list key, which holds either one url or a list of
+// them. Anything that is not an http url is skipped.
+func urlList(value interface{}) []string {
+	var values []interface{}
+	switch value := value.(type) {
+	case string:
+		values = []interface{}{value}
+	case []interface{}:
+		values = value
+	}
+	var urls []string
+	for _, value := range values {
+		address, ok := value.(string)
+		if ok && (strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://")) {
+			urls = append(urls, address)
+		}
+	}
+	return urls
+}
+
+// ParseMetadata builds a torrent from a bare info dictionary, as fetched from
+// peers when starting from a magnet link.
+func (torrentFile *TorrentParser) ParseMetadata(metadata []byte, announce string) *Torrent {
+	decode := torrentFile.bencode.Decode(string(metadata))
+	if decode.err != nil {
+		return &Torrent{
+			Metainfo: nil,
+			Err:      decode.err,
+		}
+	}
+	info, ok := decode.value.(map[string]interface{})
+	if !ok || decode.end != len(metadata) {
+		return &Torrent{
+			Metainfo: nil,
+			Err:      ErrInvalidMetainfo,
+		}
+	}
+	return torrentFile.torrent(info, announce)
+}
+
+func (torrentFile *TorrentParser) torrent(info map[string]interface{}, announce string) *Torrent {
+	name, ok := info["name"].(string)
 	if !ok {
-		fmt.Println("info.length is invalid")
+		fmt.Println("info.name is invalid")
 		return &Torrent{
 			Metainfo: nil,
 			Err:      ErrInvalidMetainfo,
 		}
 	}
 	pieceLength, ok := info["piece length"].(int)
-	if !ok {
+	if !ok || pieceLength <= 0 {
 		fmt.Println("piece length is invalid")
 		return &Torrent{
 			Metainfo: nil,
 			Err:      ErrInvalidMetainfo,
 		}
 	}
-	hash := torrentFile.hash(bencode.encode(info))
+	metaVersion, ok := info["meta version"].(int)
+	if !ok {
+		metaVersion = 1
+	}
+	if metaVersion != 1 && metaVersion != 2 {
+		fmt.Println("meta version is not supported")
+		return &Torrent{
+			Metainfo: nil,
+			Err:      ErrInvalidMetainfo,
+		}
+	}
+	var tree []File
+	if metaVersion == 2 {
+		var err error
+		tree, err = torrentFile.fileTree(info, pieceLength)
+		if err != nil {
+			fmt.Println("info.file tree is invalid")
+			return &Torrent{
+				Metainfo: nil,
+				Err:      err,
+			}
+		}
+	}
+	_, hybrid := info["pieces"]
+	hybrid = hybrid && metaVersion == 2
+	var files []File
+	var multiFile bool
+	if metaVersion == 2 && !hybrid {
+		files, multiFile = alignFiles(tree, name, pieceLength)
+	} else {
+		var err error
+		files, multiFile, err = torrentFile.files(info, name)
+		if err != nil {
+			fmt.Println("info.length is invalid")
+			return &Torrent{
+				Metainfo: nil,
+				Err:      err,
+			}
+		}
+		if hybrid && !matchFileTree(files, tree) {
+			fmt.Println("info.files do not match info.file tree")
+			return &Torrent{
+				Metainfo: nil,
+				Err:      ErrInvalidMetainfo,
+			}
+		}
+	}
+	length := 0
+	for _, file := range files {
+		length += file.Length
+	}
+	var pieces [][]byte
+	if metaVersion == 2 && !hybrid {
+		pieces = v2Pieces(files, pieceLength)
+	} else {
+		var err error
+		pieces, err = torrentFile.pieces(info)
+		if err != nil || len(pieces) != (length+pieceLength-1)/pieceLength {
+			fmt.Println("info.pieces is invalid")
+			return &Torrent{
+				Metainfo: nil,
+				Err:      ErrInvalidMetainfo,
+			}
+		}
+	}
+	bencode := torrentFile.bencode
+	encoded := bencode.encode(info)
+	hash := torrentFile.hash(encoded)
+	var hashV2 []byte
+	if metaVersion == 2 {
+		sum := sha256.Sum256([]byte(encoded.value))
+		hashV2 = sum[:]
+		if !hybrid {
+			hash = hashV2[:sha1.Size]
+		}
+	}
 	return &Torrent{
 		Metainfo: &Metainfo{
-			Announce: metainfo["announce"].(string),
+			Announce: announce,
 			Info: Info{
 				Length:      length,
-				Name:        info["name"].(string),
+				Name:        name,
 				PieceLength: pieceLength,
 				Hash:        hash,
-				Pieces:      torrentFile.pieces(info),
+				HashV2:      hashV2,
+				MetaVersion: metaVersion,
+				Hybrid:      hybrid,
+				Pieces:      pieces,
+				Files:       files,
+				MultiFile:   multiFile,
+				Metadata:    []byte(encoded.value),
 			},
 		},
 		Err: nil,
@@ -117,12 +295,284 @@ func (torrentFile *TorrentParser) hash(encode BencodeEncoded) []byte {
 	return hasher.Sum(nil)
 }
 
-func (torrentFile *TorrentParser) pieces(info map[string]interface{}) [][]byte {
+func (torrentFile *TorrentParser) files(info map[string]interface{}, name string) ([]File, bool, error) {
+	if length, ok := info["length"].(int); ok {
+		if length < 0 {
+			return nil, false, ErrInvalidMetainfo
+		}
+		return []File{{Length: length, Path: []string{name}}}, false, nil
+	}
+	list, ok := info["files"].([]interface{})
+	if !ok {
+		return nil, false, ErrInvalidMetainfo
+	}
+	files := make([]File, 0, len(list))
+	for _, value := range list {
+		dict, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false, ErrInvalidMetainfo
+		}
+		length, ok := dict["length"].(int)
+		if !ok || length < 0 {
+			return nil, false, ErrInvalidMetainfo
+		}
+		elements, ok := dict["path"].([]interface{})
+		if !ok || len(elements) == 0 {
+			return nil, false, ErrInvalidMetainfo
+		}
+		path := make([]string, 0, len(elements))
+		for _, element := range elements {
+			part, ok := element.(string)
+			if !ok || part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+				return nil, false, ErrInvalidMetainfo
+			}
+			path = append(path, part)
+		}
+		attr, _ := dict["attr"].(string)
+		files = append(files, File{Length: length, Path: path, Padding: strings.Contains(attr, "p")})
+	}
+	return files, true, nil
+}
+
+// fileTree flattens the v2 file tree into its files, walking directories in
+// key order as the bencoded dictionaries store them.
+func (torrentFile *TorrentParser) fileTree(info map[string]interface{}, pieceLength int) ([]File, error) {
+	if pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, ErrInvalidMetainfo
+	}
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidMetainfo
+	}
+	files, err := walkFileTree(tree, nil, nil)
+	if err != nil || len(files) == 0 {
+		return nil, ErrInvalidMetainfo
+	}
+	return files, nil
+}
+
+func walkFileTree(tree map[string]interface{}, path []string, files []File) ([]File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidMetainfo
+		}
+		if name != "" {
+			if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+				return nil, ErrInvalidMetainfo
+			}
+			var err error
+			if files, err = walkFileTree(node, append(append([]string{}, path...), name), files); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		length, ok := node["length"].(int)
+		if len(path) == 0 || !ok || length < 0 {
+			return nil, ErrInvalidMetainfo
+		}
+		file := File{Length: length, Path: path}
+		if length > 0 {
+			root, ok := node["pieces root"].(string)
+			if !ok || len(root) != sha256.Size {
+				return nil, ErrInvalidMetainfo
+			}
+			file.PiecesRoot = []byte(root)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// alignFiles lays out the files of a pure v2 torrent in one piece space. Every
+// file starts a new piece, so padding is inserted after those that do not end
+// on a piece boundary.
+func alignFiles(tree []File, name string, pieceLength int) ([]File, bool) {
+	if len(tree) == 1 && len(tree[0].Path) == 1 && tree[0].Path[0] == name {
+		return tree, false
+	}
+	files := make([]File, 0, 2*len(tree))
+	for index, file := range tree {
+		files = append(files, file)
+		if rest := file.Length % pieceLength; rest > 0 && index < len(tree)-1 {
+			pad := pieceLength - rest
+			files = append(files, File{Length: pad, Path: []string{".pad", strconv.Itoa(pad)}, Padding: true})
+		}
+	}
+	return files, true
+}
+
+// matchFileTree checks the v1 files of a hybrid torrent describe the same
+// files as its v2 file tree, and copies over their pieces roots.
+func matchFileTree(files []File, tree []File) bool {
+	index := 0
+	for position := range files {
+		file := &files[position]
+		if file.Padding {
+			continue
+		}
+		if index == len(tree) || file.Length != tree[index].Length ||
+			strings.Join(file.Path, "/") != strings.Join(tree[index].Path, "/") {
+			return false
+		}
+		file.PiecesRoot = tree[index].PiecesRoot
+		index++
+	}
+	return index == len(tree)
+}
+
+// v2Pieces returns the piece hashes of a pure v2 torrent known from the info
+// dictionary alone. A file fitting in one piece is hashed by its pieces root,
+// the hashes of larger files come from the piece layers.
+func v2Pieces(files []File, pieceLength int) [][]byte {
+	var pieces [][]byte
+	for _, file := range files {
+		if file.Padding {
+			continue
+		}
+		count := (file.Length + pieceLength - 1) / pieceLength
+		if count == 1 {
+			pieces = append(pieces, file.PiecesRoot)
+			continue
+		}
+		pieces = append(pieces, make([][]byte, count)...)
+	}
+	return pieces
+}
+
+// pieceLayers reads the piece layers of a v2 torrent, each checked against
+// the pieces root of its file. Pure v2 torrents take the hashes of their
+// pieces from them.
+func pieceLayers(info *Info, value interface{}) (map[string][]byte, error) {
+	dict, _ := value.(map[string]interface{})
+	layers := make(map[string][]byte)
+	piece := 0
+	for _, file := range info.Files {
+		if file.Padding {
+			continue
+		}
+		count := (file.Length + info.PieceLength - 1) / info.PieceLength
+		layer, ok := dict[string(file.PiecesRoot)].(string)
+		if count > 1 && ok {
+			hashes := splitHashes([]byte(layer))
+			if len(layer) != count*sha256.Size || !bytes.Equal(merkleRoot(hashes, 0, zeroRoot(info.PieceLength/BlockSize)), file.PiecesRoot) {
+				return nil, ErrInvalidMetainfo
+			}
+			layers[string(file.PiecesRoot)] = []byte(layer)
+			if !info.Hybrid {
+				copy(info.Pieces[piece:], hashes)
+			}
+		}
+		piece += count
+	}
+	return layers, nil
+}
+
+func (torrentFile *TorrentParser) pieces(info map[string]interface{}) ([][]byte, error) {
 	response := make([][]byte, 0)
-	pieces := info["pieces"].(string)
+	pieces, ok := info["pieces"].(string)
+	if !ok || len(pieces)%20 != 0 {
+		return nil, ErrInvalidMetainfo
+	}
 	for len(pieces) > 0 {
 		response = append(response, []byte(pieces[:20]))
 		pieces = pieces[20:]
 	}
-	return response
+	return response, nil
+}
+
+// Version names the kind of torrent, v1, v2 or hybrid.
+func (info *Info) Version() string {
+	switch {
+	case info.Hybrid:
+		return "hybrid"
+	case info.MetaVersion == 2:
+		return "v2"
+	default:
+		return "v1"
+	}
+}
+
+// VerifyPiece checks piece data against its hash. Pieces of pure v2 torrents
+// are the merkle subtree of their blocks' SHA-256 hashes, leaving out the
+// padding after the end of a file.
+func (info *Info) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= len(info.Pieces) || len(info.Pieces[index]) == 0 {
+		return false
+	}
+	if info.MetaVersion != 2 || info.Hybrid {
+		hash := sha1.Sum(data)
+		return bytes.Equal(hash[:], info.Pieces[index])
+	}
+	file, length := info.pieceFile(index)
+	if file < 0 || len(data) < length {
+		return false
+	}
+	var leaves [][]byte
+	for begin := 0; begin < length; begin += BlockSize {
+		end := begin + BlockSize
+		if end > length {
+			end = length
+		}
+		hash := sha256.Sum256(data[begin:end])
+		leaves = append(leaves, hash[:])
+	}
+	width := info.PieceLength / BlockSize
+	if info.Files[file].Length <= info.PieceLength {
+		// A file within one piece is hashed by its pieces root, whose
+		// tree only spans the blocks the file has.
+		width = 0
+	}
+	return bytes.Equal(merkleRoot(leaves, width, make([]byte, sha256.Size)), info.Pieces[index])
+}
+
+// pieceFile returns the file a piece of a pure v2 torrent belongs to and how
+// many bytes of the piece are file data rather than padding.
+func (info *Info) pieceFile(index int) (int, int) {
+	piece := 0
+	for position, file := range info.Files {
+		if file.Padding {
+			continue
+		}
+		count := (file.Length + info.PieceLength - 1) / info.PieceLength
+		if index < piece+count {
+			length := file.Length - (index-piece)*info.PieceLength
+			if length > info.PieceLength {
+				length = info.PieceLength
+			}
+			return position, length
+		}
+		piece += count
+	}
+	return -1, 0
+}
+
+// filePieces returns the first piece of the pure v2 file with the given
+// pieces root and how many pieces it has.
+func (info *Info) filePieces(root []byte) (int, int, bool) {
+	piece := 0
+	for _, file := range info.Files {
+		if file.Padding {
+			continue
+		}
+		count := (file.Length + info.PieceLength - 1) / info.PieceLength
+		if file.PiecesRoot != nil && bytes.Equal(file.PiecesRoot, root) {
+			return piece, count, true
+		}
+		piece += count
+	}
+	return 0, 0, false
+}
+
+func (info *Info) PieceSize(index int) int {
+	rest := info.Length - (info.PieceLength * index)
+	if rest >= info.PieceLength {
+		return info.PieceLength
+	}
+	return rest
 }
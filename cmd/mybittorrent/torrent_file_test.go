@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -68,3 +76,319 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMultiFile(t *testing.T) {
+	bencode := NewBencode()
+	encoded := bencode.encode(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "album",
+			"piece length": 16,
+			"pieces":       "0123456789012345678901234567890123456789",
+			"files": []interface{}{
+				map[string]interface{}{"length": 20, "path": []interface{}{"cd1", "track1.flac"}},
+				map[string]interface{}{"length": 0, "path": []interface{}{"empty"}},
+				map[string]interface{}{"length": 7, "path": []interface{}{"cover.jpg"}},
+			},
+		},
+	})
+	path := filepath.Join(t.TempDir(), "album.torrent")
+	if err := os.WriteFile(path, []byte(encoded.value), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := NewTorrentParser(bencode).Parse(path)
+	if parsed.Err != nil {
+		t.Fatal(parsed.Err)
+	}
+	info := parsed.Metainfo.Info
+
+	if !info.MultiFile {
+		t.Error("expected a multi file torrent")
+	}
+	if info.Length != 27 {
+		t.Errorf("length bad result - want %d, got %d", 27, info.Length)
+	}
+	if len(info.Files) != 3 || strings.Join(info.Files[0].Path, "/") != "cd1/track1.flac" {
+		t.Errorf("files bad result - got %v", info.Files)
+	}
+}
+
+func TestParseRejectsUnsafeFilePaths(t *testing.T) {
+	bencode := NewBencode()
+	encoded := bencode.encode(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "album",
+			"piece length": 16,
+			"pieces":       "01234567890123456789",
+			"files": []interface{}{
+				map[string]interface{}{"length": 10, "path": []interface{}{"..", "passwd"}},
+			},
+		},
+	})
+	path := filepath.Join(t.TempDir(), "unsafe.torrent")
+	if err := os.WriteFile(path, []byte(encoded.value), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := NewTorrentParser(bencode).Parse(path)
+	if !errors.Is(parsed.Err, ErrInvalidMetainfo) {
+		t.Errorf("expected ErrInvalidMetainfo - got: %v", parsed.Err)
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	parser := NewTorrentParser(NewBencode())
+	parsed := parser.Parse("../../sample.torrent")
+	if parsed.Err != nil {
+		t.Fatal(parsed.Err)
+	}
+	info := parsed.Metainfo.Info
+
+	fromMetadata := parser.ParseMetadata(info.Metadata, parsed.Metainfo.Announce)
+	if fromMetadata.Err != nil {
+		t.Fatal(fromMetadata.Err)
+	}
+	if hex.EncodeToString(fromMetadata.Metainfo.Info.Hash) != hex.EncodeToString(info.Hash) {
+		t.Errorf("hash bad result - want %x, got %x", info.Hash, fromMetadata.Metainfo.Info.Hash)
+	}
+	if fromMetadata.Metainfo.Info.Length != info.Length || len(fromMetadata.Metainfo.Info.Pieces) != len(info.Pieces) {
+		t.Errorf("info bad result - want %v, got %v", info, fromMetadata.Metainfo.Info)
+	}
+
+	for _, metadata := range []string{
+		"",
+		"le",
+		"d4:name1:a12:piece lengthi16e6:lengthi10e6:pieces3:abce",
+		"d4:name1:a12:piece lengthi16e6:lengthi40e6:pieces20:aaaaaaaaaaaaaaaaaaaae",
+		"d4:name1:a12:piece lengthi16e6:lengthi10e6:pieces20:aaaaaaaaaaaaaaaaaaaaeextra",
+	} {
+		if parsed := parser.ParseMetadata([]byte(metadata), ""); parsed.Err == nil {
+			t.Errorf("%q expected error", metadata)
+		}
+	}
+}
+
+type testV2File struct {
+	path []string
+	data []byte
+}
+
+// testV2Tree returns the pieces root of data and, for data spanning more than
+// one piece, its piece layer.
+func testV2Tree(data []byte, pieceLength int) ([]byte, []byte) {
+	var leaves [][]byte
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha256.Sum256(data[begin:end])
+		leaves = append(leaves, hash[:])
+	}
+	perPiece := pieceLength / BlockSize
+	if len(leaves) <= perPiece {
+		return merkleRoot(leaves, 0, zeroRoot(1)), nil
+	}
+	var hashes [][]byte
+	var layer []byte
+	for begin := 0; begin < len(leaves); begin += perPiece {
+		end := begin + perPiece
+		if end > len(leaves) {
+			end = len(leaves)
+		}
+		hash := merkleRoot(leaves[begin:end], perPiece, zeroRoot(1))
+		hashes = append(hashes, hash)
+		layer = append(layer, hash...)
+	}
+	return merkleRoot(hashes, 0, zeroRoot(perPiece)), layer
+}
+
+// testV2Metainfo builds the metainfo of a v2 torrent, with the v1 keys and
+// padding files as well when hybrid.
+func testV2Metainfo(name string, pieceLength int, hybrid bool, files ...testV2File) map[string]interface{} {
+	tree := make(map[string]interface{})
+	layers := make(map[string]interface{})
+	var v1Files []interface{}
+	var data []byte
+	for index, file := range files {
+		root, layer := testV2Tree(file.data, pieceLength)
+		node := tree
+		for _, part := range file.path {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+		node[""] = map[string]interface{}{"length": len(file.data), "pieces root": string(root)}
+		if layer != nil {
+			layers[string(root)] = string(layer)
+		}
+		path := make([]interface{}, len(file.path))
+		for i, part := range file.path {
+			path[i] = part
+		}
+		v1Files = append(v1Files, map[string]interface{}{"length": len(file.data), "path": path})
+		data = append(data, file.data...)
+		if rest := len(file.data) % pieceLength; rest > 0 && index < len(files)-1 {
+			pad := pieceLength - rest
+			v1Files = append(v1Files, map[string]interface{}{
+				"length": pad,
+				"path":   []interface{}{".pad", strconv.Itoa(pad)},
+				"attr":   "p",
+			})
+			data = append(data, make([]byte, pad)...)
+		}
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+	if hybrid {
+		var pieces []byte
+		for begin := 0; begin < len(data); begin += pieceLength {
+			end := begin + pieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			hash := sha1.Sum(data[begin:end])
+			pieces = append(pieces, hash[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = v1Files
+	}
+	return map[string]interface{}{
+		"announce":     "http://tracker.example/announce",
+		"info":         info,
+		"piece layers": layers,
+	}
+}
+
+func testV2Files() []testV2File {
+	return []testV2File{
+		{[]string{"a"}, testData(2*BlockSize + 100)},
+		{[]string{"dir", "b"}, testData(10)},
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := [][]byte{
+		bytes.Repeat([]byte{1}, 32),
+		bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32),
+	}
+	zero := make([]byte, 32)
+	pair := func(left, right []byte) []byte {
+		hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+		return hash[:]
+	}
+	want := pair(pair(leaves[0], leaves[1]), pair(leaves[2], zero))
+	if root := merkleRoot(leaves, 0, zero); !bytes.Equal(root, want) {
+		t.Errorf("root bad result - want %x, got %x", want, root)
+	}
+	want = pair(pair(leaves[0], zero), pair(zero, zero))
+	if root := merkleRoot(leaves[:1], 4, zero); !bytes.Equal(root, want) {
+		t.Errorf("padded root bad result - want %x, got %x", want, root)
+	}
+	if root := zeroRoot(4); !bytes.Equal(root, pair(pair(zero, zero), pair(zero, zero))) {
+		t.Errorf("zero root bad result - got %x", root)
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	bencode := NewBencode()
+	pieceLength := 2 * BlockSize
+	metainfo := testV2Metainfo("v2", pieceLength, false, testV2Files()...)
+	encoded := bencode.encode(metainfo)
+	parsed := NewTorrentParser(bencode).ParseBytes([]byte(encoded.value))
+	if parsed.Err != nil {
+		t.Fatal(parsed.Err)
+	}
+	info := parsed.Metainfo.Info
+
+	if info.Version() != "v2" || info.MetaVersion != 2 {
+		t.Errorf("version bad result - want v2, got %v", info.Version())
+	}
+	hashV2 := sha256.Sum256([]byte(bencode.encode(metainfo["info"]).value))
+	if !bytes.Equal(info.HashV2, hashV2[:]) || !bytes.Equal(info.Hash, hashV2[:20]) {
+		t.Errorf("hashes bad result - want %x, got %x and %x", hashV2, info.HashV2, info.Hash)
+	}
+	var paths []string
+	for _, file := range info.Files {
+		paths = append(paths, strings.Join(file.Path, "/"))
+	}
+	if want := []string{"a", ".pad/32668", "dir/b"}; !reflect.DeepEqual(paths, want) || !info.Files[1].Padding {
+		t.Errorf("files bad result - want %v, got %v", want, paths)
+	}
+	if info.Length != 2*pieceLength+10 || len(info.Pieces) != 3 {
+		t.Errorf("layout bad result - want %d bytes in 3 pieces, got %d in %d", 2*pieceLength+10, info.Length, len(info.Pieces))
+	}
+	rootA, layerA := testV2Tree(testV2Files()[0].data, pieceLength)
+	rootB, _ := testV2Tree(testV2Files()[1].data, pieceLength)
+	if !bytes.Equal(info.Files[0].PiecesRoot, rootA) || !bytes.Equal(info.Files[2].PiecesRoot, rootB) {
+		t.Error("pieces roots do not match the files")
+	}
+	if !bytes.Equal(bytes.Join(info.Pieces[:2], nil), layerA) || !bytes.Equal(info.Pieces[2], rootB) {
+		t.Errorf("piece hashes bad result - got %x", info.Pieces)
+	}
+	if !bytes.Equal(parsed.Metainfo.PieceLayers[string(rootA)], layerA) {
+		t.Error("piece layer of a should be kept")
+	}
+}
+
+func TestParseHybrid(t *testing.T) {
+	bencode := NewBencode()
+	metainfo := testV2Metainfo("hybrid", 2*BlockSize, true, testV2Files()...)
+	parsed := NewTorrentParser(bencode).ParseBytes([]byte(bencode.encode(metainfo).value))
+	if parsed.Err != nil {
+		t.Fatal(parsed.Err)
+	}
+	info := parsed.Metainfo.Info
+
+	encoded := []byte(bencode.encode(metainfo["info"]).value)
+	hashV1 := sha1.Sum(encoded)
+	hashV2 := sha256.Sum256(encoded)
+	if info.Version() != "hybrid" || !bytes.Equal(info.Hash, hashV1[:]) || !bytes.Equal(info.HashV2, hashV2[:]) {
+		t.Errorf("hybrid bad result - got %v with %x and %x", info.Version(), info.Hash, info.HashV2)
+	}
+	if len(info.Files) != 3 || !info.Files[1].Padding || info.Files[0].PiecesRoot == nil || len(info.Pieces[0]) != sha1.Size {
+		t.Errorf("files bad result - got %+v", info.Files)
+	}
+}
+
+func TestParseV2Invalid(t *testing.T) {
+	for name, change := range map[string]func(metainfo map[string]interface{}){
+		"piece length": func(metainfo map[string]interface{}) {
+			metainfo["info"].(map[string]interface{})["piece length"] = 3 * BlockSize
+		},
+		"meta version": func(metainfo map[string]interface{}) {
+			metainfo["info"].(map[string]interface{})["meta version"] = 3
+		},
+		"piece layer": func(metainfo map[string]interface{}) {
+			for root, layer := range metainfo["piece layers"].(map[string]interface{}) {
+				metainfo["piece layers"].(map[string]interface{})[root] = strings.Repeat("x", len(layer.(string)))
+			}
+		},
+		"pieces root": func(metainfo map[string]interface{}) {
+			tree := metainfo["info"].(map[string]interface{})["file tree"].(map[string]interface{})
+			tree["a"].(map[string]interface{})[""].(map[string]interface{})["pieces root"] = "short"
+		},
+		"hybrid files": func(metainfo map[string]interface{}) {
+			files := metainfo["info"].(map[string]interface{})["files"].([]interface{})
+			files[0].(map[string]interface{})["length"] = 5
+		},
+	} {
+		metainfo := testV2Metainfo("bad", 2*BlockSize, true, testV2Files()...)
+		change(metainfo)
+		bencode := NewBencode()
+		parsed := NewTorrentParser(bencode).ParseBytes([]byte(bencode.encode(metainfo).value))
+		if !errors.Is(parsed.Err, ErrInvalidMetainfo) {
+			t.Errorf("%v expected ErrInvalidMetainfo - got: %v", name, parsed.Err)
+		}
+	}
+}
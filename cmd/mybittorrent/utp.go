@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUTPTimeout = errors.New("utp connection timed out")
+	ErrUTPReset   = errors.New("utp connection reset")
+)
+
+const UTPDialTimeout = 2 * time.Second
+const MaxUTPPacket = 64 * 1024
+const utpAcceptBacklog = 32
+const utpTickInterval = 50 * time.Millisecond
+
+// UTPSocket multiplexes uTP connections over one UDP socket. It accepts
+// incoming connections like a net.Listener and dials outgoing ones.
+type UTPSocket struct {
+	conn      net.PacketConn
+	start     time.Time
+	mutex     sync.Mutex
+	conns     map[utpKey]*UTPConn
+	accept    chan *UTPConn
+	random    *rand.Rand
+	owned     bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// utpKey identifies a connection by the remote address and the id packets
+// from the remote carry.
+type utpKey struct {
+	address string
+	id      uint16
+}
+
+func ListenUTP(address string) (*UTPSocket, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewUTPSocket(conn), nil
+}
+
+func NewUTPSocket(conn net.PacketConn) *UTPSocket {
+	socket := &UTPSocket{
+		conn:   conn,
+		start:  time.Now(),
+		conns:  make(map[utpKey]*UTPConn),
+		accept: make(chan *UTPConn, utpAcceptBacklog),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		closed: make(chan struct{}),
+	}
+	go socket.read()
+	go socket.tick()
+	return socket
+}
+
+// DialUTP connects over a socket of its own, which is closed with the
+// connection.
+func DialUTP(address string, timeout time.Duration) (*UTPConn, error) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	socket := NewUTPSocket(conn)
+	socket.owned = true
+	utp, err := socket.Dial(address, timeout)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return utp, nil
+}
+
+func (socket *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.accept:
+		return conn, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (socket *UTPSocket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+func (socket *UTPSocket) Close() error {
+	var err error
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		socket.mutex.Lock()
+		conns := make([]*UTPConn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mutex.Unlock()
+		for _, conn := range conns {
+			conn.mutex.Lock()
+			conn.fail(net.ErrClosed)
+			conn.mutex.Unlock()
+		}
+		err = socket.conn.Close()
+	})
+	return err
+}
+
+func (socket *UTPSocket) Dial(address string, timeout time.Duration) (*UTPConn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn := newUTPConn(socket, remote)
+	socket.mutex.Lock()
+	for {
+		conn.recvId = uint16(socket.random.Intn(1 << 16))
+		if _, ok := socket.conns[utpKey{remote.String(), conn.recvId}]; !ok {
+			break
+		}
+	}
+	conn.sendId = conn.recvId + 1
+	socket.conns[utpKey{remote.String(), conn.recvId}] = conn
+	socket.mutex.Unlock()
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.state = utpSynSent
+	conn.seq = 1
+	conn.sendPacket(utpSyn, nil)
+	deadline := time.Now().Add(timeout)
+	for conn.state == utpSynSent {
+		if !conn.wait(deadline) {
+			conn.fail(ErrUTPTimeout)
+		}
+	}
+	if conn.err != nil {
+		return nil, conn.err
+	}
+	return conn, nil
+}
+
+func (socket *UTPSocket) timestamp() uint32 {
+	return uint32(time.Since(socket.start).Microseconds())
+}
+
+func (socket *UTPSocket) send(packet *utpPacket, remote net.Addr) {
+	packet.timestamp = socket.timestamp()
+	socket.conn.WriteTo(packet.encode(), remote)
+}
+
+func (socket *UTPSocket) remove(conn *UTPConn) {
+	socket.mutex.Lock()
+	key := utpKey{conn.remote.String(), conn.recvId}
+	if socket.conns[key] == conn {
+		delete(socket.conns, key)
+	}
+	empty := len(socket.conns) == 0
+	socket.mutex.Unlock()
+	if socket.owned && empty {
+		go socket.Close()
+	}
+}
+
+func (socket *UTPSocket) read() {
+	buffer := make([]byte, MaxUTPPacket)
+	for {
+		n, remote, err := socket.conn.ReadFrom(buffer)
+		if err != nil {
+			socket.Close()
+			return
+		}
+		packet, err := parseUTPPacket(append([]byte{}, buffer[:n]...))
+		if err != nil {
+			continue
+		}
+		id := packet.connection
+		if packet.kind == utpSyn {
+			id++
+		}
+		socket.mutex.Lock()
+		conn, ok := socket.conns[utpKey{remote.String(), id}]
+		if !ok && packet.kind == utpSyn {
+			conn = socket.incoming(packet, remote)
+		}
+		if !ok && packet.kind == utpReset {
+			// A reset carries the id the rejected packet was sent with.
+			for key, other := range socket.conns {
+				if key.address == remote.String() && other.sendId == packet.connection {
+					conn = other
+				}
+			}
+		}
+		socket.mutex.Unlock()
+		if conn != nil {
+			conn.receive(packet)
+		} else if packet.kind != utpReset {
+			socket.send(&utpPacket{kind: utpReset, connection: packet.connection, ack: packet.seq}, remote)
+		}
+	}
+}
+
+// incoming sets up the connection for a SYN, it is refused once the accept
+// backlog is full.
+func (socket *UTPSocket) incoming(syn *utpPacket, remote net.Addr) *UTPConn {
+	if len(socket.accept) == cap(socket.accept) {
+		return nil
+	}
+	conn := newUTPConn(socket, remote)
+	conn.recvId = syn.connection + 1
+	conn.sendId = syn.connection
+	conn.seq = uint16(socket.random.Intn(1 << 16))
+	conn.ack = syn.seq
+	conn.state = utpConnected
+	socket.conns[utpKey{remote.String(), conn.recvId}] = conn
+	socket.accept <- conn
+	return conn
+}
+
+func (socket *UTPSocket) tick() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-socket.closed:
+			return
+		}
+		socket.mutex.Lock()
+		conns := make([]*UTPConn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mutex.Unlock()
+		now := time.Now()
+		for _, conn := range conns {
+			conn.tick(now)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const UTPPacketSize = 1400
+const UTPReceiveWindow = 1024 * 1024
+const UTPTargetDelay = 100 * time.Millisecond
+const utpMaxPayload = UTPPacketSize - utpHeaderSize
+const utpMinWindow = 2 * UTPPacketSize
+const utpInitialWindow = 8 * UTPPacketSize
+const utpMaxWindowIncrease = 3000
+const utpMinTimeout = 500 * time.Millisecond
+const utpInitialTimeout = time.Second
+const utpMaxTimeouts = 5
+const utpDuplicateAcks = 3
+const utpReorderLimit = 1024
+const utpLinger = 5 * time.Second
+
+type utpConnState int
+
+const (
+	utpSynSent utpConnState = iota
+	utpConnected
+	utpClosed
+)
+
+type utpOutgoing struct {
+	packet        *utpPacket
+	sentAt        time.Time
+	transmissions int
+}
+
+// utpDelays keeps the lowest one way delay seen in the last two minutes, the
+// base the LEDBAT queuing delay is measured against.
+type utpDelays struct {
+	current  uint32
+	previous uint32
+	since    time.Time
+}
+
+// UTPConn is a uTP connection. Sending is paced by LEDBAT so it yields to
+// other traffic, lost packets are detected from duplicate or selective acks
+// and from timeouts.
+type UTPConn struct {
+	socket  *UTPSocket
+	remote  net.Addr
+	recvId  uint16
+	sendId  uint16
+	mutex   sync.Mutex
+	changed chan struct{}
+	state   utpConnState
+	err     error
+	closing bool
+	closeAt time.Time
+
+	seq           uint16
+	ack           uint16
+	inflight      []*utpOutgoing
+	outstanding   int
+	maxWindow     int
+	peerWindow    int
+	rtt           time.Duration
+	rttVar        time.Duration
+	rto           time.Duration
+	timeoutAt     time.Time
+	timeouts      int
+	lastAck       uint16
+	duplicateAcks int
+	lastLoss      time.Time
+	delays        utpDelays
+	replyDelay    uint32
+
+	readBuffer    []byte
+	reorder       map[uint16][]byte
+	finReceived   bool
+	finSeq        uint16
+	eof           bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUTPConn(socket *UTPSocket, remote net.Addr) *UTPConn {
+	return &UTPConn{
+		socket:     socket,
+		remote:     remote,
+		changed:    make(chan struct{}),
+		maxWindow:  utpInitialWindow,
+		peerWindow: UTPReceiveWindow,
+		rto:        utpInitialTimeout,
+		reorder:    make(map[uint16][]byte),
+	}
+}
+
+// notify wakes everyone waiting for the connection state to change.
+func (conn *UTPConn) notify() {
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+// wait releases the lock until the state changes, it returns false once the
+// deadline passed.
+func (conn *UTPConn) wait(deadline time.Time) bool {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return false
+	}
+	changed := conn.changed
+	conn.mutex.Unlock()
+	defer conn.mutex.Lock()
+	if deadline.IsZero() {
+		<-changed
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (conn *UTPConn) fail(err error) {
+	if conn.state == utpClosed {
+		return
+	}
+	conn.state = utpClosed
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.notify()
+	conn.socket.remove(conn)
+}
+
+func (conn *UTPConn) Read(data []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	for len(conn.readBuffer) == 0 {
+		if conn.eof {
+			return 0, io.EOF
+		}
+		if conn.closing {
+			return 0, net.ErrClosed
+		}
+		if conn.err != nil {
+			return 0, conn.err
+		}
+		if !conn.wait(conn.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	closedWindow := conn.window() < UTPPacketSize
+	n := copy(data, conn.readBuffer)
+	conn.readBuffer = conn.readBuffer[n:]
+	if len(conn.readBuffer) == 0 {
+		conn.readBuffer = nil
+	}
+	if closedWindow && conn.window() >= UTPPacketSize {
+		conn.sendState()
+	}
+	return n, nil
+}
+
+// Write queues the data as packets while the send window has room, so it
+// blocks while the peer or the network cannot take more.
+func (conn *UTPConn) Write(data []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	written := 0
+	for len(data) > 0 {
+		if conn.closing {
+			return written, net.ErrClosed
+		}
+		if conn.err != nil {
+			return written, conn.err
+		}
+		length := len(data)
+		if length > utpMaxPayload {
+			length = utpMaxPayload
+		}
+		window := conn.maxWindow
+		if conn.peerWindow < window {
+			window = conn.peerWindow
+		}
+		if conn.outstanding > 0 && conn.outstanding+length > window {
+			if !conn.wait(conn.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		conn.sendPacket(utpData, append([]byte{}, data[:length]...))
+		data = data[length:]
+		written += length
+	}
+	return written, nil
+}
+
+// Close sends a FIN after the queued data and lingers until it is
+// acknowledged, reads and writes fail from now on.
+func (conn *UTPConn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closing || conn.state == utpClosed {
+		return nil
+	}
+	conn.closing = true
+	conn.closeAt = time.Now().Add(utpLinger)
+	conn.sendPacket(utpFin, nil)
+	conn.notify()
+	return nil
+}
+
+func (conn *UTPConn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *UTPConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *UTPConn) SetDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = deadline
+	conn.writeDeadline = deadline
+	conn.notify()
+	return nil
+}
+
+func (conn *UTPConn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = deadline
+	conn.notify()
+	return nil
+}
+
+func (conn *UTPConn) SetWriteDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writeDeadline = deadline
+	conn.notify()
+	return nil
+}
+
+// window is the receive window advertised to the peer.
+func (conn *UTPConn) window() int {
+	window := UTPReceiveWindow - len(conn.readBuffer)
+	for _, payload := range conn.reorder {
+		window -= len(payload)
+	}
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+func (conn *UTPConn) header(kind byte) *utpPacket {
+	connection := conn.sendId
+	if kind == utpSyn {
+		connection = conn.recvId
+	}
+	return &utpPacket{
+		kind:       kind,
+		connection: connection,
+		difference: conn.replyDelay,
+		window:     uint32(conn.window()),
+		seq:        conn.seq,
+		ack:        conn.ack,
+	}
+}
+
+// sendPacket sends a packet that takes a sequence number and keeps it until
+// it is acknowledged.
+func (conn *UTPConn) sendPacket(kind byte, payload []byte) {
+	packet := conn.header(kind)
+	packet.payload = payload
+	conn.seq++
+	now := time.Now()
+	conn.inflight = append(conn.inflight, &utpOutgoing{packet: packet, sentAt: now, transmissions: 1})
+	conn.outstanding += len(payload)
+	if conn.timeoutAt.IsZero() {
+		conn.timeoutAt = now.Add(conn.rto)
+	}
+	conn.socket.send(packet, conn.remote)
+}
+
+// sendState acknowledges what we received, packets received out of order are
+// reported in a selective ack.
+func (conn *UTPConn) sendState() {
+	packet := conn.header(utpState)
+	if len(conn.reorder) > 0 {
+		selective := make([]byte, 4)
+		for seq := range conn.reorder {
+			bit := int(seq - conn.ack - 2)
+			for bit >= len(selective)*8 && len(selective) < 32 {
+				selective = append(selective, 0, 0, 0, 0)
+			}
+			if bit < len(selective)*8 {
+				selective[bit/8] |= 1 << (bit % 8)
+			}
+		}
+		packet.selective = selective
+	}
+	conn.socket.send(packet, conn.remote)
+}
+
+func (conn *UTPConn) resend(outgoing *utpOutgoing, now time.Time) {
+	packet := outgoing.packet
+	packet.ack = conn.ack
+	packet.difference = conn.replyDelay
+	packet.window = uint32(conn.window())
+	outgoing.sentAt = now
+	outgoing.transmissions++
+	conn.socket.send(packet, conn.remote)
+}
+
+func (conn *UTPConn) receive(packet *utpPacket) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.state == utpClosed {
+		return
+	}
+	now := time.Now()
+	conn.replyDelay = conn.socket.timestamp() - packet.timestamp
+	if packet.kind == utpReset {
+		if conn.closing {
+			conn.fail(net.ErrClosed)
+		} else {
+			conn.fail(ErrUTPReset)
+		}
+		return
+	}
+	if packet.kind == utpSyn {
+		conn.sendState()
+		return
+	}
+	conn.peerWindow = int(packet.window)
+	if conn.state == utpSynSent {
+		if packet.kind != utpState || packet.ack != conn.seq-1 {
+			return
+		}
+		conn.state = utpConnected
+		conn.ack = packet.seq - 1
+	}
+	conn.acknowledged(packet, now)
+	if packet.kind == utpData || packet.kind == utpFin {
+		conn.received(packet)
+		conn.sendState()
+	}
+	if conn.closing && len(conn.inflight) == 0 && conn.eof {
+		conn.fail(net.ErrClosed)
+	}
+	conn.notify()
+}
+
+// acknowledged drops the packets the peer acknowledged and updates the round
+// trip time and the congestion window.
+func (conn *UTPConn) acknowledged(packet *utpPacket, now time.Time) {
+	acked := 0
+	remaining := conn.inflight[:0]
+	for _, outgoing := range conn.inflight {
+		seq := outgoing.packet.seq
+		bit := int(seq - packet.ack - 2)
+		selected := seqLess(packet.ack+1, seq) && bit < len(packet.selective)*8 &&
+			packet.selective[bit/8]&(1<<(bit%8)) != 0
+		if !seqLess(packet.ack, seq) || selected {
+			acked += len(outgoing.packet.payload)
+			if outgoing.transmissions == 1 {
+				conn.sample(now.Sub(outgoing.sentAt))
+			}
+			continue
+		}
+		remaining = append(remaining, outgoing)
+	}
+	conn.inflight = remaining
+	conn.outstanding -= acked
+
+	lost := false
+	if len(conn.inflight) > 0 && acked == 0 && packet.ack == conn.lastAck && packet.kind == utpState {
+		conn.duplicateAcks++
+		lost = conn.duplicateAcks == utpDuplicateAcks
+	} else if packet.ack != conn.lastAck {
+		conn.duplicateAcks = 0
+	}
+	conn.lastAck = packet.ack
+	if len(conn.inflight) > 0 && conn.inflight[0].packet.seq == packet.ack+1 && selectedCount(packet.selective) >= utpDuplicateAcks {
+		lost = true
+	}
+	if lost && now.Sub(conn.inflight[0].sentAt) >= conn.rtt {
+		conn.lose(now)
+		conn.resend(conn.inflight[0], now)
+	}
+
+	if acked > 0 || len(conn.inflight) == 0 {
+		conn.timeouts = 0
+		conn.timeoutAt = time.Time{}
+		if len(conn.inflight) > 0 {
+			conn.timeoutAt = now.Add(conn.rto)
+		}
+	}
+	if acked > 0 && packet.difference != 0 {
+		conn.ledbat(acked, packet.difference, now)
+	}
+}
+
+func selectedCount(selective []byte) int {
+	count := 0
+	for _, value := range selective {
+		for ; value != 0; value &= value - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+func (conn *UTPConn) sample(rtt time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = rtt
+		conn.rttVar = rtt / 2
+	} else {
+		delta := conn.rtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		conn.rttVar += (delta - conn.rttVar) / 4
+		conn.rtt += (rtt - conn.rtt) / 8
+	}
+	conn.rto = conn.rtt + 4*conn.rttVar
+	if conn.rto < utpMinTimeout {
+		conn.rto = utpMinTimeout
+	}
+}
+
+// ledbat grows the window while the queuing delay stays below UTPTargetDelay
+// and shrinks it above, scaled by how much of the window was acknowledged.
+func (conn *UTPConn) ledbat(acked int, delay uint32, now time.Time) {
+	base := conn.delays.add(delay, now)
+	queuing := float64(int32(delay-base)) * float64(time.Microsecond)
+	offTarget := (float64(UTPTargetDelay) - queuing) / float64(UTPTargetDelay)
+	windowFactor := float64(acked) / float64(conn.maxWindow)
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	conn.maxWindow += int(utpMaxWindowIncrease * offTarget * windowFactor)
+	if conn.maxWindow < utpMinWindow {
+		conn.maxWindow = utpMinWindow
+	}
+}
+
+func (delays *utpDelays) add(delay uint32, now time.Time) uint32 {
+	if delays.since.IsZero() || now.Sub(delays.since) >= time.Minute {
+		delays.previous = delays.current
+		if delays.since.IsZero() {
+			delays.previous = delay
+		}
+		delays.current = delay
+		delays.since = now
+	} else if int32(delay-delays.current) < 0 {
+		delays.current = delay
+	}
+	if int32(delays.previous-delays.current) < 0 {
+		return delays.previous
+	}
+	return delays.current
+}
+
+// lose halves the window at most once a round trip.
+func (conn *UTPConn) lose(now time.Time) {
+	if now.Sub(conn.lastLoss) < conn.rtt {
+		return
+	}
+	conn.lastLoss = now
+	conn.maxWindow /= 2
+	if conn.maxWindow < utpMinWindow {
+		conn.maxWindow = utpMinWindow
+	}
+}
+
+// received delivers data in order, packets that arrive early wait in the
+// reorder buffer for the ones before them.
+func (conn *UTPConn) received(packet *utpPacket) {
+	if packet.kind == utpFin && !conn.finReceived {
+		conn.finReceived = true
+		conn.finSeq = packet.seq
+	}
+	distance := packet.seq - conn.ack - 1
+	if distance >= 0x8000 {
+		return
+	}
+	if distance > 0 {
+		if distance < utpReorderLimit {
+			conn.reorder[packet.seq] = packet.payload
+		}
+		return
+	}
+	conn.deliver(packet.seq, packet.payload)
+	for {
+		payload, ok := conn.reorder[conn.ack+1]
+		if !ok {
+			break
+		}
+		delete(conn.reorder, conn.ack+1)
+		conn.deliver(conn.ack+1, payload)
+	}
+}
+
+func (conn *UTPConn) deliver(seq uint16, payload []byte) {
+	conn.ack = seq
+	if conn.finReceived && seq == conn.finSeq {
+		conn.eof = true
+		return
+	}
+	if !conn.eof {
+		conn.readBuffer = append(conn.readBuffer, payload...)
+	}
+}
+
+// tick resends the oldest packet once the retransmission timeout passes,
+// the window collapses and the timeout backs off until the connection is
+// given up.
+func (conn *UTPConn) tick(now time.Time) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.state == utpClosed {
+		return
+	}
+	if conn.closing && now.After(conn.closeAt) {
+		conn.fail(net.ErrClosed)
+		return
+	}
+	if conn.timeoutAt.IsZero() || now.Before(conn.timeoutAt) || len(conn.inflight) == 0 {
+		return
+	}
+	conn.timeouts++
+	if conn.timeouts > utpMaxTimeouts {
+		conn.fail(ErrUTPTimeout)
+		return
+	}
+	conn.maxWindow = utpMinWindow
+	conn.rto *= 2
+	conn.resend(conn.inflight[0], now)
+	conn.timeoutAt = now.Add(conn.rto)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidUTPPacket = errors.New("invalid utp packet")
+
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const utpVersion = 1
+const utpHeaderSize = 20
+const utpSelectiveAck = 1
+
+type utpPacket struct {
+	kind       byte
+	connection uint16
+	timestamp  uint32
+	difference uint32
+	window     uint32
+	seq        uint16
+	ack        uint16
+	// selective acknowledges packets past ack+1, bit i stands for ack+2+i.
+	selective []byte
+	payload   []byte
+}
+
+func (packet *utpPacket) encode() []byte {
+	buffer := make([]byte, utpHeaderSize, utpHeaderSize+len(packet.selective)+2+len(packet.payload))
+	buffer[0] = packet.kind<<4 | utpVersion
+	if len(packet.selective) > 0 {
+		buffer[1] = utpSelectiveAck
+	}
+	binary.BigEndian.PutUint16(buffer[2:], packet.connection)
+	binary.BigEndian.PutUint32(buffer[4:], packet.timestamp)
+	binary.BigEndian.PutUint32(buffer[8:], packet.difference)
+	binary.BigEndian.PutUint32(buffer[12:], packet.window)
+	binary.BigEndian.PutUint16(buffer[16:], packet.seq)
+	binary.BigEndian.PutUint16(buffer[18:], packet.ack)
+	if len(packet.selective) > 0 {
+		buffer = append(buffer, 0, byte(len(packet.selective)))
+		buffer = append(buffer, packet.selective...)
+	}
+	return append(buffer, packet.payload...)
+}
+
+// parseUTPPacket reads a packet, extensions other than selective acks are
+// skipped.
+func parseUTPPacket(data []byte) (*utpPacket, error) {
+	if len(data) < utpHeaderSize || data[0]&0x0f != utpVersion || data[0]>>4 > utpSyn {
+		return nil, ErrInvalidUTPPacket
+	}
+	packet := &utpPacket{
+		kind:       data[0] >> 4,
+		connection: binary.BigEndian.Uint16(data[2:]),
+		timestamp:  binary.BigEndian.Uint32(data[4:]),
+		difference: binary.BigEndian.Uint32(data[8:]),
+		window:     binary.BigEndian.Uint32(data[12:]),
+		seq:        binary.BigEndian.Uint16(data[16:]),
+		ack:        binary.BigEndian.Uint16(data[18:]),
+	}
+	extension := data[1]
+	data = data[utpHeaderSize:]
+	for extension != 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, ErrInvalidUTPPacket
+		}
+		length := int(data[1])
+		if extension == utpSelectiveAck {
+			if length == 0 || length%4 != 0 {
+				return nil, ErrInvalidUTPPacket
+			}
+			packet.selective = data[2 : 2+length]
+		}
+		extension = data[0]
+		data = data[2+length:]
+	}
+	packet.payload = data
+	return packet, nil
+}
+
+// seqLess compares sequence numbers allowing for wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops and reorders data packets on their way out.
+type lossyPacketConn struct {
+	net.PacketConn
+	mutex   sync.Mutex
+	count   int
+	held    []byte
+	address net.Addr
+}
+
+func (conn *lossyPacketConn) WriteTo(data []byte, address net.Addr) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if data[0]>>4 != utpData {
+		return conn.PacketConn.WriteTo(data, address)
+	}
+	conn.count++
+	if conn.count%7 == 0 {
+		return len(data), nil
+	}
+	if conn.count%5 == 0 && conn.held == nil {
+		conn.held = append([]byte{}, data...)
+		conn.address = address
+		return len(data), nil
+	}
+	n, err := conn.PacketConn.WriteTo(data, address)
+	if conn.held != nil {
+		conn.PacketConn.WriteTo(conn.held, conn.address)
+		conn.held = nil
+	}
+	return n, err
+}
+
+func testUTPSockets(t *testing.T, lossy bool) (*UTPSocket, *UTPSocket) {
+	sockets := make([]*UTPSocket, 2)
+	for index := range sockets {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lossy {
+			conn = &lossyPacketConn{PacketConn: conn}
+		}
+		sockets[index] = NewUTPSocket(conn)
+		t.Cleanup(func() { sockets[index].Close() })
+	}
+	return sockets[0], sockets[1]
+}
+
+func TestUTPPacket(t *testing.T) {
+	packet := &utpPacket{
+		kind:       utpState,
+		connection: 0x1234,
+		timestamp:  1,
+		difference: 2,
+		window:     3,
+		seq:        4,
+		ack:        5,
+		selective:  []byte{0x05, 0, 0, 0x80},
+		payload:    []byte("data"),
+	}
+	parsed, err := parseUTPPacket(packet.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.kind != packet.kind || parsed.connection != packet.connection || parsed.seq != packet.seq ||
+		parsed.ack != packet.ack || parsed.window != packet.window || !bytes.Equal(parsed.selective, packet.selective) ||
+		!bytes.Equal(parsed.payload, packet.payload) {
+		t.Errorf("packet bad result - want %+v, got %+v", packet, parsed)
+	}
+	if selectedCount(packet.selective) != 3 {
+		t.Errorf("selected count bad result - want 3, got %d", selectedCount(packet.selective))
+	}
+	for _, data := range [][]byte{
+		make([]byte, utpHeaderSize-1),
+		append([]byte{utpData<<4 | 2}, make([]byte, utpHeaderSize-1)...),
+		append(append([]byte{utpState<<4 | utpVersion, utpSelectiveAck}, make([]byte, utpHeaderSize-2)...), 0, 3, 1, 2, 3),
+	} {
+		if _, err := parseUTPPacket(data); !errors.Is(err, ErrInvalidUTPPacket) {
+			t.Errorf("%x expected ErrInvalidUTPPacket - got: %v", data, err)
+		}
+	}
+	if !seqLess(0xfff0, 0x0002) || seqLess(0x0002, 0xfff0) {
+		t.Error("sequence numbers do not wrap around")
+	}
+}
+
+func testUTPTransfer(t *testing.T, lossy bool, length int) {
+	server, client := testUTPSockets(t, lossy)
+	data := testData(length)
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		buffer, _ := io.ReadAll(conn)
+		received <- buffer
+	}()
+
+	conn, err := client.Dial(server.Addr().String(), UTPDialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case buffer := <-received:
+		if !bytes.Equal(buffer, data) {
+			t.Errorf("received data bad result - want %d bytes, got %d", len(data), len(buffer))
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("transfer did not finish")
+	}
+}
+
+func TestUTPTransfer(t *testing.T) {
+	testUTPTransfer(t, false, 1024*1024)
+}
+
+func TestUTPTransferWithLoss(t *testing.T) {
+	testUTPTransfer(t, true, 256*1024)
+}
+
+func TestUTPEcho(t *testing.T) {
+	server, client := testUTPSockets(t, false)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := client.Dial(server.Addr().String(), UTPDialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, message := range []string{"ping", "a longer message", "pong"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, len(message))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer) != message {
+			t.Errorf("echo bad result - want %q, got %q", message, buffer)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read expected deadline error - got: %v", err)
+	}
+}
+
+func TestUTPDialTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	_, client := testUTPSockets(t, false)
+	if _, err := client.Dial(silent.LocalAddr().String(), 100*time.Millisecond); !errors.Is(err, ErrUTPTimeout) {
+		t.Errorf("dial expected ErrUTPTimeout - got: %v", err)
+	}
+}
+
+func TestConnectionManagerFallsBackToTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, socket := testUTPSockets(t, false)
+	manager := NewConnectionManager(systemClock{})
+	manager.SetUTP(socket)
+	address := listener.Addr().String()
+	manager.Add(address)
+
+	conn, err := manager.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("dial bad result - want a TCP connection, got %T", conn)
+	}
+	if !manager.candidates[address].tcpOnly {
+		t.Error("peer without uTP should only be dialed over TCP afterwards")
+	}
+}
+
+func TestSessionDownloadOverUTP(t *testing.T) {
+	data := testData(5*BlockSize + 123)
+	torrent := testTorrent(data, 2*BlockSize)
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := NewSession(torrent, nil)
+	defer seeder.Close()
+	if err := seeder.Attach(openFileStorage(t, torrent, path), false); err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(0)
+	listener.Register(seeder)
+	server, client := testUTPSockets(t, false)
+	go listener.ServeUTP(server)
+
+	leecher := NewSession(torrent, nil)
+	defer leecher.Close()
+	leecher.Peers().SetUTP(client)
+	address := server.Addr().String()
+	if err := leecher.Download([]string{address}); err != nil {
+		t.Fatal(err)
+	}
+
+	if downloaded, err := leecher.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match seeded data (%v)", err)
+	}
+	if candidate, ok := leecher.Peers().candidates[address]; ok && candidate.tcpOnly {
+		t.Error("download should not have fallen back to TCP")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebSeedResponse = errors.New("unexpected web seed response")
+	ErrWebSeedHash     = errors.New("web seed piece failed hash check")
+)
+
+const WebSeedTimeout = 30 * time.Second
+const WebSeedRetryInterval = 30 * time.Second
+const WebSeedPollInterval = time.Second
+const MaxWebSeedFailures = 5
+
+// WebSeed downloads whole pieces from an HTTP mirror of the torrent's files
+// (BEP 19). It takes pieces from the session like a peer having all of them.
+type WebSeed struct {
+	url           string
+	session       *Session
+	client        *http.Client
+	mapping       *FileMapping
+	peer          *PeerConnection
+	failures      int
+	retryInterval time.Duration
+}
+
+func NewWebSeed(session *Session, address string) *WebSeed {
+	info := &session.torrent.Metainfo.Info
+	bitfield := NewPieceBitfield(len(info.Pieces))
+	for index := range info.Pieces {
+		bitfield.Set(index)
+	}
+	return &WebSeed{
+		url:     address,
+		session: session,
+		client:  &http.Client{Timeout: WebSeedTimeout},
+		mapping: NewFileMapping(info),
+		// The seed has no connection, the peer only tracks the blocks
+		// it was handed.
+		peer: &PeerConnection{
+			Address:  address,
+			Bitfield: bitfield,
+			requests: make(map[PiecePayload]struct{}),
+		},
+		retryInterval: WebSeedRetryInterval,
+	}
+}
+
+// fileURL returns where a file of the torrent is served. A single file
+// torrent's url names the file unless it ends in a slash, multi-file
+// torrents live in a directory named after the torrent.
+func (seed *WebSeed) fileURL(file int) string {
+	info := &seed.session.torrent.Metainfo.Info
+	base := seed.url
+	if !info.MultiFile {
+		if strings.HasSuffix(base, "/") {
+			base += url.PathEscape(info.Name)
+		}
+		return base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(info.Name)}
+	for _, part := range info.Files[file].Path {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// FetchPiece downloads a piece range by range from the files it spans and
+// checks it against the piece hash.
+func (seed *WebSeed) FetchPiece(index int) ([]byte, error) {
+	info := &seed.session.torrent.Metainfo.Info
+	segments, err := seed.mapping.Segments(index, 0, int64(info.PieceSize(index)))
+	if err != nil {
+		return nil, err
+	}
+	piece := make([]byte, 0, info.PieceSize(index))
+	for _, segment := range segments {
+		// Padding files only hold zeros and are not served by mirrors.
+		if info.Files[segment.File].Padding {
+			piece = append(piece, make([]byte, segment.Length)...)
+			continue
+		}
+		data, err := seed.fetch(seed.fileURL(segment.File), segment.Offset, segment.Length)
+		if err != nil {
+			return nil, err
+		}
+		piece = append(piece, data...)
+	}
+	if !info.VerifyPiece(index, piece) {
+		return nil, ErrWebSeedHash
+	}
+	return piece, nil
+}
+
+func (seed *WebSeed) fetch(address string, offset, length int64) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	response, err := seed.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file.
+		if _, err := io.CopyN(io.Discard, response.Body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrWebSeedResponse, response.Status)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(response.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Run downloads pieces until the session completes or stop is closed. After a
+// failure the seed waits twice as long as the time before, and it is given up
+// after MaxWebSeedFailures failures in a row.
+func (seed *WebSeed) Run(stop <-chan struct{}) error {
+	s := seed.session
+	s.addWebSeed(seed.peer)
+	defer s.removeWebSeed(seed.peer)
+	for !s.isDone() {
+		wait := WebSeedPollInterval
+		if index, ok := s.claimPiece(seed.peer); ok {
+			piece, err := seed.FetchPiece(index)
+			if err == nil {
+				seed.failures = 0
+				s.receivePiece(seed.peer, index, piece)
+				continue
+			}
+			log.Println(seed.url, err)
+			s.abandonPieces(seed.peer)
+			seed.failures++
+			if seed.failures >= MaxWebSeedFailures {
+				return err
+			}
+			wait = seed.retryInterval << (seed.failures - 1)
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return nil
+		case <-s.done:
+			return nil
+		case <-s.closed:
+			return ErrSessionClosed
+		}
+	}
+	return nil
+}
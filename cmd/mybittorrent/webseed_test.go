@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebSeedServer serves the files of a torrent with range support, a single
+// file as /<name> and multiple files below /<name>/. Padding files are not
+// served and the first failures requests fail.
+func testWebSeedServer(t *testing.T, info *Info, data []byte, failures int) *httptest.Server {
+	files := make(map[string][]byte)
+	offset := 0
+	for _, file := range info.Files {
+		path := "/" + info.Name
+		for _, part := range file.Path {
+			if info.MultiFile {
+				path += "/" + part
+			}
+		}
+		if !file.Padding {
+			files[path] = data[offset : offset+file.Length]
+		}
+		offset += file.Length
+	}
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		fail := failures > 0
+		failures--
+		mutex.Unlock()
+		content, ok := files[request.URL.Path]
+		if fail || !ok {
+			http.Error(writer, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(writer, request, request.URL.Path, time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseURLList(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "test.bin",
+		"piece length": 16,
+		"pieces":       "01234567890123456789",
+		"length":       10,
+	}
+	for _, test := range []struct {
+		urlList interface{}
+		want    []string
+	}{
+		{"http://mirror.example/test.bin", []string{"http://mirror.example/test.bin"}},
+		{[]interface{}{"https://a.example/", "ftp://b.example/", 1, "http://c.example/"}, []string{"https://a.example/", "http://c.example/"}},
+		{nil, nil},
+	} {
+		metainfo := map[string]interface{}{"announce": "http://tracker.example/announce", "info": info}
+		if test.urlList != nil {
+			metainfo["url-list"] = test.urlList
+		}
+		bencode := NewBencode()
+		parsed := NewTorrentParser(bencode).ParseBytes([]byte(bencode.encode(metainfo).value))
+		if parsed.Err != nil {
+			t.Fatal(parsed.Err)
+		}
+		if !reflect.DeepEqual(parsed.Metainfo.URLList, test.want) {
+			t.Errorf("url list bad result - want %v, got %v", test.want, parsed.Metainfo.URLList)
+		}
+	}
+}
+
+func TestWebSeedFileURL(t *testing.T) {
+	single := NewSession(testTorrent(testData(10), 16), nil)
+	defer single.Close()
+	multi := NewSession(testMultiFileTorrent(testData(10), 16, 4, 6), nil)
+	defer multi.Close()
+	multi.torrent.Metainfo.Info.Files[1].Path = []string{"my dir", "b#1"}
+	for _, test := range []struct {
+		session *Session
+		url     string
+		file    int
+		want    string
+	}{
+		{single, "http://mirror.example/files/test.bin", 0, "http://mirror.example/files/test.bin"},
+		{single, "http://mirror.example/files/", 0, "http://mirror.example/files/test.bin"},
+		{multi, "http://mirror.example/files", 0, "http://mirror.example/files/root/dir/a"},
+		{multi, "http://mirror.example/files/", 1, "http://mirror.example/files/root/my%20dir/b%231"},
+	} {
+		if got := NewWebSeed(test.session, test.url).fileURL(test.file); got != test.want {
+			t.Errorf("file url bad result - want %v, got %v", test.want, got)
+		}
+	}
+}
+
+func TestSessionDownloadFromWebSeed(t *testing.T) {
+	multiData := testData(5*BlockSize + 123)
+	multi := testMultiFileTorrent(multiData, 2*BlockSize, BlockSize+7, 0, 3*BlockSize, BlockSize+116)
+	hybrid := parseV2(t, testV2Metainfo("hybrid", 2*BlockSize, true, testV2Files()...))
+	hybridData := testV2Data(&hybrid.Metainfo.Info, testV2Files())
+	tests := []struct {
+		name    string
+		torrent *Torrent
+		data    []byte
+	}{
+		{"multi file", multi, multiData},
+		{"padded hybrid", hybrid, hybridData},
+	}
+	for _, test := range tests {
+		server := testWebSeedServer(t, &test.torrent.Metainfo.Info, test.data, 0)
+		session := NewSession(test.torrent, nil)
+		session.AddWebSeeds(server.URL + "/")
+		if err := session.Download(nil); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if downloaded, err := session.Data(); err != nil || !bytes.Equal(downloaded, test.data) {
+			t.Errorf("%v: downloaded data does not match served data (%v)", test.name, err)
+		}
+		if downloaded := session.Stats().Downloaded; downloaded != int64(len(test.data)) {
+			t.Errorf("%v: downloaded bytes bad result - want %d, got %d", test.name, len(test.data), downloaded)
+		}
+		session.Close()
+	}
+}
+
+func TestWebSeedBacksOff(t *testing.T) {
+	data := testData(3*BlockSize + 5)
+	torrent := testTorrent(data, 2*BlockSize)
+	server := testWebSeedServer(t, &torrent.Metainfo.Info, data, 2)
+
+	session := NewSession(torrent, nil)
+	defer session.Close()
+	seed := NewWebSeed(session, server.URL+"/")
+	seed.retryInterval = 10 * time.Millisecond
+	start := time.Now()
+	if err := seed.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("web seed should back off after failures - finished in %v", elapsed)
+	}
+	if downloaded, err := session.Data(); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded data does not match served data (%v)", err)
+	}
+}
+
+func TestWebSeedGivesUpOnBadData(t *testing.T) {
+	data := testData(3*BlockSize + 5)
+	torrent := testTorrent(data, 2*BlockSize)
+	corrupted := append([]byte{}, data...)
+	corrupted[0]++
+	server := testWebSeedServer(t, &torrent.Metainfo.Info, corrupted, 0)
+
+	session := NewSession(torrent, nil)
+	defer session.Close()
+	seed := NewWebSeed(session, server.URL+"/")
+	seed.retryInterval = time.Millisecond
+	// Only the first piece is corrupted, the seed keeps failing on it once
+	// the others are done.
+	if err := seed.Run(nil); !errors.Is(err, ErrWebSeedHash) {
+		t.Errorf("expected ErrWebSeedHash - got: %v", err)
+	}
+	if session.Completed().Has(0) {
+		t.Error("corrupted piece should not be completed")
+	}
+	if progress, ok := session.progress[0]; ok && progress.owner != nil {
+		t.Error("failed piece should be released")
+	}
+}